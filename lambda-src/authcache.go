@@ -0,0 +1,75 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AUTH_REFRESH_MARGIN is how long before expiry a cached token is refreshed. It is longer
+// than the 15 minutes a Lambda invocation can last, so a token handed out for a copy
+// doesn't expire before the invocation ends.
+const AUTH_REFRESH_MARGIN = 20 * time.Minute
+
+// AuthCache holds registry tokens for as long as they are valid, sharing them between the
+// copies of a deployment and across warm invocations.
+type AuthCache struct {
+	mu      sync.Mutex
+	entries map[string]ECRAuth
+	margin  time.Duration
+	now     func() time.Time
+}
+
+// ecrAuthCache lives as long as the Lambda execution environment.
+var ecrAuthCache = NewAuthCache(AUTH_REFRESH_MARGIN)
+
+func NewAuthCache(margin time.Duration) *AuthCache {
+	return &AuthCache{
+		entries: map[string]ECRAuth{},
+		margin:  margin,
+		now:     time.Now,
+	}
+}
+
+// AuthCacheKey identifies the token of a registry requested as role, or with the Lambda's
+// own credentials if role is nil.
+func AuthCacheKey(registry string, role *AssumeRoleConfigs) string {
+	if role == nil {
+		return registry
+	}
+	return fmt.Sprintf("%s|%s|%s", registry, role.RoleArn, role.ExternalId)
+}
+
+// Get returns the cached token of key, calling fetch for a new one if there is none or it
+// expires within the refresh margin. Concurrent calls are serialized, so a token is only
+// fetched once.
+func (c *AuthCache) Get(key string, fetch func() (*ECRAuth, error)) (*ECRAuth, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if auth, ok := c.entries[key]; ok && c.now().Add(c.margin).Before(auth.ExpiresAt) {
+		return &auth, nil
+	}
+	auth, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if !c.now().Add(c.margin).Before(auth.ExpiresAt) {
+		logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_AUTH, "key": key, "expiresAt": auth.ExpiresAt}).Info("Not caching token: it expires too soon")
+		return auth, nil
+	}
+	c.entries[key] = *auth
+	return auth, nil
+}
+
+// Invalidate drops the cached token of key, for instance after the registry rejected it.
+func (c *AuthCache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,119 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+// authCacheKey returns the key the token of opts is cached under, or "" if it isn't cached.
+func authCacheKey(opts *ImageOpts) string {
+	host, authenticator := opts.authenticator()
+	if authenticator == nil {
+		return ""
+	}
+	return authenticator.CacheKey(host)
+}
+
+func TestAuthCacheGet(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewAuthCache(AUTH_REFRESH_MARGIN)
+	cache.now = func() time.Time { return now }
+
+	fetches := 0
+	fetch := func() (*ECRAuth, error) {
+		fetches++
+		return &ECRAuth{User: "AWS", Pass: "token", ExpiresAt: now.Add(time.Hour)}, nil
+	}
+
+	auth, err := cache.Get("registry", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, "token", auth.Pass)
+	_, err = cache.Get("registry", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// Other keys don't share the token.
+	_, err = cache.Get("other", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// Still cached until the refresh margin is reached.
+	now = now.Add(time.Hour - AUTH_REFRESH_MARGIN - time.Second)
+	_, err = cache.Get("registry", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+
+	now = now.Add(time.Second)
+	_, err = cache.Get("registry", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fetches)
+
+	cache.Invalidate("registry")
+	_, err = cache.Get("registry", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fetches)
+}
+
+func TestAuthCacheGetShortLived(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewAuthCache(AUTH_REFRESH_MARGIN)
+	cache.now = func() time.Time { return now }
+
+	fetches := 0
+	fetch := func() (*ECRAuth, error) {
+		fetches++
+		return &ECRAuth{User: "AWS", Pass: "token", ExpiresAt: now.Add(AUTH_REFRESH_MARGIN)}, nil
+	}
+	for i := 0; i < 2; i++ {
+		auth, err := cache.Get("registry", fetch)
+		require.NoError(t, err)
+		assert.Equal(t, "token", auth.Pass)
+	}
+	assert.Equal(t, 2, fetches)
+
+	_, err := cache.Get("failing", func() (*ECRAuth, error) { return nil, errors.New("access denied") })
+	assert.EqualError(t, err, "access denied")
+	assert.Empty(t, cache.entries)
+}
+
+func TestAuthCacheKey(t *testing.T) {
+	role := &AssumeRoleConfigs{RoleArn: "arn:aws:iam::123456789012:role/ecr-push", ExternalId: "ext-123", SessionName: DEFAULT_SESSION_NAME}
+	assert.Equal(t, "public.ecr.aws", AuthCacheKey("public.ecr.aws", nil))
+	assert.Equal(t, "public.ecr.aws|arn:aws:iam::123456789012:role/ecr-push|ext-123", AuthCacheKey("public.ecr.aws", role))
+	assert.NotEqual(t, AuthCacheKey("public.ecr.aws", role), AuthCacheKey("public.ecr.aws", &AssumeRoleConfigs{RoleArn: role.RoleArn}))
+}
+
+func TestImageOptsRefreshAuth(t *testing.T) {
+	opts := NewImageOpts("docker://123456789012.dkr.ecr-fips.us-east-1.amazonaws.com/repo:tag", "amd64", false)
+	key := authCacheKey(opts)
+	assert.Equal(t, "123456789012.dkr.ecr.us-east-1", key)
+
+	ecrAuthCache.entries[key] = ECRAuth{User: "AWS", Pass: "cached", ExpiresAt: time.Now().Add(12 * time.Hour)}
+	defer ecrAuthCache.Invalidate(key)
+
+	// The cached token is used without calling ECR.
+	ctx, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "AWS", Password: "cached"}, ctx.DockerAuthConfig)
+
+	ecrAuthCache.entries[key] = ECRAuth{User: "AWS", Pass: "refreshed", ExpiresAt: time.Now().Add(12 * time.Hour)}
+	require.NoError(t, opts.RefreshAuth(ctx, false))
+	assert.Equal(t, "refreshed", ctx.DockerAuthConfig.Password)
+
+	// Explicit credentials are never replaced.
+	opts.SetCreds(NewStaticAuthenticator("user:pass"))
+	key = authCacheKey(opts)
+	assert.Empty(t, key)
+	ctx, err = opts.NewSystemContext()
+	require.NoError(t, err)
+	require.NoError(t, opts.RefreshAuth(ctx, true))
+	assert.Equal(t, "pass", ctx.DockerAuthConfig.Password)
+}
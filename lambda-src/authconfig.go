@@ -0,0 +1,145 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	dockerconfig "go.podman.io/image/v5/pkg/docker/config"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// AuthConfig is a docker config.json-style document holding credentials per registry.
+type AuthConfig struct {
+	Auths       map[string]AuthConfigEntry `json:"auths"`
+	CredsStore  string                     `json:"credsStore,omitempty"`
+	CredHelpers map[string]string          `json:"credHelpers,omitempty"`
+}
+
+// AuthConfigEntry holds the credentials of a registry, a namespace or a repository.
+type AuthConfigEntry struct {
+	Auth          string `json:"auth,omitempty"`          // base64 of `user:pass`
+	IdentityToken string `json:"identitytoken,omitempty"` // OAuth2 refresh token, used instead of a password
+}
+
+// ParseAuthConfig validates an auth config document. Credential helpers and stores can't
+// run in the Lambda, so documents relying on them are rejected.
+func ParseAuthConfig(doc []byte) (*AuthConfig, error) {
+	authConfig := &AuthConfig{}
+	if err := json.Unmarshal(doc, authConfig); err != nil {
+		return nil, fmt.Errorf("error parsing auth config: %v", err.Error())
+	}
+	if authConfig.CredsStore != "" || len(authConfig.CredHelpers) > 0 {
+		return nil, fmt.Errorf("invalid auth config: credential helpers are not supported, use auths entries")
+	}
+	if len(authConfig.Auths) == 0 {
+		return nil, fmt.Errorf("invalid auth config: no auths entries")
+	}
+	for key, entry := range authConfig.Auths {
+		if entry.Auth == "" && entry.IdentityToken == "" {
+			return nil, fmt.Errorf("invalid auth config: entry %s has neither auth nor identitytoken", key)
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil || !strings.Contains(string(decoded), ":") {
+				return nil, fmt.Errorf("invalid auth config: auth of entry %s is not base64 of user:pass", key)
+			}
+		}
+	}
+	return authConfig, nil
+}
+
+// GetAuthConfig loads the SrcAuthConfig or DestAuthConfig property: an inline document, an
+// `s3://bucket/key` URI, an SSM parameter (`ssm:<name>` or parameter ARN) or a Secrets
+// Manager secret name or ARN holding the document. An empty property returns nil.
+func GetAuthConfig(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var doc []byte
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(s), "{"):
+		doc = []byte(s)
+	case strings.HasPrefix(s, "s3://"):
+		b, err := GetS3Object(s, iolimits.MaxAuthConfigBodySize)
+		if err != nil {
+			return nil, err
+		}
+		doc = b
+	case IsSSMParameterRef(s):
+		v, err := GetSSMParameter(s)
+		if err != nil {
+			return nil, err
+		}
+		doc = []byte(v)
+	default:
+		v, err := GetSecret(s)
+		if err != nil {
+			return nil, err
+		}
+		doc = []byte(v)
+	}
+
+	if _, err := ParseAuthConfig(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// LookupAuthConfig returns the credentials doc holds for the image uri, matching entries the
+// way container tools do: the most specific repository or namespace entry wins over the
+// registry one. It returns empty credentials if there is no matching entry.
+func LookupAuthConfig(doc []byte, uri string) (*types.DockerAuthConfig, error) {
+	ref, err := alltransports.ParseImageName(uri)
+	if err != nil {
+		return nil, err
+	}
+	named := ref.DockerReference()
+	if named == nil {
+		return &types.DockerAuthConfig{}, nil
+	}
+	authConfig, err := ParseAuthConfig(doc)
+	if err != nil {
+		return nil, err
+	}
+	for key, entry := range authConfig.Auths {
+		// Entries are only read with an auth; docker writes `<token>:` along identity tokens.
+		if entry.Auth == "" {
+			entry.Auth = base64.StdEncoding.EncodeToString([]byte("<token>:"))
+			authConfig.Auths[key] = entry
+		}
+	}
+	normalized, err := json.Marshal(authConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// The lookup only reads files, so the document lives on disk just for its duration.
+	f, err := os.CreateTemp("", "auth-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(normalized)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := dockerconfig.GetCredentialsForRef(&types.SystemContext{AuthFilePath: f.Name()}, named)
+	if err != nil {
+		return nil, fmt.Errorf("error reading auth config: %v", err.Error())
+	}
+	return &creds, nil
+}
@@ -0,0 +1,138 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+func basicAuth(user string, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
+
+var testAuthConfig = fmt.Sprintf(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "%s"},
+		"ghcr.io": {"identitytoken": "ghcr-refresh-token"},
+		"quay.io": {"auth": "%s"},
+		"quay.io/team": {"auth": "%s"}
+	}
+}`, basicAuth("hubuser", "hubpass"), basicAuth("quayuser", "quaypass"), basicAuth("teamuser", "teampass"))
+
+func TestParseAuthConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{"valid", testAuthConfig, ""},
+		{"not JSON", "user:pass", "error parsing auth config"},
+		{"no auths", `{"auths": {}}`, "no auths entries"},
+		{"creds store", `{"auths": {"ghcr.io": {"identitytoken": "t"}}, "credsStore": "desktop"}`, "credential helpers are not supported"},
+		{"cred helpers", `{"credHelpers": {"gcr.io": "gcloud"}}`, "credential helpers are not supported"},
+		{"empty entry", `{"auths": {"ghcr.io": {}}}`, "neither auth nor identitytoken"},
+		{"invalid auth", `{"auths": {"ghcr.io": {"auth": "not-base64!"}}}`, "not base64 of user:pass"},
+		{"auth without colon", fmt.Sprintf(`{"auths": {"ghcr.io": {"auth": "%s"}}}`, base64.StdEncoding.EncodeToString([]byte("token"))), "not base64 of user:pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseAuthConfig([]byte(tt.doc))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGetAuthConfig(t *testing.T) {
+	doc, err := GetAuthConfig("")
+	assert.NoError(t, err)
+	assert.Nil(t, doc)
+
+	doc, err = GetAuthConfig(testAuthConfig)
+	require.NoError(t, err)
+	assert.Equal(t, testAuthConfig, string(doc))
+
+	_, err = GetAuthConfig(`{"auths": {}}`)
+	assert.ErrorContains(t, err, "no auths entries")
+}
+
+func TestLookupAuthConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want types.DockerAuthConfig
+	}{
+		{"Docker Hub", "docker://nginx:latest", types.DockerAuthConfig{Username: "hubuser", Password: "hubpass"}},
+		{"identity token", "docker://ghcr.io/owner/repo:v1", types.DockerAuthConfig{Username: "<token>", IdentityToken: "ghcr-refresh-token"}},
+		{"registry entry", "docker://quay.io/org/repo:v1", types.DockerAuthConfig{Username: "quayuser", Password: "quaypass"}},
+		{"namespace entry", "docker://quay.io/team/repo:v1", types.DockerAuthConfig{Username: "teamuser", Password: "teampass"}},
+		{"no entry", "docker://registry.example.com/repo:v1", types.DockerAuthConfig{}},
+		{"not a registry", "dir:/tmp/image", types.DockerAuthConfig{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := LookupAuthConfig([]byte(testAuthConfig), tt.uri)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *auth)
+		})
+	}
+}
+
+func TestNewSystemContextAuthConfig(t *testing.T) {
+	opts := NewImageOpts("docker://ghcr.io/owner/repo:v1", "amd64", false)
+	opts.SetAuthConfig([]byte(testAuthConfig))
+	ctx, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, "ghcr-refresh-token", ctx.DockerAuthConfig.IdentityToken)
+
+	// Registries without an entry keep ECR auto login.
+	opts = NewImageOpts("docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/repo:tag", "amd64", false)
+	opts.SetAuthConfig([]byte(testAuthConfig))
+	key := authCacheKey(opts)
+	assert.Equal(t, "123456789012.dkr.ecr.us-west-2", key)
+	ecrAuthCache.entries[key] = ECRAuth{User: "AWS", Pass: "cached", ExpiresAt: time.Now().Add(12 * time.Hour)}
+	defer ecrAuthCache.Invalidate(key)
+	ctx, err = opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "AWS", Password: "cached"}, ctx.DockerAuthConfig)
+
+	// An entry replaces ECR auto login, so no token is requested.
+	withECR := strings.Replace(testAuthConfig, `"ghcr.io"`, `"123456789012.dkr.ecr.us-west-2.amazonaws.com": {"auth": "`+basicAuth("AWS", "from-config")+`"}, "ghcr.io"`, 1)
+	opts.SetAuthConfig([]byte(withECR))
+	assert.Empty(t, authCacheKey(opts))
+	ctx, err = opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, "from-config", ctx.DockerAuthConfig.Password)
+
+	// Without an entry nor another login, the registry is accessed anonymously.
+	opts = NewImageOpts("docker://registry.example.com/repo:tag", "amd64", false)
+	opts.SetAuthConfig([]byte(testAuthConfig))
+	ctx, err = opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{}, ctx.DockerAuthConfig)
+}
+
+func TestGetAuthConfigProps(t *testing.T) {
+	doc, err := getAuthConfigProps(map[string]interface{}{SRC_AUTH_CONFIG: testAuthConfig}, SRC_AUTH_CONFIG, SRC_CREDS)
+	require.NoError(t, err)
+	assert.Equal(t, testAuthConfig, string(doc))
+
+	doc, err = getAuthConfigProps(map[string]interface{}{}, DEST_AUTH_CONFIG, DEST_CREDS)
+	assert.NoError(t, err)
+	assert.Nil(t, doc)
+
+	_, err = getAuthConfigProps(map[string]interface{}{DEST_AUTH_CONFIG: testAuthConfig, DEST_CREDS: "user:pass"}, DEST_AUTH_CONFIG, DEST_CREDS)
+	assert.ErrorContains(t, err, "DestAuthConfig and DestCreds can't be both set")
+}
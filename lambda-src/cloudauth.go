@@ -0,0 +1,460 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+const (
+	gcpTokenURL             = "https://oauth2.googleapis.com/token"
+	gcpSTSTokenURL          = "https://sts.googleapis.com/v1/token"
+	gcpIAMCredentialsURL    = "https://iamcredentials.googleapis.com"
+	gcpCloudPlatformScope   = "https://www.googleapis.com/auth/cloud-platform"
+	gcpRegistryUser         = "oauth2accesstoken"
+	azureLoginURL           = "https://login.microsoftonline.com"
+	azureRegistryScope      = "https://containerregistry.azure.net/.default"
+	azureRegistryUser       = "00000000-0000-0000-0000-000000000000"
+	githubAPIURL            = "https://api.github.com"
+	githubRegistryUser      = "x-access-token"
+	defaultCloudTokenExpiry = time.Hour
+)
+
+// GCPServiceAccountAuthenticator exchanges a service account key for an access token, with
+// the OAuth 2.0 JWT bearer grant.
+type GCPServiceAccountAuthenticator struct {
+	client       *http.Client
+	clientEmail  string
+	privateKeyId string
+	privateKey   *rsa.PrivateKey
+	tokenURL     string
+}
+
+// NewGCPServiceAccountAuthenticator parses the JSON key of a service account.
+func NewGCPServiceAccountAuthenticator(keyJSON []byte, client *http.Client) (*GCPServiceAccountAuthenticator, error) {
+	var key struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyId string `json:"private_key_id"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		return nil, fmt.Errorf("invalid gcp service account key: %v", err.Error())
+	}
+	if key.Type != "service_account" || key.ClientEmail == "" {
+		return nil, fmt.Errorf("invalid gcp service account key: not a service account key")
+	}
+	privateKey, err := parseRSAPrivateKey([]byte(key.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gcp service account key: %v", err.Error())
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = gcpTokenURL
+	}
+	return &GCPServiceAccountAuthenticator{
+		client:       client,
+		clientEmail:  key.ClientEmail,
+		privateKeyId: key.PrivateKeyId,
+		privateKey:   privateKey,
+		tokenURL:     key.TokenURI,
+	}, nil
+}
+
+func (a *GCPServiceAccountAuthenticator) CacheKey(host string) string {
+	return "gcp|" + a.clientEmail
+}
+
+func (a *GCPServiceAccountAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	now := time.Now()
+	assertion, err := signJWT(a.privateKey, a.privateKeyId, map[string]any{
+		"iss":   a.clientEmail,
+		"scope": gcpCloudPlatformScope,
+		"aud":   a.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = postForm(ctx, a.client, a.tokenURL, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}, &token)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching gcp access token: %v", err.Error())
+	}
+	return &ECRAuth{User: gcpRegistryUser, Pass: token.AccessToken, ExpiresAt: expiresIn(now, token.ExpiresIn)}, nil
+}
+
+// GCPWorkloadIdentityAuthenticator federates the Lambda's AWS identity into GCP: a signed
+// sts:GetCallerIdentity request is exchanged for a federated token, which is used as-is or
+// to impersonate a service account.
+type GCPWorkloadIdentityAuthenticator struct {
+	client              *http.Client
+	audience            string
+	serviceAccountEmail string
+	awsConfig           *aws.Config // Loaded from the environment if nil
+	stsTokenURL         string
+	iamCredentialsURL   string
+}
+
+func NewGCPWorkloadIdentityAuthenticator(audience string, serviceAccountEmail string, awsConfig *aws.Config, client *http.Client) *GCPWorkloadIdentityAuthenticator {
+	return &GCPWorkloadIdentityAuthenticator{
+		client:              client,
+		audience:            audience,
+		serviceAccountEmail: serviceAccountEmail,
+		awsConfig:           awsConfig,
+		stsTokenURL:         gcpSTSTokenURL,
+		iamCredentialsURL:   gcpIAMCredentialsURL,
+	}
+}
+
+func (a *GCPWorkloadIdentityAuthenticator) CacheKey(host string) string {
+	return fmt.Sprintf("gcp|%s|%s", a.audience, a.serviceAccountEmail)
+}
+
+func (a *GCPWorkloadIdentityAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	subjectToken, err := a.awsSubjectToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var federated struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = postForm(ctx, a.client, a.stsTokenURL, url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {a.audience},
+		"scope":                {gcpCloudPlatformScope},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token_type":   {"urn:ietf:params:aws:token-type:aws4_request"},
+		"subject_token":        {subjectToken},
+	}, &federated)
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging aws identity for a gcp token: %v", err.Error())
+	}
+	if a.serviceAccountEmail == "" {
+		return &ECRAuth{User: gcpRegistryUser, Pass: federated.AccessToken, ExpiresAt: expiresIn(now, federated.ExpiresIn)}, nil
+	}
+
+	body, err := json.Marshal(map[string]any{"scope": []string{gcpCloudPlatformScope}})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken", a.iamCredentialsURL, url.PathEscape(a.serviceAccountEmail))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+federated.AccessToken)
+	var impersonated struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := doTokenRequest(a.client, req, &impersonated); err != nil {
+		return nil, fmt.Errorf("error impersonating gcp service account %s: %v", a.serviceAccountEmail, err.Error())
+	}
+	return &ECRAuth{User: gcpRegistryUser, Pass: impersonated.AccessToken, ExpiresAt: impersonated.ExpireTime}, nil
+}
+
+// awsSubjectToken serializes a signed sts:GetCallerIdentity request, which GCP replays to
+// verify the AWS identity.
+func (a *GCPWorkloadIdentityAuthenticator) awsSubjectToken(ctx context.Context) (string, error) {
+	cfg := a.awsConfig
+	if cfg == nil {
+		loaded, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return "", fmt.Errorf("api client configuration error: %v", err.Error())
+		}
+		cfg = &loaded
+	}
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving aws credentials: %v", err.Error())
+	}
+
+	endpoint := fmt.Sprintf("https://sts.%s.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15", cfg.Region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-goog-cloud-target-resource", a.audience)
+	emptyHash := sha256.Sum256(nil)
+	if err := v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(emptyHash[:]), "sts", cfg.Region, time.Now()); err != nil {
+		return "", fmt.Errorf("error signing aws identity request: %v", err.Error())
+	}
+
+	headers := []map[string]string{
+		{"key": "host", "value": req.URL.Host},
+	}
+	for _, key := range []string{"Authorization", "X-Amz-Date", "X-Amz-Security-Token", "X-Goog-Cloud-Target-Resource"} {
+		if v := req.Header.Get(key); v != "" {
+			headers = append(headers, map[string]string{"key": strings.ToLower(key), "value": v})
+		}
+	}
+	token, err := json.Marshal(map[string]any{
+		"url":     endpoint,
+		"method":  http.MethodPost,
+		"headers": headers,
+	})
+	if err != nil {
+		return "", err
+	}
+	return url.QueryEscape(string(token)), nil
+}
+
+// AzureAuthenticator exchanges the Azure AD token of a service principal for an ACR refresh
+// token, which registries accept as the password of a null GUID user.
+type AzureAuthenticator struct {
+	client       *http.Client
+	tenantId     string
+	clientId     string
+	clientSecret string
+	loginURL     string
+	scheme       string // Scheme of the registry exchange endpoint
+}
+
+func NewAzureAuthenticator(tenantId string, clientId string, clientSecret string, client *http.Client) *AzureAuthenticator {
+	return &AzureAuthenticator{
+		client:       client,
+		tenantId:     tenantId,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		loginURL:     azureLoginURL,
+		scheme:       "https",
+	}
+}
+
+func (a *AzureAuthenticator) CacheKey(host string) string {
+	return fmt.Sprintf("azure|%s|%s|%s", host, a.tenantId, a.clientId)
+}
+
+func (a *AzureAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	now := time.Now()
+	var aad struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err := postForm(ctx, a.client, fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.loginURL, url.PathEscape(a.tenantId)), url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.clientId},
+		"client_secret": {a.clientSecret},
+		"scope":         {azureRegistryScope},
+	}, &aad)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching azure ad token: %v", err.Error())
+	}
+
+	var acr struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err = postForm(ctx, a.client, fmt.Sprintf("%s://%s/oauth2/exchange", a.scheme, host), url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"tenant":       {a.tenantId},
+		"access_token": {aad.AccessToken},
+	}, &acr)
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging azure ad token with %s: %v", host, err.Error())
+	}
+	expiresAt, ok := jwtExpiry(acr.RefreshToken)
+	if !ok {
+		expiresAt = expiresIn(now, aad.ExpiresIn)
+	}
+	return &ECRAuth{User: azureRegistryUser, Pass: acr.RefreshToken, ExpiresAt: expiresAt}, nil
+}
+
+// GitHubAppAuthenticator authenticates as a GitHub App installation, whose tokens can read
+// and write the packages the installation has access to.
+type GitHubAppAuthenticator struct {
+	client         *http.Client
+	appId          string
+	installationId string
+	privateKey     *rsa.PrivateKey
+	apiURL         string
+}
+
+func NewGitHubAppAuthenticator(appId string, installationId string, privateKeyPEM []byte, client *http.Client) (*GitHubAppAuthenticator, error) {
+	privateKey, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github app private key: %v", err.Error())
+	}
+	return &GitHubAppAuthenticator{
+		client:         client,
+		appId:          appId,
+		installationId: installationId,
+		privateKey:     privateKey,
+		apiURL:         githubAPIURL,
+	}, nil
+}
+
+func (a *GitHubAppAuthenticator) CacheKey(host string) string {
+	return fmt.Sprintf("github|%s|%s", a.appId, a.installationId)
+}
+
+func (a *GitHubAppAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	now := time.Now()
+	// Backdated to allow for clock drift, as GitHub recommends; app JWTs last 10 minutes at most.
+	appJWT, err := signJWT(a.privateKey, "", map[string]any{
+		"iss": a.appId,
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/app/installations/%s/access_tokens", a.apiURL, url.PathEscape(a.installationId))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+appJWT)
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := doTokenRequest(a.client, req, &token); err != nil {
+		return nil, fmt.Errorf("error fetching github app installation token: %v", err.Error())
+	}
+	return &ECRAuth{User: githubRegistryUser, Pass: token.Token, ExpiresAt: token.ExpiresAt}, nil
+}
+
+// postForm posts a URL-encoded form and decodes the JSON response into v.
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(client, req, v)
+}
+
+// doTokenRequest sends req and decodes the JSON response into v. The response body isn't
+// included in errors, as it may echo credentials.
+func doTokenRequest(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, iolimits.MaxErrorBodySize))
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	b, err := iolimits.ReadAtMost(resp.Body, iolimits.MaxAuthTokenBodySize)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error parsing token response: %v", err.Error())
+	}
+	return nil
+}
+
+// signJWT returns an RS256 JSON Web Token of claims.
+func signJWT(key *rsa.PrivateKey, keyId string, claims map[string]any) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if keyId != "" {
+		header["kid"] = keyId
+	}
+	encode := func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+	h, err := encode(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := encode(claims)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(h + "." + c))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return h + "." + c + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// jwtExpiry reads the exp claim of a JWT without verifying it.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
+
+// expiresIn returns when a token issued at now expires, defaulting to an hour if the
+// response didn't say.
+func expiresIn(now time.Time, seconds int64) time.Time {
+	if seconds <= 0 {
+		return now.Add(defaultCloudTokenExpiry)
+	}
+	return now.Add(time.Duration(seconds) * time.Second)
+}
+
+// parseRSAPrivateKey parses a PEM-encoded PKCS #8 or PKCS #1 RSA private key.
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return rsaKey, nil
+}
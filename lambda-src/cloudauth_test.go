@@ -0,0 +1,230 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// verifyJWT checks the RS256 signature of token and returns its claims.
+func verifyJWT(t *testing.T, key *rsa.PublicKey, token string) map[string]any {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	require.NoError(t, rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig))
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	claims := map[string]any{}
+	require.NoError(t, json.Unmarshal(b, &claims))
+	return claims
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestGCPServiceAccountAuthenticator(t *testing.T) {
+	key, keyPEM := generateRSAKey(t)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+		claims := verifyJWT(t, &key.PublicKey, r.PostForm.Get("assertion"))
+		assert.Equal(t, "deployer@project.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, server.URL+"/token", claims["aud"])
+		assert.Equal(t, gcpCloudPlatformScope, claims["scope"])
+		writeJSON(w, map[string]any{"access_token": "gcp-access-token", "expires_in": 3599})
+	}))
+	defer server.Close()
+
+	keyJSON, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "deployer@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(keyPEM),
+		"token_uri":      server.URL + "/token",
+	})
+	require.NoError(t, err)
+	a, err := NewGCPServiceAccountAuthenticator(keyJSON, server.Client())
+	require.NoError(t, err)
+
+	auth, err := a.Authenticate(context.Background(), "us-docker.pkg.dev")
+	require.NoError(t, err)
+	assert.Equal(t, gcpRegistryUser, auth.User)
+	assert.Equal(t, "gcp-access-token", auth.Pass)
+	assert.WithinDuration(t, time.Now().Add(3599*time.Second), auth.ExpiresAt, time.Minute)
+
+	_, err = NewGCPServiceAccountAuthenticator([]byte(`{"type": "authorized_user"}`), server.Client())
+	assert.ErrorContains(t, err, "not a service account key")
+}
+
+func TestGCPWorkloadIdentityAuthenticator(t *testing.T) {
+	audience := "//iam.googleapis.com/projects/123/locations/global/workloadIdentityPools/aws/providers/lambda"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, audience, r.PostForm.Get("audience"))
+		assert.Equal(t, "urn:ietf:params:aws:token-type:aws4_request", r.PostForm.Get("subject_token_type"))
+
+		// The subject token is the signed GetCallerIdentity request, for GCP to replay.
+		decoded, err := url.QueryUnescape(r.PostForm.Get("subject_token"))
+		require.NoError(t, err)
+		var subject struct {
+			URL     string              `json:"url"`
+			Method  string              `json:"method"`
+			Headers []map[string]string `json:"headers"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(decoded), &subject))
+		assert.Equal(t, "https://sts.eu-west-1.amazonaws.com?Action=GetCallerIdentity&Version=2011-06-15", subject.URL)
+		assert.Equal(t, http.MethodPost, subject.Method)
+		headers := map[string]string{}
+		for _, h := range subject.Headers {
+			headers[h["key"]] = h["value"]
+		}
+		assert.Equal(t, "sts.eu-west-1.amazonaws.com", headers["host"])
+		assert.Equal(t, audience, headers["x-goog-cloud-target-resource"])
+		assert.Equal(t, "session-token", headers["x-amz-security-token"])
+		assert.Contains(t, headers["authorization"], "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/")
+
+		writeJSON(w, map[string]any{"access_token": "federated-token", "expires_in": 3600})
+	})
+	mux.HandleFunc("/v1/projects/-/serviceAccounts/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/projects/-/serviceAccounts/deployer@project.iam.gserviceaccount.com:generateAccessToken", r.URL.Path)
+		assert.Equal(t, "Bearer federated-token", r.Header.Get("Authorization"))
+		writeJSON(w, map[string]any{"accessToken": "impersonated-token", "expireTime": "2026-01-01T01:00:00Z"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	awsConfig := &aws.Config{
+		Region:      "eu-west-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", "session-token"),
+	}
+	tests := []struct {
+		name                string
+		serviceAccountEmail string
+		wantPass            string
+	}{
+		{"federated token", "", "federated-token"},
+		{"impersonation", "deployer@project.iam.gserviceaccount.com", "impersonated-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewGCPWorkloadIdentityAuthenticator(audience, tt.serviceAccountEmail, awsConfig, server.Client())
+			a.stsTokenURL = server.URL + "/v1/token"
+			a.iamCredentialsURL = server.URL
+			auth, err := a.Authenticate(context.Background(), "gcr.io")
+			require.NoError(t, err)
+			assert.Equal(t, gcpRegistryUser, auth.User)
+			assert.Equal(t, tt.wantPass, auth.Pass)
+		})
+	}
+}
+
+func TestAzureAuthenticator(t *testing.T) {
+	refreshToken, err := signJWT(mustRSAKey(t), "", map[string]any{"exp": int64(1767229200)})
+	require.NoError(t, err)
+
+	login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/tenant-1/oauth2/v2.0/token", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "client-1", r.PostForm.Get("client_id"))
+		assert.Equal(t, "client-secret", r.PostForm.Get("client_secret"))
+		writeJSON(w, map[string]any{"access_token": "aad-token", "expires_in": 3600})
+	}))
+	defer login.Close()
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/oauth2/exchange", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "access_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "aad-token", r.PostForm.Get("access_token"))
+		assert.Equal(t, r.Host, r.PostForm.Get("service"))
+		writeJSON(w, map[string]any{"refresh_token": refreshToken})
+	}))
+	defer registry.Close()
+
+	a := NewAzureAuthenticator("tenant-1", "client-1", "client-secret", registry.Client())
+	a.loginURL = login.URL
+	host := strings.TrimPrefix(registry.URL, "https://")
+	auth, err := a.Authenticate(context.Background(), host)
+	require.NoError(t, err)
+	assert.Equal(t, azureRegistryUser, auth.User)
+	assert.Equal(t, refreshToken, auth.Pass)
+	assert.Equal(t, time.Unix(1767229200, 0), auth.ExpiresAt)
+
+	// Refresh tokens are scoped to a registry.
+	assert.NotEqual(t, a.CacheKey("one.azurecr.io"), a.CacheKey("two.azurecr.io"))
+}
+
+func TestGitHubAppAuthenticator(t *testing.T) {
+	key, keyPEM := generateRSAKey(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/app/installations/42/access_tokens", r.URL.Path)
+		claims := verifyJWT(t, &key.PublicKey, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		assert.Equal(t, "1234", claims["iss"])
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]any{"token": "ghs_installation", "expires_at": "2026-01-01T01:00:00Z"})
+	}))
+	defer server.Close()
+
+	a, err := NewGitHubAppAuthenticator("1234", "42", keyPEM, server.Client())
+	require.NoError(t, err)
+	a.apiURL = server.URL
+	auth, err := a.Authenticate(context.Background(), "ghcr.io")
+	require.NoError(t, err)
+	assert.Equal(t, &ECRAuth{User: githubRegistryUser, Pass: "ghs_installation", ExpiresAt: time.Date(2026, 1, 1, 1, 0, 0, 0, time.UTC)}, auth)
+
+	_, err = NewGitHubAppAuthenticator("1234", "42", []byte("not a key"), server.Client())
+	assert.ErrorContains(t, err, "invalid github app private key")
+}
+
+func TestDoTokenRequestError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid_client", "client_secret": "client-secret"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	err := postForm(context.Background(), server.Client(), server.URL+"/token", url.Values{"client_secret": {"client-secret"}}, &struct{}{})
+	assert.EqualError(t, err, fmt.Sprintf("POST %s/token: 401 Unauthorized", server.URL))
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, _ := generateRSAKey(t)
+	return key
+}
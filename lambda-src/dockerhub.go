@@ -0,0 +1,221 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+)
+
+// DOCKER_HUB_DOMAIN is the domain of Docker Hub image references.
+const DOCKER_HUB_DOMAIN = "docker.io"
+
+// dockerHubRegistryHost is the host serving the registry API of Docker Hub.
+var dockerHubRegistryHost = "registry-1.docker.io"
+
+// Docker Hub configuration: whether the pull quota left is checked before copying a Docker Hub
+// image, and the ECR pull-through cache to pull it from instead when the quota is too low.
+type DockerHubConfigs struct {
+	CheckRateLimit *bool `json:"checkRateLimit,omitempty"` // Whether to check the pull quota left before copying, true by default
+	// The ECR pull-through cache of Docker Hub to copy from when the quota is too low, such as
+	// `123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub`
+	PullThroughCachePrefix *string `json:"pullThroughCachePrefix,omitempty"`
+}
+
+// GetDockerHubConfigs parses the DockerHubConfigs property.
+func GetDockerHubConfigs(data string) (*DockerHubConfigs, error) {
+	config := DockerHubConfigs{
+		CheckRateLimit: aws.Bool(true),
+	}
+
+	if data != "" {
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("unable to parse docker hub configuration from data: %v with error: %v", data, err)
+		}
+	}
+	if err := config.ValidateFields(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ValidateFields checks that the pull-through cache prefix is a repository prefix in ECR.
+func (dc *DockerHubConfigs) ValidateFields() error {
+	if dc.PullThroughCachePrefix != nil {
+		if err := ValidatePullThroughCachePrefix(*dc.PullThroughCachePrefix); err != nil {
+			return fmt.Errorf("pullThroughCachePrefix: %v", err)
+		}
+	}
+	return nil
+}
+
+// DockerHubRateLimit is the pull quota Docker Hub has left for the Lambda: per IP address when
+// anonymous, per account when authenticated.
+type DockerHubRateLimit struct {
+	Limit     int           // Pulls allowed per window
+	Remaining int           // Pulls left in the current window
+	Window    time.Duration // Length of the window
+	Required  int           // Manifest pulls the copy is going to make, 0 if unknown as the quota is used up
+	// Whether Docker Hub refused the check with a 429 response, as the quota is used up
+	Exhausted bool
+	// The wait for the quota to come back when it is used up: the Retry-After or reset header of
+	// the 429 response, or else the window
+	RetryAfter time.Duration
+}
+
+// Sufficient reports whether the quota left covers the pulls of the copy.
+func (l *DockerHubRateLimit) Sufficient() bool {
+	return !l.Exhausted && l.Remaining >= l.Required
+}
+
+// DockerHubRateLimitError is returned when the Docker Hub pull quota left is too low for a copy.
+type DockerHubRateLimitError struct {
+	Image     string
+	RateLimit *DockerHubRateLimit
+}
+
+func (e *DockerHubRateLimitError) Error() string {
+	const advice = "Authenticate with SrcCreds for a higher limit, set pullThroughCachePrefix in DockerHubConfigs to copy from an ECR pull-through cache, " +
+		"or retry once the window resets"
+	if e.RateLimit.Exhausted {
+		return fmt.Sprintf("docker hub pull rate limit used up copying %s: %d pulls per %v, back in %v. %s",
+			e.Image, e.RateLimit.Limit, e.RateLimit.Window, e.RateLimit.RetryAfter, advice)
+	}
+	return fmt.Sprintf("docker hub pull rate limit too low to copy %s: %d of %d pulls left per %v, the copy needs %d. %s",
+		e.Image, e.RateLimit.Remaining, e.RateLimit.Limit, e.RateLimit.Window, e.RateLimit.Required, advice)
+}
+
+// RetryAfter returns the wait for a used up quota to come back, so that the copy is retried
+// then. A quota too low for the copy is not waited for.
+func (e *DockerHubRateLimitError) RetryAfter() time.Duration {
+	return e.RateLimit.RetryAfter
+}
+
+// CheckDockerHubRateLimit returns the pull quota Docker Hub has left for copying the image of
+// ref with the credentials in sys, or nil if Docker Hub sets no limit. The quota is read from the
+// ratelimit headers of a HEAD request on the manifest, which is not counted as a pull. The
+// instances of an image index copied whole are only known by reading it, which is a pull too.
+// copyImage reads each manifest twice when inspectsSource is set: once to inspect the source,
+// and once to copy it. A 429 response means the quota is used up, whatever the copy needs.
+func CheckDockerHubRateLimit(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, copyImageIndex bool, inspectsSource bool) (*DockerHubRateLimit, error) {
+	named := ref.DockerReference()
+	resp, err := doManifestRequest(ctx, sys, http.MethodHead, named)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return exhaustedDockerHubRateLimit(resp), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error checking docker hub rate limit of %s: %w", named, NewRegistryResponseError(resp))
+	}
+
+	manifests := 1
+	mimeType := manifest.NormalizedMIMEType(resp.Header.Get("Content-Type"))
+	if manifest.MIMETypeIsMultiImage(mimeType) {
+		if !copyImageIndex {
+			// The index, and the instance selected from it.
+			manifests = 2
+		} else {
+			resp, err = doManifestRequest(ctx, sys, http.MethodGet, named)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusTooManyRequests {
+				return exhaustedDockerHubRateLimit(resp), nil
+			}
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("error checking docker hub rate limit of %s: %w", named, NewRegistryResponseError(resp))
+			}
+			b, err := iolimits.ReadAtMost(resp.Body, iolimits.MaxManifestBodySize)
+			if err != nil {
+				return nil, err
+			}
+			list, err := manifest.ListFromBlob(b, mimeType)
+			if err != nil {
+				return nil, err
+			}
+			manifests = 1 + len(list.Instances())
+		}
+	}
+
+	limit, window, ok := parseRateLimitHeader(resp.Header.Get("RateLimit-Limit"))
+	if !ok {
+		return nil, nil
+	}
+	remaining, _, ok := parseRateLimitHeader(resp.Header.Get("RateLimit-Remaining"))
+	if !ok {
+		return nil, nil
+	}
+	if inspectsSource {
+		manifests *= 2
+	}
+	return &DockerHubRateLimit{Limit: limit, Remaining: remaining, Window: window, Required: manifests}, nil
+}
+
+// exhaustedDockerHubRateLimit returns the quota of the 429 response resp, which is used up. The
+// quota comes back after the Retry-After or reset header of resp, or within the window at most.
+func exhaustedDockerHubRateLimit(resp *http.Response) *DockerHubRateLimit {
+	limit, window, _ := parseRateLimitHeader(resp.Header.Get("RateLimit-Limit"))
+	retryAfter, ok := ParseRetryAfterHeaders(resp.Header, time.Now())
+	if !ok {
+		retryAfter = window
+	}
+	return &DockerHubRateLimit{Limit: limit, Window: window, Exhausted: true, RetryAfter: retryAfter}
+}
+
+// doManifestRequest sends a request for the manifest of named to Docker Hub.
+func doManifestRequest(ctx context.Context, sys *types.SystemContext, method string, named reference.Named) (*http.Response, error) {
+	tagOrDigest := "latest"
+	if digested, ok := named.(reference.Canonical); ok {
+		tagOrDigest = digested.Digest().String()
+	} else if tagged, ok := named.(reference.NamedTagged); ok {
+		tagOrDigest = tagged.Tag()
+	}
+	path := reference.Path(named)
+	endpoint := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryEndpointHost(named), path, tagOrDigest)
+	return doRegistryRequest(ctx, sys, method, endpoint, strings.Join(manifest.DefaultRequestedManifestMIMETypes, ", "), fmt.Sprintf("repository:%s:pull", path))
+}
+
+// parseRateLimitHeader parses a Docker Hub ratelimit header such as `100;w=21600`: a number of
+// pulls, and the window they are counted over in seconds.
+func parseRateLimitHeader(v string) (int, time.Duration, bool) {
+	countValue, params, _ := strings.Cut(v, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(countValue))
+	if err != nil || count < 0 {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, param := range strings.Split(params, ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && k == "w" {
+			if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return count, window, true
+}
+
+// isDockerHubImage reports whether ref is an image in Docker Hub.
+func isDockerHubImage(ref types.ImageReference) bool {
+	return ref.Transport().Name() == docker.Transport.Name() && ref.DockerReference() != nil &&
+		reference.Domain(ref.DockerReference()) == DOCKER_HUB_DOMAIN
+}
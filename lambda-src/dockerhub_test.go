@@ -0,0 +1,248 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+func TestGetDockerHubConfigs(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantCheck bool
+		wantErr   string
+	}{
+		{"default", "", true, ""},
+		{"disabled", `{"checkRateLimit": false}`, false, ""},
+		{"cache", `{"pullThroughCachePrefix": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub"}`, true, ""},
+		{"cache not in ECR", `{"pullThroughCachePrefix": "mirror.gcr.io/docker-hub"}`, false, "is not in a private ECR registry"},
+		{"cache without prefix", `{"pullThroughCachePrefix": "123456789012.dkr.ecr.us-west-2.amazonaws.com"}`, false, "is not a repository prefix"},
+		{"invalid cache prefix", `{"pullThroughCachePrefix": "123456789012.dkr.ecr.us-west-2.amazonaws.com/Docker-Hub"}`, false, "is not a repository prefix"},
+		{"unknown field", `{"fallback": true}`, false, "unable to parse docker hub configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs, err := GetDockerHubConfigs(tt.data)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCheck, aws.ToBool(configs.CheckRateLimit))
+		})
+	}
+}
+
+func TestParseRateLimitHeader(t *testing.T) {
+	tests := []struct {
+		header     string
+		wantCount  int
+		wantWindow time.Duration
+		wantOk     bool
+	}{
+		{"100;w=21600", 100, 6 * time.Hour, true},
+		{"0;w=21600", 0, 6 * time.Hour, true},
+		{"76", 76, 0, true},
+		{"", 0, 0, false},
+		{"-1;w=60", 0, 0, false},
+		{"many;w=60", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			count, window, ok := parseRateLimitHeader(tt.header)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantCount, count)
+			assert.Equal(t, tt.wantWindow, window)
+		})
+	}
+}
+
+// newDockerHubServer serves library/nginx behind anonymous bearer auth, as Docker Hub does, with
+// the ratelimit headers of remaining pulls out of 100. Tag index is an image index of two images.
+// The first manifest requests of each method in throttled are refused with a 429 response asking
+// to wait a second.
+func newDockerHubServer(t *testing.T, remaining string, throttled map[string]int) *httptest.Server {
+	var server *httptest.Server
+	var mu sync.Mutex
+	throttle := func(method string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if throttled[method] == 0 {
+			return false
+		}
+		throttled[method]--
+		return true
+	}
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:library/nginx:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"t0ken"}`))
+			return
+		case r.Header.Get("Authorization") != "Bearer t0ken":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry.docker.io"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.Contains(r.URL.Path, "/manifests/") && throttle(r.Method) {
+			w.Header().Set("RateLimit-Limit", "100;w=21600")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if remaining != "" {
+			w.Header().Set("RateLimit-Limit", "100;w=21600")
+			w.Header().Set("RateLimit-Remaining", remaining+";w=21600")
+		}
+		switch r.URL.Path {
+		case "/v2/library/nginx/manifests/latest":
+			w.Header().Set("Content-Type", imgspecv1.MediaTypeImageManifest)
+		case "/v2/library/nginx/manifests/index":
+			w.Header().Set("Content-Type", imgspecv1.MediaTypeImageIndex)
+			if r.Method == http.MethodGet {
+				_ = json.NewEncoder(w).Encode(imgspecv1.Index{
+					MediaType: imgspecv1.MediaTypeImageIndex,
+					Manifests: []imgspecv1.Descriptor{
+						{MediaType: imgspecv1.MediaTypeImageManifest, Digest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", Platform: &imgspecv1.Platform{OS: "linux", Architecture: "amd64"}},
+						{MediaType: imgspecv1.MediaTypeImageManifest, Digest: "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210", Platform: &imgspecv1.Platform{OS: "linux", Architecture: "arm64"}},
+					},
+				})
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	registryTransport = server.Client().Transport.(*http.Transport)
+	dockerHubRegistryHost = strings.TrimPrefix(server.URL, "https://")
+	t.Cleanup(func() {
+		registryTransport = http.DefaultTransport.(*http.Transport)
+		dockerHubRegistryHost = "registry-1.docker.io"
+	})
+	return server
+}
+
+func TestCheckDockerHubRateLimit(t *testing.T) {
+	tests := []struct {
+		name           string
+		image          string
+		copyImageIndex bool
+		inspectsSource bool
+		remaining      string
+		throttled      map[string]int
+		want           *DockerHubRateLimit
+		wantErr        string
+	}{
+		{"image", "docker://nginx", false, false, "10", nil, &DockerHubRateLimit{Limit: 100, Remaining: 10, Window: 6 * time.Hour, Required: 1}, ""},
+		{"inspected image", "docker://nginx", false, true, "10", nil, &DockerHubRateLimit{Limit: 100, Remaining: 10, Window: 6 * time.Hour, Required: 2}, ""},
+		{"instance of index", "docker://nginx:index", false, false, "10", nil, &DockerHubRateLimit{Limit: 100, Remaining: 10, Window: 6 * time.Hour, Required: 2}, ""},
+		{"inspected instance of index", "docker://nginx:index", false, true, "10", nil, &DockerHubRateLimit{Limit: 100, Remaining: 10, Window: 6 * time.Hour, Required: 4}, ""},
+		{"whole index", "docker://nginx:index", true, false, "10", nil, &DockerHubRateLimit{Limit: 100, Remaining: 10, Window: 6 * time.Hour, Required: 3}, ""},
+		{"inspected whole index", "docker://nginx:index", true, true, "10", nil, &DockerHubRateLimit{Limit: 100, Remaining: 10, Window: 6 * time.Hour, Required: 6}, ""},
+		{"exhausted", "docker://nginx", false, false, "0", nil, &DockerHubRateLimit{Limit: 100, Remaining: 0, Window: 6 * time.Hour, Required: 1}, ""},
+		{"used up", "docker://nginx", false, false, "10", map[string]int{http.MethodHead: 1}, &DockerHubRateLimit{Limit: 100, Window: 6 * time.Hour, Exhausted: true, RetryAfter: time.Second}, ""},
+		{"used up reading whole index", "docker://nginx:index", true, false, "10", map[string]int{http.MethodGet: 1}, &DockerHubRateLimit{Limit: 100, Window: 6 * time.Hour, Exhausted: true, RetryAfter: time.Second}, ""},
+		{"unlimited", "docker://nginx", false, false, "", nil, nil, ""},
+		{"not found", "docker://nginx:missing", false, false, "10", nil, nil, "404 Not Found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newDockerHubServer(t, tt.remaining, tt.throttled)
+			ref, err := alltransports.ParseImageName(tt.image)
+			require.NoError(t, err)
+			rateLimit, err := CheckDockerHubRateLimit(context.Background(), &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{}}, ref, tt.copyImageIndex, tt.inspectsSource)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, rateLimit)
+		})
+	}
+}
+
+func TestDockerHubSource(t *testing.T) {
+	captureLogs(t)
+	newDockerHubServer(t, "1", nil)
+	srcRef, err := alltransports.ParseImageName("docker://nginx")
+	require.NoError(t, err)
+	srcCtx := &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{}}
+
+	configs, err := GetDockerHubConfigs("")
+	require.NoError(t, err)
+	_, err = dockerHubSource(context.Background(), "docker://nginx", srcRef, srcCtx, false, true, configs)
+	var rateLimitErr *DockerHubRateLimitError
+	require.True(t, errors.As(err, &rateLimitErr))
+	assert.Equal(t, 1, rateLimitErr.RateLimit.Remaining)
+	assert.ErrorContains(t, err, "docker hub pull rate limit too low to copy docker://nginx: 1 of 100 pulls left per 6h0m0s, the copy needs 2")
+
+	configs, err = GetDockerHubConfigs(`{"pullThroughCachePrefix": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub"}`)
+	require.NoError(t, err)
+	cacheImage, err := dockerHubSource(context.Background(), "docker://nginx", srcRef, srcCtx, false, true, configs)
+	require.NoError(t, err)
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub/library/nginx:latest", cacheImage)
+
+	// The copy goes on as it is when the quota can't be checked.
+	srcRef, err = alltransports.ParseImageName("docker://nginx:missing")
+	require.NoError(t, err)
+	cacheImage, err = dockerHubSource(context.Background(), "docker://nginx:missing", srcRef, srcCtx, false, true, configs)
+	require.NoError(t, err)
+	assert.Empty(t, cacheImage)
+}
+
+func TestCopyImageDockerHubRateLimit(t *testing.T) {
+	captureLogs(t)
+	newDockerHubServer(t, "0", nil)
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+	dockerHubConfigs, err := GetDockerHubConfigs("")
+	require.NoError(t, err)
+	_, err = copyImage(context.Background(), "docker://nginx", "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{
+		Compression: &CompressionConfigs{},
+		Retry:       retryConfigs,
+		DockerHub:   dockerHubConfigs,
+	})
+	var rateLimitErr *DockerHubRateLimitError
+	assert.True(t, errors.As(err, &rateLimitErr))
+}
+
+func TestCopyImageDockerHubRateLimitUsedUp(t *testing.T) {
+	logs := captureLogs(t)
+	newDockerHubServer(t, "10", map[string]int{http.MethodHead: 1})
+	retryConfigs, err := GetRetryConfigs(`{"numAttempts": 2, "baseDelay": 0.01, "maxDelay": 2}`)
+	require.NoError(t, err)
+	dockerHubConfigs, err := GetDockerHubConfigs("")
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = copyImage(context.Background(), "docker://nginx", "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{
+		Compression: &CompressionConfigs{},
+		Retry:       retryConfigs,
+		DockerHub:   dockerHubConfigs,
+	})
+	// The manifest served is empty, so the copy itself fails once the quota came back.
+	var rateLimitErr *DockerHubRateLimitError
+	assert.False(t, errors.As(err, &rateLimitErr))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Contains(t, logs.String(), `"retryAfter":"1s"`)
+	assert.Contains(t, logs.String(), `"wait":"1s"`)
+}
@@ -0,0 +1,323 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/docker/distribution/registry/api/errcode"
+	v2 "github.com/docker/distribution/registry/api/v2"
+	"go.podman.io/image/v5/docker"
+)
+
+// ErrorCategory is the kind of transient failure an error is, each retried unless the
+// retryableErrors of the RetryConfigs disable it.
+type ErrorCategory string
+
+const (
+	ERROR_RATE_LIMIT   ErrorCategory = "rateLimit"   // HTTP 429, registry TOOMANYREQUESTS and AWS throttling codes
+	ERROR_THROTTLING   ErrorCategory = "throttling"  // HTTP 503, such as S3 Slow Down on blob reads
+	ERROR_SERVER_ERROR ErrorCategory = "serverError" // HTTP 500, 502 and 504
+	ERROR_NETWORK      ErrorCategory = "network"     // Timeouts, connection resets and truncated responses
+)
+
+// ErrorCategories lists the categories of retryable errors.
+var ErrorCategories = []ErrorCategory{ERROR_RATE_LIMIT, ERROR_THROTTLING, ERROR_SERVER_ERROR, ERROR_NETWORK}
+
+// httpStatusError is implemented by the response errors of the AWS SDK.
+type httpStatusError interface {
+	HTTPStatusCode() int
+}
+
+// connectionError is implemented by the AWS SDK errors of requests that could not be sent.
+type connectionError interface {
+	ConnectionError() bool
+}
+
+// errorMessagePatterns classify errors that only reach the handler as text, such as errors of
+// copy.Image formatted with %v. Words are matched whole, so that "rate" doesn't match
+// "generate" or "separate".
+var errorMessagePatterns = []struct {
+	category ErrorCategory
+	pattern  *regexp.Regexp
+}{
+	{ERROR_RATE_LIMIT, regexp.MustCompile(`(?i)\btoomanyrequests\b|\bratelimitexceeded\b|\brate\b[^.;]*\bexceed|\bhttp 429\b`)},
+	{ERROR_THROTTLING, regexp.MustCompile(`(?i)\bslow ?down\b|\b503 service unavailable\b`)},
+	{ERROR_SERVER_ERROR, regexp.MustCompile(`(?i)\b500 internal server error\b|\b502 bad gateway\b|\b504 gateway time-?out\b`)},
+	{ERROR_NETWORK, regexp.MustCompile(`(?i)\bconnection reset by peer\b|\bbroken pipe\b`)},
+}
+
+// ClassifyError returns the category of transient failure of err, or "" if err is not
+// transient. The error chain is unwrapped to its concrete types and HTTP status codes first:
+// a registry response is classified by its status alone. The message is only matched for
+// errors without a registry or AWS error in their chain, such as the errors copy.Image formats
+// as text.
+func ClassifyError(err error) ErrorCategory {
+	// The deadline of the invocation is a net.Error timeout too, but retrying can't beat it.
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ""
+	}
+	if errors.Is(err, docker.ErrTooManyRequests) {
+		return ERROR_RATE_LIMIT
+	}
+	// A used up Docker Hub quota comes back in time, but one too low for the copy fails it early.
+	var quotaErr *DockerHubRateLimitError
+	if errors.As(err, &quotaErr) {
+		if quotaErr.RateLimit.Exhausted {
+			return ERROR_RATE_LIMIT
+		}
+		return ""
+	}
+	var registryErr errcode.Error
+	if errors.As(err, &registryErr) && registryErr.Code == errcode.ErrorCodeTooManyRequests {
+		return ERROR_RATE_LIMIT
+	}
+	if status, ok := registryStatusCode(err); ok {
+		return httpStatusCategory(status)
+	}
+	// AWS throttling errors have a 400 status, so their code comes first.
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if category := apiErrorCategory(apiErr); category != "" {
+			return category
+		}
+	}
+	var responseErr httpStatusError
+	if errors.As(err, &responseErr) {
+		if category := httpStatusCategory(responseErr.HTTPStatusCode()); category != "" {
+			return category
+		}
+	}
+	if isNetworkError(err) {
+		return ERROR_NETWORK
+	}
+	// The message of a registry or AWS error is the server's, which says nothing more than its code.
+	if errors.As(err, &registryErr) || errors.As(err, &apiErr) {
+		return ""
+	}
+	for _, p := range errorMessagePatterns {
+		if p.pattern.MatchString(err.Error()) {
+			return p.category
+		}
+	}
+	return ""
+}
+
+// registryStatusCode returns the HTTP status of the registry response in the chain of err. The
+// docker transport returns it as docker.UnexpectedHTTPStatusError, or as an unexported error for
+// 4xx responses with a body it can't parse, such as an HTML 429 page.
+func registryStatusCode(err error) (int, bool) {
+	var statusErr docker.UnexpectedHTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode, true
+	}
+	var responseErr *RegistryResponseError
+	if errors.As(err, &responseErr) {
+		return responseErr.StatusCode, true
+	}
+	return unparsedResponseStatusCode(err)
+}
+
+// unparsedResponsePattern matches the message of the unexported error the docker transport
+// returns for registry responses with a body it can't parse. Its status is only exposed in the
+// message; TestClassifyRegistryResponse pins the message of the c/image version in go.mod.
+var unparsedResponsePattern = regexp.MustCompile(`^error parsing HTTP (\d{3}) response body: `)
+
+// unparsedResponseStatusCode returns the status of the registry response with a body the docker
+// transport couldn't parse in the chain of err. Only errors whose own message starts with the
+// one of the docker transport match, not the errors wrapping them.
+func unparsedResponseStatusCode(err error) (int, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if m := unparsedResponsePattern.FindStringSubmatch(err.Error()); m != nil {
+			status, _ := strconv.Atoi(m[1])
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+// IsManifestUnknownError checks for registries answering that a manifest doesn't exist: the
+// MANIFEST_UNKNOWN error code, or a 404 response without an error code.
+func IsManifestUnknownError(err error) bool {
+	var coder errcode.ErrorCoder
+	if errors.As(err, &coder) && coder.ErrorCode() == v2.ErrorCodeManifestUnknown {
+		return true
+	}
+	status, ok := registryStatusCode(err)
+	return ok && status == http.StatusNotFound
+}
+
+// ECR_TOKEN_EXPIRED_MESSAGE starts the message of the DENIED error ECR returns for an expired
+// authorization token.
+const ECR_TOKEN_EXPIRED_MESSAGE = "Your authorization token has expired"
+
+// IsAuthExpiredError checks for registries rejecting the token of the copy, which a new one
+// fixes: a 401 response, an UNAUTHORIZED error code, or the DENIED code ECR returns for an
+// expired token.
+func IsAuthExpiredError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+		return true
+	}
+	var registryErr errcode.Error
+	if errors.As(err, &registryErr) {
+		return registryErr.Code == errcode.ErrorCodeUnauthorized ||
+			registryErr.Code == errcode.ErrorCodeDenied && strings.HasPrefix(registryErr.Message, ECR_TOKEN_EXPIRED_MESSAGE)
+	}
+	if status, ok := registryStatusCode(err); ok {
+		return status == http.StatusUnauthorized
+	}
+	var responseErr httpStatusError
+	return errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusUnauthorized
+}
+
+// PRESERVE_DIGESTS_REASON is the reason copy.Image gives for not converting the manifest or
+// layers of an image when Options.PreserveDigests is set. copy.Image has no error type for it.
+const PRESERVE_DIGESTS_REASON = "Instructed to preserve digests"
+
+// IsPreserveDigestsError checks whether copy.Image failed because preserving digests was requested.
+func IsPreserveDigestsError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), PRESERVE_DIGESTS_REASON)
+}
+
+// httpStatusCategory returns the category of the failures with HTTP status code.
+func httpStatusCategory(code int) ErrorCategory {
+	switch code {
+	case http.StatusTooManyRequests:
+		return ERROR_RATE_LIMIT
+	case http.StatusServiceUnavailable:
+		return ERROR_THROTTLING
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return ERROR_SERVER_ERROR
+	}
+	return ""
+}
+
+// apiErrorCategory returns the category of the AWS API error codes the SDK itself retries.
+func apiErrorCategory(apiErr smithy.APIError) ErrorCategory {
+	code := apiErr.ErrorCode()
+	if code == "SlowDown" {
+		return ERROR_THROTTLING
+	}
+	if _, ok := retry.DefaultThrottleErrorCodes[code]; ok {
+		return ERROR_RATE_LIMIT
+	}
+	if _, ok := retry.DefaultRetryableErrorCodes[code]; ok {
+		return ERROR_NETWORK
+	}
+	return ""
+}
+
+// isNetworkError checks for timeouts, connection resets and responses cut short.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var connErr connectionError
+	if errors.As(err, &connErr) && connErr.ConnectionError() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfterError is implemented by errors carrying the delay their server asked to wait before
+// retrying.
+type retryAfterError interface {
+	RetryAfter() time.Duration
+}
+
+// RetryAfterError wraps an error with the delay its server asked to wait before retrying, for
+// the responses read by the handler itself.
+type RetryAfterError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *RetryAfterError) Error() string             { return e.Err.Error() }
+func (e *RetryAfterError) Unwrap() error             { return e.Err }
+func (e *RetryAfterError) RetryAfter() time.Duration { return e.Delay }
+
+// RegistryResponseError is the error of an unexpected response to a request the handler sends to a
+// registry itself, rather than through the docker transport.
+type RegistryResponseError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *RegistryResponseError) Error() string { return e.Status }
+
+// NewRegistryResponseError returns the error of the unexpected registry response resp. The delay
+// asked by the headers of 429 and 503 responses is kept in a RetryAfterError.
+func NewRegistryResponseError(resp *http.Response) error {
+	err := &RegistryResponseError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := ParseRetryAfterHeaders(resp.Header, time.Now()); ok {
+			return &RetryAfterError{Err: err, Delay: delay}
+		}
+	}
+	return err
+}
+
+// RetryAfter returns the delay the server which failed with err asked to wait before retrying,
+// from a RetryAfterError or the headers of an AWS API response in the error chain.
+func RetryAfter(err error) (time.Duration, bool) {
+	var hinted retryAfterError
+	if errors.As(err, &hinted) {
+		return hinted.RetryAfter(), true
+	}
+	var responseErr interface{ HTTPResponse() *smithyhttp.Response }
+	if errors.As(err, &responseErr) {
+		if res := responseErr.HTTPResponse(); res != nil && res.Response != nil {
+			return ParseRetryAfterHeaders(res.Header, time.Now())
+		}
+	}
+	return 0, false
+}
+
+// ParseRetryAfterHeaders returns the delay asked by the Retry-After header of a response, in
+// seconds or as an HTTP date, or else by its RateLimit-Reset or X-RateLimit-Reset header. The
+// reset headers are in seconds, or an epoch time for the X- one of some registries.
+func ParseRetryAfterHeaders(h http.Header, now time.Time) (time.Duration, bool) {
+	if after := h.Get("Retry-After"); after != "" {
+		if seconds, err := strconv.ParseInt(after, 10, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if t, err := http.ParseTime(after); err == nil && t.After(now) {
+			return t.Sub(now), true
+		}
+	}
+	for _, name := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		seconds, err := strconv.ParseInt(h.Get(name), 10, 64)
+		if err != nil || seconds < 0 {
+			continue
+		}
+		// No window is a billion seconds long, so larger values are epoch times.
+		if seconds > 1e9 {
+			if reset := time.Unix(seconds, 0); reset.After(now) {
+				return reset.Sub(now), true
+			}
+			continue
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
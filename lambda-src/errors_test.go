@@ -0,0 +1,299 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// awsResponseError returns an AWS API error as the SDK does, with its HTTP response.
+func awsResponseError(status int, code string, message string) error {
+	return &smithy.OperationError{
+		ServiceID:     "ECR",
+		OperationName: "PutImage",
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+				Err:      &smithy.GenericAPIError{Code: code, Message: message},
+			},
+		},
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected ErrorCategory
+	}{
+		{"nil", nil, ""},
+		// Registry responses
+		{"docker too many requests", fmt.Errorf("reading manifest latest in docker.io/library/nginx: %w", docker.ErrTooManyRequests), ERROR_RATE_LIMIT},
+		{"registry TOOMANYREQUESTS code", fmt.Errorf("fetching blob: %w", errcode.ErrorCodeTooManyRequests.WithMessage("You have reached your pull rate limit")), ERROR_RATE_LIMIT},
+		{"registry DENIED code", fmt.Errorf("fetching blob: %w", errcode.ErrorCodeDenied.WithMessage("requested access to the resource is denied")), ""},
+		{"registry DENIED rate message", fmt.Errorf("fetching blob: %w", errcode.ErrorCodeDenied.WithMessage("rate of pulls exceeded by this account")), ""},
+		{"registry 429 status", fmt.Errorf("fetching blob: %w", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusTooManyRequests}), ERROR_RATE_LIMIT},
+		{"docker hub quota used up", &DockerHubRateLimitError{Image: "docker://nginx", RateLimit: &DockerHubRateLimit{Limit: 100, Exhausted: true, RetryAfter: time.Hour}}, ERROR_RATE_LIMIT},
+		{"docker hub quota too low", &DockerHubRateLimitError{Image: "docker://nginx", RateLimit: &DockerHubRateLimit{Limit: 100, Remaining: 1, Required: 2}}, ""},
+		{"registry 503 status", fmt.Errorf("reading blob sha256:abc123: %w", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusServiceUnavailable}), ERROR_THROTTLING},
+		{"registry 500 status", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusInternalServerError}, ERROR_SERVER_ERROR},
+		{"registry 502 status", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusBadGateway}, ERROR_SERVER_ERROR},
+		{"registry 504 status", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusGatewayTimeout}, ERROR_SERVER_ERROR},
+		{"registry 404 status", fmt.Errorf("rate exceeded: %w", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusNotFound}), ""},
+		// AWS API errors
+		{"ECR throttling", awsResponseError(http.StatusBadRequest, "ThrottlingException", "Rate exceeded"), ERROR_RATE_LIMIT},
+		{"ECR too many requests", awsResponseError(http.StatusBadRequest, "TooManyRequestsException", "Too many requests"), ERROR_RATE_LIMIT},
+		{"S3 slow down", awsResponseError(http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate."), ERROR_THROTTLING},
+		{"request timeout code", awsResponseError(http.StatusBadRequest, "RequestTimeout", "Your socket connection to the server was not read from or written to"), ERROR_NETWORK},
+		{"AWS 502 status", awsResponseError(http.StatusBadGateway, "BadGateway", ""), ERROR_SERVER_ERROR},
+		{"AWS access denied", awsResponseError(http.StatusForbidden, "AccessDeniedException", "not authorized"), ""},
+		{"AWS validation", awsResponseError(http.StatusBadRequest, "ValidationException", "limit exceeded for rate parameter"), ""},
+		{"AWS validation rate message", awsResponseError(http.StatusBadRequest, "ValidationException", "Rate exceeded for this parameter"), ""},
+		{"AWS request send", &smithyhttp.RequestSendError{Err: errors.New("dial tcp: lookup api.ecr.us-west-2.amazonaws.com: no such host")}, ERROR_NETWORK},
+		// Network errors
+		{"net timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, ERROR_NETWORK},
+		{"net error without timeout", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ""},
+		{"connection reset", fmt.Errorf("initializing source: %w", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), ERROR_NETWORK},
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, ERROR_NETWORK},
+		{"unexpected EOF", fmt.Errorf("reading blob: %w", io.ErrUnexpectedEOF), ERROR_NETWORK},
+		{"deadline exceeded", fmt.Errorf("copying blob: %w", context.DeadlineExceeded), ""},
+		{"canceled request", &smithyhttp.RequestSendError{Err: context.Canceled}, ""},
+		// Errors only known by their message
+		{"message too many requests", errors.New("toomanyrequests: You have reached your pull rate limit"), ERROR_RATE_LIMIT},
+		{"message rate exceeded", errors.New("Rate exceeded for API calls"), ERROR_RATE_LIMIT},
+		{"message slow down", errors.New("received unexpected HTTP status: 503 Slow Down"), ERROR_THROTTLING},
+		{"message bad gateway", errors.New("received unexpected HTTP status: 502 Bad Gateway"), ERROR_SERVER_ERROR},
+		{"message connection reset", errors.New("read tcp 10.0.0.1:48000->10.0.0.2:443: read: connection reset by peer"), ERROR_NETWORK},
+		{"message generate exceeds", errors.New("failed to generate manifest: size exceeds the limit"), ""},
+		{"message separate exceeded", errors.New("separate layers exceeded the quota"), ""},
+		{"message unrelated", errors.New("manifest unknown"), ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ClassifyError(tc.err))
+			assert.Equal(t, tc.expected != "", IsRetryableError(tc.err))
+		})
+	}
+}
+
+// newStatusRegistry serves a registry answering manifest requests with status and body. The
+// docker transport retries 429 responses itself, without waiting as Retry-After is 0.
+func newStatusRegistry(t *testing.T, status int, body string) types.ImageReference {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		w.Header().Set("Retry-After", "0")
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(server.URL, "https://") + "/repo:latest")
+	require.NoError(t, err)
+	return ref
+}
+
+// readRegistryManifest returns the error of reading the manifest of ref.
+func readRegistryManifest(t *testing.T, ref types.ImageReference) error {
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	src, err := ref.NewImageSource(context.Background(), sys)
+	if err == nil {
+		defer src.Close()
+		_, _, err = src.GetManifest(context.Background(), nil)
+	}
+	require.Error(t, err)
+	return err
+}
+
+func TestClassifyRegistryResponse(t *testing.T) {
+	// A body which is not a JSON error list only reaches the handler with its status code.
+	err := readRegistryManifest(t, newStatusRegistry(t, http.StatusTooManyRequests, "<html>Too Many Requests</html>"))
+	status, ok := registryStatusCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, ERROR_RATE_LIMIT, ClassifyError(err))
+	assert.False(t, IsAuthExpiredError(err))
+
+	err = readRegistryManifest(t, newStatusRegistry(t, http.StatusNotFound, "<html>Not Found</html>"))
+	assert.True(t, IsManifestUnknownError(err))
+
+	// The message of the docker transport only counts as the message of the error itself.
+	_, ok = registryStatusCode(fmt.Errorf("copying: %s", err.Error()))
+	assert.False(t, ok)
+
+	err = readRegistryManifest(t, newStatusRegistry(t, http.StatusUnauthorized, "<html>Unauthorized</html>"))
+	assert.Equal(t, ErrorCategory(""), ClassifyError(err))
+	assert.True(t, IsAuthExpiredError(err))
+
+	err = readRegistryManifest(t, newStatusRegistry(t, http.StatusForbidden, `{"errors": [{"code": "DENIED", "message": "Your authorization token has expired. Reauthenticate and try again."}]}`))
+	assert.True(t, IsAuthExpiredError(err))
+
+	err = readRegistryManifest(t, newStatusRegistry(t, http.StatusNotFound, `{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`))
+	assert.False(t, IsAuthExpiredError(err))
+}
+
+func TestIsAuthExpiredError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"unauthorized for credentials", fmt.Errorf("initializing source: %w", docker.ErrUnauthorizedForCredentials{Err: errors.New("authentication required")}), true},
+		{"registry UNAUTHORIZED code", fmt.Errorf("reading manifest: %w", errcode.ErrorCodeUnauthorized.WithMessage("authentication required")), true},
+		{"ECR expired token", fmt.Errorf("writing manifest: %w", errcode.ErrorCodeDenied.WithMessage("Your authorization token has expired. Reauthenticate and try again.")), true},
+		{"registry DENIED code", errcode.ErrorCodeDenied.WithMessage("requested access to the resource is denied"), false},
+		{"registry 401 status", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusUnauthorized}, true},
+		{"registry 403 status", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusForbidden}, false},
+		{"AWS 401 status", awsResponseError(http.StatusUnauthorized, "UnrecognizedClientException", "The security token included in the request is invalid"), true},
+		{"AWS access denied", awsResponseError(http.StatusForbidden, "AccessDeniedException", "not authorized"), false},
+		{"message only", errors.New("denied: Your authorization token has expired. Reauthenticate and try again."), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsAuthExpiredError(tc.err))
+		})
+	}
+}
+
+func TestIsPreserveDigestsError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"layer representation", fmt.Errorf("Copying this image would require changing layer representation, which we cannot do: %q", PRESERVE_DIGESTS_REASON), true},
+		{"manifest list", fmt.Errorf("copying image 1/2 from manifest list: Manifest list must be converted to type %q to be written to destination, but we cannot modify it: %q", "application/vnd.oci.image.index.v1+json", PRESERVE_DIGESTS_REASON), true},
+		{"layer encryption", fmt.Errorf("layer sha256:abc123 should be encrypted, but we can’t modify the manifest: %s", PRESERVE_DIGESTS_REASON), true},
+		{"other reason", fmt.Errorf("Copying this image would require changing layer representation, which we cannot do: %q", "Would invalidate signatures"), false},
+		{"rate limit", docker.ErrTooManyRequests, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsPreserveDigestsError(tc.err))
+		})
+	}
+}
+
+func TestRetryConfigsIsRetryable(t *testing.T) {
+	testCases := []struct {
+		name     string
+		jsonData string
+		err      error
+		expected bool
+	}{
+		{"all retried by default", "", docker.UnexpectedHTTPStatusError{StatusCode: http.StatusBadGateway}, true},
+		{"disabled category", `{"retryableErrors": {"serverError": false}}`, docker.UnexpectedHTTPStatusError{StatusCode: http.StatusBadGateway}, false},
+		{"other category", `{"retryableErrors": {"serverError": false}}`, docker.ErrTooManyRequests, true},
+		{"enabled category", `{"retryableErrors": {"network": true}}`, io.ErrUnexpectedEOF, true},
+		{"permanent error", `{"retryableErrors": {"network": true}}`, errors.New("manifest unknown"), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rc, err := GetRetryConfigs(tc.jsonData)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, rc.IsRetryable(tc.err))
+		})
+	}
+
+	_, err := GetRetryConfigs(`{"retryableErrors": {"timeout": false}}`)
+	assert.ErrorContains(t, err, `unknown error category "timeout" in retryableErrors`)
+}
+
+func TestParseRetryAfterHeaders(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		expected time.Duration
+		ok       bool
+	}{
+		{"no headers", nil, 0, false},
+		{"retry after seconds", map[string]string{"Retry-After": "30"}, 30 * time.Second, true},
+		{"retry after date", map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)}, time.Minute, true},
+		{"retry after past date", map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)}, 0, false},
+		{"retry after invalid", map[string]string{"Retry-After": "soon"}, 0, false},
+		{"retry after first", map[string]string{"Retry-After": "5", "RateLimit-Reset": "60"}, 5 * time.Second, true},
+		{"rate limit reset", map[string]string{"RateLimit-Reset": "60"}, time.Minute, true},
+		{"x rate limit reset epoch", map[string]string{"X-RateLimit-Reset": strconv.FormatInt(now.Add(2*time.Minute).Unix(), 10)}, 2 * time.Minute, true},
+		{"x rate limit reset past epoch", map[string]string{"X-RateLimit-Reset": strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)}, 0, false},
+		{"invalid rate limit reset", map[string]string{"RateLimit-Reset": "-1"}, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			delay, ok := ParseRetryAfterHeaders(h, now)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, delay)
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	throttled := awsResponseError(http.StatusBadRequest, "ThrottlingException", "Rate exceeded")
+	var responseErr *smithyhttp.ResponseError
+	require.True(t, errors.As(throttled, &responseErr))
+	responseErr.Response.Header = http.Header{"Retry-After": []string{"3"}}
+
+	testCases := []struct {
+		name     string
+		err      error
+		expected time.Duration
+		ok       bool
+	}{
+		{"AWS response header", fmt.Errorf("pushing manifest: %w", throttled), 3 * time.Second, true},
+		{"AWS response without header", awsResponseError(http.StatusServiceUnavailable, "SlowDown", ""), 0, false},
+		{"hinted error", fmt.Errorf("checking rate limit: %w", &RetryAfterError{Err: docker.ErrTooManyRequests, Delay: time.Hour}), time.Hour, true},
+		{"registry error", docker.ErrTooManyRequests, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delay, ok := RetryAfter(tc.err)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, delay)
+		})
+	}
+
+	// Hinted errors keep the category of the error they wrap.
+	assert.Equal(t, ERROR_RATE_LIMIT, ClassifyError(&RetryAfterError{Err: docker.ErrTooManyRequests, Delay: time.Hour}))
+}
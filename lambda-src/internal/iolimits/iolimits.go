@@ -44,6 +44,12 @@ const (
 	// MaxTarFileManifestSize is the maximum allowed size of a (docker save)-like manifest (which may contain multiple images)
 	// The limit of 1 MB is considered to be greatly sufficient.
 	MaxTarFileManifestSize = MegaByte
+	// MaxPolicyBodySize is the maximum allowed size of a signature policy document fetched from S3.
+	// The limit of 1 MB is considered to be greatly sufficient.
+	MaxPolicyBodySize = MegaByte
+	// MaxAuthConfigBodySize is the maximum allowed size of a registry auth config document fetched from S3.
+	// The limit of 1 MB is considered to be greatly sufficient.
+	MaxAuthConfigBodySize = MegaByte
 
 	// This size of a block
 	BlockSize = 8 * MegaByte
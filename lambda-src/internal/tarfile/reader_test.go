@@ -19,7 +19,7 @@ func TestNewS3FileReader(t *testing.T) {
 
 	s3uri, _ := ParseS3Uri("s3://cdk-ecr-deployment/nginx.tar")
 
-	f, err := NewS3File(cfg, *s3uri)
+	f, err := NewS3File(context.TODO(), cfg, *s3uri)
 	assert.NoError(t, err)
 
 	log.Printf("file size: %d", f.Size())
@@ -10,6 +10,7 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 
@@ -18,10 +19,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/golang/groupcache/lru"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const S3Prefix = "s3://"
 
+// TracerName is the instrumentation scope of the spans of the S3 reads.
+const TracerName = "cdk-ecr-deployment-handler/internal/tarfile"
+
 type S3Uri struct {
 	Bucket string
 	Key    string
@@ -46,6 +54,7 @@ func ParseS3Uri(s string) (*S3Uri, error) {
 }
 
 type S3File struct {
+	ctx    context.Context // context of the image source, carrying the trace of the reads
 	s3uri  S3Uri
 	client *s3.Client
 	i      int64       // current reading index
@@ -95,10 +104,23 @@ func (f *S3File) onCacheMiss(block *Block) (err error) {
 		return errors.New("S3File: api client is nil, did you close the file?")
 	}
 	bid := block.Id
-	out, err := f.client.GetObject(context.TODO(), &s3.GetObjectInput{
+	byteRange := fmt.Sprintf("bytes=%d-%d", bid*iolimits.BlockSize, (bid+1)*iolimits.BlockSize-1)
+	ctx, span := otel.Tracer(TracerName).Start(f.ctx, "S3File.onCacheMiss", trace.WithAttributes(
+		attribute.String("s3.bucket", f.s3uri.Bucket),
+		attribute.String("s3.key", f.s3uri.Key),
+		attribute.String("s3.range", byteRange),
+	))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	out, err := f.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &f.s3uri.Bucket,
 		Key:    &f.s3uri.Key,
-		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", bid*iolimits.BlockSize, (bid+1)*iolimits.BlockSize-1)),
+		Range:  aws.String(byteRange),
 	})
 	if err != nil {
 		return err
@@ -192,6 +214,7 @@ func (f *S3File) Close() error {
 
 func (f *S3File) Clone() *S3File {
 	return &S3File{
+		ctx:    f.ctx,
 		s3uri:  f.s3uri,
 		client: f.client,
 		i:      0,
@@ -223,9 +246,9 @@ func (f *S3File) Clone() *S3File {
 // 	return
 // }
 
-func NewS3File(cfg aws.Config, s3uri S3Uri) (*S3File, error) {
+func NewS3File(ctx context.Context, cfg aws.Config, s3uri S3Uri) (*S3File, error) {
 	client := s3.NewFromConfig(cfg)
-	output, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+	output, err := client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: &s3uri.Bucket,
 		Key:    &s3uri.Key,
 	})
@@ -234,6 +257,7 @@ func NewS3File(cfg aws.Config, s3uri S3Uri) (*S3File, error) {
 	}
 
 	return &S3File{
+		ctx:    ctx,
 		s3uri:  s3uri,
 		client: client,
 		i:      0,
@@ -252,6 +276,25 @@ func (b *Block) Size() int {
 	return len(b.Buf)
 }
 
+// CacheStats counts the block reads of the LRUBlockPools of the process, served from the cache
+// (hits) or fetched (misses).
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+}
+
+// Sub returns the reads counted since base.
+func (s CacheStats) Sub(base CacheStats) CacheStats {
+	return CacheStats{Hits: s.Hits - base.Hits, Misses: s.Misses - base.Misses}
+}
+
+var blockCacheHits, blockCacheMisses atomic.Int64
+
+// BlockCacheStats returns the block reads counted since the process started.
+func BlockCacheStats() CacheStats {
+	return CacheStats{Hits: blockCacheHits.Load(), Misses: blockCacheMisses.Load()}
+}
+
 type LRUBlockPool struct {
 	pool  *sync.Pool
 	cache *lru.Cache
@@ -282,6 +325,7 @@ func (p *LRUBlockPool) GetBlock(id int64, blockInitFn func(*Block) error) (block
 	defer p.mutex.Unlock()
 	val, hit := p.cache.Get(id)
 	if hit {
+		blockCacheHits.Add(1)
 		if block, ok := val.(*Block); ok {
 			return block, nil
 		} else {
@@ -289,6 +333,7 @@ func (p *LRUBlockPool) GetBlock(id int64, blockInitFn func(*Block) error) (block
 		}
 	} else {
 		logrus.Debugf("LRUBlockPool: miss block#%d", id)
+		blockCacheMisses.Add(1)
 		if (p.cache.MaxEntries != 0) && (p.cache.Len() >= p.cache.MaxEntries) {
 			p.cache.RemoveOldest()
 		}
@@ -6,14 +6,27 @@ package tarfile
 import (
 	"archive/tar"
 	"cdk-ecr-deployment-handler/internal/iolimits"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestNewS3File(t *testing.T) {
@@ -23,7 +36,7 @@ func TestNewS3File(t *testing.T) {
 
 	s3uri, _ := ParseS3Uri("s3://cdk-ecr-deployment/nginx.tar")
 
-	f, err := NewS3File(cfg, *s3uri)
+	f, err := NewS3File(context.TODO(), cfg, *s3uri)
 	assert.NoError(t, err)
 
 	log.Printf("file size: %d", f.Size())
@@ -153,6 +166,18 @@ func TestLRUBlockPool(t *testing.T) {
 	assert.Equal(t, byte('B'), block.Buf[0])
 }
 
+func TestBlockCacheStats(t *testing.T) {
+	base := BlockCacheStats()
+	pool := NewLRUBlockPool(1)
+	blockInitFn := func(block *Block) error { return nil }
+
+	for _, id := range []int64{0, 0, 1, 0, 0} {
+		_, err := pool.GetBlock(id, blockInitFn)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 3}, BlockCacheStats().Sub(base))
+}
+
 // Create magic bytes based on seed: [seed-1, seed, seed+1]
 func magic(seed int64) []byte {
 	return []byte{byte(seed - 1), byte(seed), byte(seed + 1)}
@@ -163,3 +188,52 @@ func mkblk(init []byte) []byte {
 	copy(block[0:len(init)], init)
 	return block
 }
+
+func TestS3FileReadSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	content := bytes.Repeat([]byte("layer"), 200)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bucket/image.tar" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "image.tar", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	ctx, parent := otel.Tracer(TracerName).Start(context.Background(), "CopyImage")
+	f := &S3File{ctx: ctx, s3uri: S3Uri{Bucket: "bucket", Key: "image.tar"}, client: client, size: int64(len(content)), rcache: NewBlockCache(1)}
+	b := make([]byte, 16)
+	_, err := f.ReadAt(b, 10)
+	require.NoError(t, err)
+	assert.Equal(t, content[10:26], b)
+	// The block is cached, so it is only fetched once.
+	_, err = f.Clone().ReadAt(b, 100)
+	require.NoError(t, err)
+
+	missing := &S3File{ctx: ctx, s3uri: S3Uri{Bucket: "bucket", Key: "missing.tar"}, client: client, size: int64(len(content)), rcache: NewBlockCache(1)}
+	_, err = missing.ReadAt(b, 0)
+	require.Error(t, err)
+	parent.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	for _, span := range spans[:2] {
+		assert.Equal(t, "S3File.onCacheMiss", span.Name)
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	}
+	assert.Contains(t, spans[0].Attributes, attribute.String("s3.key", "image.tar"))
+	assert.Contains(t, spans[0].Attributes, attribute.String("s3.range", fmt.Sprintf("bytes=0-%d", iolimits.BlockSize-1)))
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Contains(t, spans[1].Attributes, attribute.String("s3.key", "missing.tar"))
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+}
@@ -0,0 +1,120 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/sirupsen/logrus"
+)
+
+// Fields of the structured log entries, for CloudWatch Logs Insights queries.
+const (
+	LOG_REQUEST_ID          = "requestId"
+	LOG_CFN_REQUEST_ID      = "cfnRequestId"
+	LOG_REQUEST_TYPE        = "requestType"
+	LOG_STACK_ID            = "stackId"
+	LOG_LOGICAL_RESOURCE_ID = "logicalResourceId"
+	LOG_SRC                 = "src"
+	LOG_DEST                = "dest"
+	LOG_ATTEMPT             = "attempt"
+	LOG_PHASE               = "phase"
+	LOG_DIGEST              = "digest"
+)
+
+// Phases of a deployment, logged in the phase field.
+const (
+	PHASE_PARSE     = "parse"
+	PHASE_AUTH      = "auth"
+	PHASE_COPY      = "copy"
+	PHASE_REFERRERS = "referrers"
+	PHASE_SIGN      = "sign"
+)
+
+// logger is the logger of the current invocation, carrying its request and resource fields.
+// Lambda runs one invocation at a time per process, so it is replaced by each handler call.
+var logger = logrus.NewEntry(logrus.StandardLogger())
+
+// setupLogging makes logrus write JSON entries at level to out, and routes the standard log
+// package through the invocation logger so that every line is structured.
+func setupLogging(out io.Writer, level logrus.Level) {
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	logrus.SetOutput(out)
+	logrus.SetLevel(level)
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+// stdLogWriter logs each line written by the standard log package as an info entry.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// newInvocationLogger returns the logger of a CloudFormation event.
+func newInvocationLogger(ctx context.Context, event cfn.Event) *logrus.Entry {
+	fields := logrus.Fields{
+		LOG_CFN_REQUEST_ID:      event.RequestID,
+		LOG_REQUEST_TYPE:        string(event.RequestType),
+		LOG_STACK_ID:            event.StackID,
+		LOG_LOGICAL_RESOURCE_ID: event.LogicalResourceID,
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		fields[LOG_REQUEST_ID] = lc.AwsRequestID
+	}
+	return logrus.NewEntry(logrus.StandardLogger()).WithFields(fields)
+}
+
+// reportDigestRegexp matches the digests of the blobs and manifests in copy reports.
+var reportDigestRegexp = regexp.MustCompile(`\b[a-z0-9]+:[a-f0-9]{32,}\b`)
+
+// reportWriter turns the text report of copy.Image into log entries, one per line, with the
+// digest the line is about in its own field. Each line is also passed to the hooks.
+type reportWriter struct {
+	entry *logrus.Entry
+	hooks []func(line string)
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newReportWriter(entry *logrus.Entry, hooks ...func(line string)) *reportWriter {
+	return &reportWriter{entry: entry, hooks: hooks}
+}
+
+func (w *reportWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		entry := w.entry
+		if d := reportDigestRegexp.FindString(line); d != "" {
+			entry = entry.WithField(LOG_DIGEST, d)
+		}
+		entry.Info(line)
+		for _, hook := range w.hooks {
+			hook(line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,122 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs sends the JSON entries of logrus to the returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	saved := logger
+	t.Cleanup(func() {
+		logrus.SetOutput(os.Stderr)
+		logger = saved
+	})
+	return &buf
+}
+
+// logEntries decodes the JSON entries written to buf.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), scanner.Text())
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestInvocationLogger(t *testing.T) {
+	buf := captureLogs(t)
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "lambda-request-1"})
+	logger = newInvocationLogger(ctx, cfn.Event{
+		RequestID:         "cfn-request-1",
+		RequestType:       cfn.RequestCreate,
+		StackID:           "arn:aws:cloudformation:us-west-2:123456789012:stack/app/1",
+		LogicalResourceID: "DeployImage",
+	})
+
+	// Lines of the standard log package become entries of the invocation logger.
+	log.Printf("get secret id: %s", "creds")
+	logger.WithField(LOG_PHASE, PHASE_COPY).Info("Copying image")
+
+	entries := logEntries(t, buf)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, "lambda-request-1", entry[LOG_REQUEST_ID])
+		assert.Equal(t, "cfn-request-1", entry[LOG_CFN_REQUEST_ID])
+		assert.Equal(t, "Create", entry[LOG_REQUEST_TYPE])
+		assert.Equal(t, "arn:aws:cloudformation:us-west-2:123456789012:stack/app/1", entry[LOG_STACK_ID])
+		assert.Equal(t, "DeployImage", entry[LOG_LOGICAL_RESOURCE_ID])
+		assert.Equal(t, "info", entry["level"])
+	}
+	assert.Equal(t, "get secret id: creds", entries[0]["msg"])
+	assert.Equal(t, PHASE_COPY, entries[1][LOG_PHASE])
+}
+
+func TestReportWriter(t *testing.T) {
+	buf := captureLogs(t)
+	blob := "sha256:" + fmt.Sprintf("%064x", 1)
+	w := newReportWriter(logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_COPY, LOG_ATTEMPT: 2}))
+
+	// Lines may be split across writes.
+	_, err := fmt.Fprintf(w, "Getting image source signatures\nCopying blob %s", blob[:20])
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(w, "%s\n\nWriting manifest to image destination\n", blob[20:])
+	require.NoError(t, err)
+	_, err = fmt.Fprint(w, "partial")
+	require.NoError(t, err)
+
+	entries := logEntries(t, buf)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "Getting image source signatures", entries[0]["msg"])
+	assert.Equal(t, "Copying blob "+blob, entries[1]["msg"])
+	assert.Equal(t, blob, entries[1][LOG_DIGEST])
+	assert.Equal(t, "Writing manifest to image destination", entries[2]["msg"])
+	assert.NotContains(t, entries[2], LOG_DIGEST)
+	for _, entry := range entries {
+		assert.Equal(t, PHASE_COPY, entry[LOG_PHASE])
+		assert.Equal(t, float64(2), entry[LOG_ATTEMPT])
+	}
+}
+
+func TestCopyImageLogs(t *testing.T) {
+	buf := captureLogs(t)
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+	_, err = copyImage(context.Background(), emptyImageArchive, "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{Compression: &CompressionConfigs{}, Retry: retryConfigs})
+	require.NoError(t, err)
+
+	// The copy report is logged as entries of the copy phase.
+	copied := false
+	for _, entry := range logEntries(t, buf) {
+		if entry[LOG_PHASE] != PHASE_COPY {
+			continue
+		}
+		assert.Equal(t, emptyImageArchive, entry[LOG_SRC])
+		assert.Equal(t, float64(1), entry[LOG_ATTEMPT])
+		if entry["msg"] == "Writing manifest to image destination" {
+			copied = true
+		}
+	}
+	assert.True(t, copied)
+}
@@ -5,20 +5,30 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/image"
+	"go.podman.io/image/v5/manifest"
 	"go.podman.io/image/v5/signature"
+	"go.podman.io/image/v5/transports"
 	"go.podman.io/image/v5/transports/alltransports"
-	"github.com/sirupsen/logrus"
+	"go.podman.io/image/v5/types"
 
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	_ "cdk-ecr-deployment-handler/s3" // Install s3 transport plugin
 )
@@ -28,13 +38,16 @@ const EnvLogLevel = "LOG_LEVEL"
 func init() {
 	s, exists := os.LookupEnv(EnvLogLevel)
 	if !exists {
-		logrus.SetLevel(logrus.InfoLevel)
+		setupLogging(os.Stderr, logrus.InfoLevel)
 	} else {
 		lvl, err := logrus.ParseLevel(s)
+		setupLogging(os.Stderr, lvl)
 		if err != nil {
 			logrus.Errorf("error parsing %s: %v", EnvLogLevel, err)
 		}
-		logrus.SetLevel(lvl)
+	}
+	if err := setupTracing(); err != nil {
+		logrus.Errorf("error setting up tracing: %v", err)
 	}
 }
 
@@ -42,12 +55,41 @@ func handler(ctx context.Context, event cfn.Event) (physicalResourceID string, d
 	physicalResourceID = event.PhysicalResourceID
 	data = make(map[string]interface{})
 
-	log.Printf("Event: %s", Dumps(event))
+	logger = newInvocationLogger(ctx, event)
+	logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_PARSE, "event": RedactEvent(event)}).Info("Event received")
+
+	ctx, span := tracer().Start(lambdaTraceContext(ctx), SPAN_DEPLOY, trace.WithAttributes(
+		attribute.String(LOG_REQUEST_TYPE, string(event.RequestType)),
+		attribute.String(LOG_LOGICAL_RESOURCE_ID, event.LogicalResourceID),
+	))
+	defer func() {
+		endSpan(span, err)
+		flushTraces(ctx)
+	}()
+
+	// Set once the copy starts, so that invalid properties are not counted as failed copies.
+	var metrics *CopyMetrics
+	defer func() {
+		if metrics == nil {
+			return
+		}
+		if err := metrics.Emit(metricsWriter, err == nil); err != nil {
+			logger.Warnf("error emitting metrics: %v", err)
+		}
+	}()
 
 	if event.RequestType == cfn.RequestDelete {
 		return physicalResourceID, data, nil
 	}
 	if event.RequestType == cfn.RequestCreate || event.RequestType == cfn.RequestUpdate {
+		// Ended with the error of the handler if parsing fails.
+		_, parseSpan := tracer().Start(ctx, SPAN_PARSE)
+		defer func() {
+			if parseSpan.IsRecording() {
+				endSpan(parseSpan, err)
+			}
+		}()
+
 		srcImage, err := getStrProps(event.ResourceProperties, SRC_IMAGE)
 		if err != nil {
 			return physicalResourceID, data, err
@@ -76,35 +118,190 @@ func handler(ctx context.Context, event cfn.Event) (physicalResourceID string, d
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		srcCreds, err := getStrPropsDefault(event.ResourceProperties, SRC_CREDS, "")
+		manifestFormat, err := getStrPropsDefault(event.ResourceProperties, MANIFEST_FORMAT, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		manifestType, err := GetManifestMIMEType(manifestFormat)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		compressionData, err := getStrPropsDefault(event.ResourceProperties, COMPRESSION_CONFIGS, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		compressionConfigs, err := GetCompressionConfigs(compressionData)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		if err := compressionConfigs.ValidateManifestType(manifestType); err != nil {
+			return physicalResourceID, data, err
+		}
+		preserveDigests, err := getBoolPropsDefault(event.ResourceProperties, PRESERVE_DIGESTS, false)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		expectedSourceDigest, err := getStrPropsDefault(event.ResourceProperties, EXPECTED_SOURCE_DIGEST, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		expectedDigest, err := GetExpectedSourceDigest(expectedSourceDigest)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		signaturePolicyData, err := getStrPropsDefault(event.ResourceProperties, SIGNATURE_POLICY, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		signaturePolicy, err := GetSignaturePolicy(signaturePolicyData)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		copyReferrers, err := getBoolPropsDefault(event.ResourceProperties, COPY_REFERRERS, false)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		signingKey, err := getStrPropsDefault(event.ResourceProperties, SIGNING_KEY, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		signer, err := GetImageSigner(signingKey)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		srcRole, err := getRoleProps(event.ResourceProperties, SRC_ROLE_ARN, SRC_EXTERNAL_ID, SRC_SESSION_NAME)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		destRole, err := getRoleProps(event.ResourceProperties, DEST_ROLE_ARN, DEST_EXTERNAL_ID, DEST_SESSION_NAME)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		srcAuthConfig, err := getAuthConfigProps(event.ResourceProperties, SRC_AUTH_CONFIG, SRC_CREDS)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		destAuthConfig, err := getAuthConfigProps(event.ResourceProperties, DEST_AUTH_CONFIG, DEST_CREDS)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		srcAuthenticators, err := getRegistryAuthProps(event.ResourceProperties, SRC_REGISTRY_AUTH)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		destAuthenticators, err := getRegistryAuthProps(event.ResourceProperties, DEST_REGISTRY_AUTH)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		progressData, err := getStrPropsDefault(event.ResourceProperties, PROGRESS_CONFIGS, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		progressConfigs, err := GetProgressConfigs(progressData)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		progressSinks, err := progressConfigs.NewSinks(defaultAWSClients)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		dockerHubData, err := getStrPropsDefault(event.ResourceProperties, DOCKER_HUB_CONFIGS, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		dockerHubConfigs, err := GetDockerHubConfigs(dockerHubData)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		pullThroughCacheData, err := getStrPropsDefault(event.ResourceProperties, PULL_THROUGH_CACHE, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		pullThroughCacheConfigs, err := GetPullThroughCacheConfigs(pullThroughCacheData)
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		copyConfigs := &CopyConfigs{
+			ManifestType:         manifestType,
+			Compression:          compressionConfigs,
+			PreserveDigests:      preserveDigests,
+			ExpectedSourceDigest: expectedDigest,
+			SignaturePolicy:      signaturePolicy,
+			CopyReferrers:        copyReferrers,
+			Signer:               signer,
+			SrcRole:              srcRole,
+			DestRole:             destRole,
+			SrcAuthConfig:        srcAuthConfig,
+			DestAuthConfig:       destAuthConfig,
+			SrcAuthenticators:    srcAuthenticators,
+			DestAuthenticators:   destAuthenticators,
+			Retry:                retryConfigs,
+			ProgressInterval:     progressConfigs.IntervalDuration(),
+			ProgressSinks:        progressSinks,
+			DockerHub:            dockerHubConfigs,
+			PullThroughCache:     pullThroughCacheConfigs,
+		}
+		srcCredsProp, err := getStrPropsDefault(event.ResourceProperties, SRC_CREDS, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+		destCredsProp, err := getStrPropsDefault(event.ResourceProperties, DEST_CREDS, "")
+		if err != nil {
+			return physicalResourceID, data, err
+		}
+
+		srcSecretConfigs, err := getSecretConfigsProps(event.ResourceProperties, SRC_SECRET_CONFIGS, srcCredsProp)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		destCreds, err := getStrPropsDefault(event.ResourceProperties, DEST_CREDS, "")
+		destSecretConfigs, err := getSecretConfigsProps(event.ResourceProperties, DEST_SECRET_CONFIGS, destCredsProp)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
 
-		srcCreds, err = parseCreds(srcCreds)
+		srcCreds, err := parseCreds(srcCredsProp, srcSecretConfigs)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
-		destCreds, err = parseCreds(destCreds)
+		destCreds, err := parseCreds(destCredsProp, destSecretConfigs)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
 
-		log.Printf("SrcImage: %v DestImage: %v ImageArch: %v CopyImageIndex: %v", srcImage, destImage, imageArch, copyImageIndex)
+		logger.WithFields(logrus.Fields{
+			LOG_SRC:          RedactURI(srcImage),
+			LOG_DEST:         RedactURI(destImage),
+			IMAGE_ARCH:       imageArch,
+			COPY_IMAGE_INDEX: copyImageIndex,
+			MANIFEST_FORMAT:  manifestFormat,
+			PRESERVE_DIGESTS: preserveDigests,
+		}).Info("Copying image")
+
+		parseSpan.End()
+
+		metrics = NewCopyMetrics(srcImage, destImage, string(event.RequestType))
+		copyConfigs.Metrics = metrics
 
 		// Main copy operation
-		err = copyImage(srcImage, destImage, srcCreds, destCreds, imageArch, copyImageIndex, retryConfigs)
+		result, err := copyImage(ctx, srcImage, destImage, srcCreds, destCreds, imageArch, copyImageIndex, copyConfigs)
 		if err != nil {
 			return physicalResourceID, data, err
 		}
+		data[DEST_DIGEST] = result.DestDigest.String()
+		if result.SrcDigest != "" {
+			data[SRC_DIGEST] = result.SrcDigest.String()
+			data[DIGESTS_MATCH] = strconv.FormatBool(result.DigestsMatch())
+		}
+		if copyConfigs.CopyReferrers {
+			data[REFERRERS_COPIED] = strconv.Itoa(result.Referrers)
+		}
+		if result.SignatureTag != "" {
+			data[SIGNATURE_TAG] = result.SignatureTag
+		}
 
 		// Apply architecture-specific image tags if specified
 		if archImageTags != "" {
-			err = applyArchImageTags(srcImage, destImage, srcCreds, destCreds, archImageTags, retryConfigs)
+			err = applyArchImageTags(ctx, srcImage, destImage, srcCreds, destCreds, archImageTags, copyConfigs)
 			if err != nil {
 				return physicalResourceID, data, err
 			}
@@ -118,14 +315,17 @@ func main() {
 	lambda.Start(cfn.LambdaWrap(handler))
 }
 
-func newTimeoutContext() (context.Context, context.CancelFunc) {
-	ctx := context.Background()
+func newTimeoutContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := parent
 	var cancel context.CancelFunc = func() {}
 	return ctx, cancel
 }
 
-func newPolicyContext() (*signature.PolicyContext, error) {
-	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+// newPolicyContext returns a policy context enforcing policy, or accepting anything if policy is nil.
+func newPolicyContext(policy *signature.Policy) (*signature.PolicyContext, error) {
+	if policy == nil {
+		policy = &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	}
 	return signature.NewPolicyContext(policy)
 }
 
@@ -162,90 +362,756 @@ func getBoolPropsDefault(m map[string]interface{}, k string, d bool) (bool, erro
 	return false, fmt.Errorf(`can't get %v as bool with value %v. valid values are "true" and "false"`, k, v)
 }
 
-func parseCreds(creds string) (string, error) {
+// getRoleProps reads the role ARN, external ID and session name properties of one side.
+func getRoleProps(m map[string]interface{}, roleArnKey string, externalIdKey string, sessionNameKey string) (*AssumeRoleConfigs, error) {
+	roleArn, err := getStrPropsDefault(m, roleArnKey, "")
+	if err != nil {
+		return nil, err
+	}
+	externalId, err := getStrPropsDefault(m, externalIdKey, "")
+	if err != nil {
+		return nil, err
+	}
+	sessionName, err := getStrPropsDefault(m, sessionNameKey, "")
+	if err != nil {
+		return nil, err
+	}
+	role, err := NewAssumeRoleConfigs(roleArn, externalId, sessionName)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", roleArnKey, err.Error())
+	}
+	return role, nil
+}
+
+// getAuthConfigProps loads the auth config property of one side, which can't be combined
+// with the creds property of that side.
+func getAuthConfigProps(m map[string]interface{}, authConfigKey string, credsKey string) ([]byte, error) {
+	authConfig, err := getStrPropsDefault(m, authConfigKey, "")
+	if err != nil {
+		return nil, err
+	}
+	creds, err := getStrPropsDefault(m, credsKey, "")
+	if err != nil {
+		return nil, err
+	}
+	if authConfig != "" && creds != "" {
+		return nil, fmt.Errorf("%v and %v can't be both set", authConfigKey, credsKey)
+	}
+	return GetAuthConfig(authConfig)
+}
+
+// getRegistryAuthProps builds the native registry authenticators of one side.
+func getRegistryAuthProps(m map[string]interface{}, k string) (*AuthenticatorRegistry, error) {
+	data, err := getStrPropsDefault(m, k, "")
+	if err != nil {
+		return nil, err
+	}
+	configs, err := GetRegistryAuthConfigs(data)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthenticatorRegistry(configs)
+}
+
+// getSecretConfigsProps parses the secret configuration of one side, which requires the
+// credentials of that side to be a secret or an SSM parameter.
+func getSecretConfigsProps(m map[string]interface{}, k string, creds string) (*SecretConfigs, error) {
+	data, err := getStrPropsDefault(m, k, "")
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		return nil, nil
+	}
+	credsType := GetCredsType(creds)
+	if creds == "" || credsType == SECRET_TEXT {
+		return nil, fmt.Errorf("%v requires the credentials to be a secret name or ARN, or an SSM parameter", k)
+	}
+	configs, err := GetSecretConfigs(data)
+	if err != nil {
+		return nil, err
+	}
+	if credsType == SSM_PARAMETER && (configs.VersionStage != nil || configs.VersionId != nil) {
+		return nil, fmt.Errorf("%v: versionStage and versionId are not supported for SSM parameters", k)
+	}
+	return configs, nil
+}
+
+// parseCreds returns the authenticator of the SrcCreds or DestCreds property, or nil if it is
+// empty. Secrets are fetched on first use.
+func parseCreds(creds string, secretConfigs *SecretConfigs) (RegistryAuthenticator, error) {
 	credsType := GetCredsType(creds)
 	if creds == "" {
-		return "", nil
+		return nil, nil
 	} else if (credsType == SECRET_ARN) || (credsType == SECRET_NAME) {
-		secret, err := GetSecret(creds)
-		if err == nil && len(secret) > 0 && json.Valid([]byte(secret)) {
-			secret, err = ParseJsonSecret(secret)
-		}
-		return secret, err
+		return NewSecretAuthenticator(creds, secretConfigs), nil
+	} else if credsType == SSM_PARAMETER {
+		return NewSSMParameterAuthenticator(creds, secretConfigs), nil
 	} else if credsType == SECRET_TEXT {
-		return creds, nil
+		return NewStaticAuthenticator(creds), nil
 	}
-	return "", fmt.Errorf("unkown creds type")
+	return nil, fmt.Errorf("unkown creds type")
+}
+
+// CopyConfigs holds the settings shared by every copy of a deployment.
+type CopyConfigs struct {
+	ManifestType         string
+	Compression          *CompressionConfigs
+	PreserveDigests      bool
+	ExpectedSourceDigest digest.Digest     // Empty if the source is not pinned
+	ExpectsIndexDigest   bool              // ExpectedSourceDigest must be the digest of the image index, as for per-arch copies
+	SignaturePolicy      *signature.Policy // Nil if any source image is accepted
+	CopyReferrers        bool
+	Signer               ImageSigner        // Nil if the destination image is not signed
+	SrcRole              *AssumeRoleConfigs // Nil if the source is read with the Lambda's own credentials
+	DestRole             *AssumeRoleConfigs // Nil if the destination is written with the Lambda's own credentials
+	SrcAuthConfig        []byte             // docker config.json-style credentials of the source, nil if not set
+	DestAuthConfig       []byte             // docker config.json-style credentials of the destination, nil if not set
+	SrcAuthenticators    *AuthenticatorRegistry
+	DestAuthenticators   *AuthenticatorRegistry
+	Retry                *RetryConfigs
+	Metrics              *CopyMetrics             // Nil if the copies are not measured
+	ProgressInterval     time.Duration            // Interval between two progress reports of a blob, DEFAULT_PROGRESS_INTERVAL if zero
+	ProgressSinks        []ProgressSink           // Receivers of the progress reports besides the logs
+	DockerHub            *DockerHubConfigs        // Nil if the Docker Hub rate limit is not checked
+	PullThroughCache     *PullThroughCacheConfigs // Nil if sources are not copied through an ECR pull-through cache
+}
+
+// InspectsSource reports whether the source manifests are read before the copy, for the checks
+// of the options or the digest the referrers are looked up by.
+func (c *CopyConfigs) InspectsSource() bool {
+	return c.ManifestType != "" || c.PreserveDigests || c.ExpectedSourceDigest != "" || c.CopyReferrers
 }
 
-func copyImage(srcImage string, destImage string, srcCreds string, destCreds string, imageArch string, copyImageIndex bool, retryConfigs *RetryConfigs) error {
+// CopyResult describes the manifests on both ends of a successful copy.
+type CopyResult struct {
+	SrcDigest    digest.Digest // Empty if the source was not inspected
+	DestDigest   digest.Digest
+	Referrers    int    // Number of referrers and referrer tags copied along with the image
+	SignatureTag string // Destination tag holding the signature of the image, empty if unsigned
+}
+
+// DigestsMatch reports whether the destination manifest is byte-for-byte the source manifest.
+func (r *CopyResult) DigestsMatch() bool {
+	return r.SrcDigest != "" && r.SrcDigest == r.DestDigest
+}
+
+func copyImage(ctx context.Context, srcImage string, destImage string, srcCreds RegistryAuthenticator, destCreds RegistryAuthenticator, imageArch string, copyImageIndex bool, copyConfigs *CopyConfigs) (result *CopyResult, err error) {
+	ctx, cancel := newTimeoutContext(ctx)
+	defer cancel()
+	ctx, span := tracer().Start(ctx, SPAN_COPY_IMAGE, trace.WithAttributes(
+		attribute.String(LOG_SRC, RedactURI(srcImage)),
+		attribute.String(LOG_DEST, RedactURI(destImage)),
+		attribute.String(IMAGE_ARCH, imageArch),
+	))
+	defer func() { endSpan(span, err) }()
+
 	srcRef, err := alltransports.ParseImageName(srcImage)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	destRef, err := alltransports.ParseImageName(destImage)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	srcOpts := NewImageOpts(srcImage, imageArch, copyImageIndex)
-	srcOpts.SetCreds(srcCreds)
-	srcCtx, err := srcOpts.NewSystemContext()
-	if err != nil {
-		return err
+	var srcOpts *ImageOpts
+	var srcCtx *types.SystemContext
+	// useSource sets the source to copy from. Images in a pull-through cache are read with ECR auto
+	// login, as the credentials of their upstream registry don't apply to them.
+	useSource := func(image string, fromCache bool) (types.ImageReference, *types.SystemContext, error) {
+		ref, err := alltransports.ParseImageName(image)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts := NewImageOpts(image, imageArch, copyImageIndex)
+		if !fromCache {
+			opts.SetCreds(srcCreds)
+			opts.SetAuthConfig(copyConfigs.SrcAuthConfig)
+			opts.SetAuthenticators(copyConfigs.SrcAuthenticators)
+		}
+		opts.SetRole(copyConfigs.SrcRole)
+		opts.SetContext(ctx)
+		sys, err := opts.NewSystemContext()
+		if err != nil {
+			return nil, nil, err
+		}
+		srcImage, srcRef, srcOpts, srcCtx = image, ref, opts, sys
+		return ref, sys, nil
+	}
+	pullThroughImage := ""
+	if copyConfigs.PullThroughCache != nil {
+		pullThroughImage, err = copyConfigs.PullThroughCache.CacheImage(srcRef, destImage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pullThroughImage != "" {
+		if err := pullThroughCacheSource(ctx, srcImage, pullThroughImage, copyConfigs.PullThroughCache, useSource); err != nil {
+			return nil, err
+		}
+	} else if _, _, err := useSource(srcImage, false); err != nil {
+		return nil, err
+	}
+	checksDockerHub := copyConfigs.DockerHub != nil && aws.ToBool(copyConfigs.DockerHub.CheckRateLimit) && isDockerHubImage(srcRef)
+	if copyConfigs.SignaturePolicy != nil {
+		// Lets sigstoreSigned requirements find signatures attached to the source image.
+		srcCtx.RegistriesDirPath, err = GetRegistriesDir()
+		if err != nil {
+			return nil, err
+		}
 	}
 	destOpts := NewImageOpts(destImage, imageArch, copyImageIndex)
 	destOpts.SetCreds(destCreds)
+	destOpts.SetRole(copyConfigs.DestRole)
+	destOpts.SetAuthConfig(copyConfigs.DestAuthConfig)
+	destOpts.SetAuthenticators(copyConfigs.DestAuthenticators)
+	destOpts.SetCompression(copyConfigs.Compression)
+	destOpts.SetContext(ctx)
 	destCtx, err := destOpts.NewSystemContext()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if precomputesLayerDigests(srcRef) {
+		fits, err := layersFitTemporaryDir(ctx, srcRef, destCtx.BigFilesTemporaryDir)
+		if err != nil {
+			logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_COPY, LOG_SRC: RedactURI(srcImage), "error": err}).Warn("Not computing layer digests before pushing: the archive size is unknown")
+		} else if !fits {
+			logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_COPY, LOG_SRC: RedactURI(srcImage)}).Warn("Not computing layer digests before pushing: the archive is larger than the free space in the temporary directory. " +
+				"Raise the ephemeral storage of the Lambda for retries to skip the layers already pushed")
+		}
+		destCtx.DockerRegistryPushPrecomputeDigests = fits
 	}
 
-	ctx, cancel := newTimeoutContext()
-	defer cancel()
-	policyContext, err := newPolicyContext()
+	policyContext, err := newPolicyContext(copyConfigs.SignaturePolicy)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer policyContext.Destroy()
 
+	entry := logger.WithFields(logrus.Fields{LOG_SRC: RedactURI(srcImage), LOG_DEST: RedactURI(destImage)})
 	copyOpts := &copy.Options{
-		ReportWriter:   os.Stdout,
-		DestinationCtx: destCtx,
-		SourceCtx:      srcCtx,
+		DestinationCtx:        destCtx,
+		SourceCtx:             srcCtx,
+		ForceManifestMIMEType: copyConfigs.ManifestType,
+		// When forced, blobs compressed with another algorithm are not reused and get recompressed.
+		ForceCompressionFormat: aws.ToBool(copyConfigs.Compression.ForceRecompress),
+		PreserveDigests:        copyConfigs.PreserveDigests,
 	}
 	if copyImageIndex {
 		copyOpts.ImageListSelection = copy.CopyAllImages
 	}
+	reporter := NewProgressReporter(ctx, entry.WithField(LOG_PHASE, PHASE_COPY), srcImage, destImage, copyConfigs.ProgressSinks)
+	blobs := newBlobSpans(ctx)
+	defer blobs.End()
+	progressHandlers := []func(types.ProgressProperties){reporter.Report, blobs.Report}
+	if copyConfigs.Metrics != nil {
+		progressHandlers = append(progressHandlers, copyConfigs.Metrics.addProgress)
+	}
+	progress, stopProgress := trackProgress(progressHandlers...)
+	defer stopProgress()
+	copyOpts.Progress = progress
+	copyOpts.ProgressInterval = copyConfigs.ProgressInterval
+	if copyOpts.ProgressInterval == 0 {
+		copyOpts.ProgressInterval = DEFAULT_PROGRESS_INTERVAL
+	}
+
+	result = &CopyResult{}
+	// Reading the source manifests costs a pull of each, and a scan of the whole archive of an
+	// S3 source, so the source is only inspected when a check needs it. The Docker Hub quota is
+	// checked along, so that the copy is retried once a used up quota comes back.
+	var inspect func(ctx context.Context) (types.ImageReference, error)
+	if copyConfigs.InspectsSource() || checksDockerHub {
+		inspect = func(ctx context.Context) (types.ImageReference, error) {
+			if checksDockerHub {
+				cacheImage, err := dockerHubSource(ctx, srcImage, srcRef, srcCtx, copyImageIndex, copyConfigs.InspectsSource(), copyConfigs.DockerHub)
+				if err != nil {
+					return nil, err
+				}
+				checksDockerHub = false
+				if cacheImage != "" {
+					registriesDir := srcCtx.RegistriesDirPath
+					if _, _, err := useSource(cacheImage, true); err != nil {
+						return nil, err
+					}
+					srcCtx.RegistriesDirPath = registriesDir
+					copyOpts.SourceCtx = srcCtx
+				}
+			}
+			if !copyConfigs.InspectsSource() {
+				return srcRef, nil
+			}
+			info, err := inspectSource(ctx, srcRef, srcCtx, copyImageIndex)
+			if err != nil {
+				return nil, err
+			}
+			ref := srcRef
+			if copyConfigs.ExpectedSourceDigest != "" {
+				verify := info.VerifyDigest
+				if copyConfigs.ExpectsIndexDigest {
+					verify = info.VerifyIndexDigest
+				}
+				if err := verify(copyConfigs.ExpectedSourceDigest); err != nil {
+					return nil, err
+				}
+				// Copy by digest so that a tag moved after the check can't change what is copied.
+				ref, err = pinSourceReference(srcRef, info)
+				if err != nil {
+					return nil, err
+				}
+			}
+			// Layers are only carried over as-is when they are not forcibly recompressed.
+			if copyConfigs.ManifestType != "" && !aws.ToBool(copyConfigs.Compression.ForceRecompress) {
+				if err := ValidateManifestLayers(copyConfigs.ManifestType, info.Layers); err != nil {
+					return nil, err
+				}
+			}
+			if copyConfigs.PreserveDigests {
+				if err := CheckPreserveDigests(info.MIMEType, copyConfigs.ManifestType, copyConfigs.Compression); err != nil {
+					return nil, err
+				}
+			}
+			result.SrcDigest = info.Digest
+			return ref, nil
+		}
+	}
+
+	// Tokens are refreshed between attempts, so that retries of a long copy don't use expired ones.
+	refreshAuth := func(force bool) error {
+		if err := srcOpts.RefreshAuth(srcCtx, force); err != nil {
+			return err
+		}
+		return destOpts.RefreshAuth(destCtx, force)
+	}
+	copiedManifest, err := copyWithRetry(ctx, entry.WithField(LOG_PHASE, PHASE_COPY), policyContext, destRef, srcRef, copyOpts, copyConfigs.Retry, reporter, copyConfigs.Metrics, refreshAuth, inspect)
+	if err != nil {
+		if pre, ok := AsPolicyRequirementError(err); ok {
+			return nil, fmt.Errorf("source image rejected by signature policy: %s", pre.Error())
+		}
+		if copyConfigs.PreserveDigests && IsPreserveDigestsError(err) {
+			return nil, fmt.Errorf("digests cannot be preserved: %s", err.Error())
+		}
+		return nil, err
+	}
+	result.DestDigest, err = manifest.Digest(copiedManifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if copyConfigs.CopyReferrers {
+		result.Referrers, err = copyImageReferrers(ctx, entry.WithField(LOG_PHASE, PHASE_REFERRERS), srcRef, destRef, srcCtx, destCtx, result, copyConfigs.Retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Signed last, so that copied referrers don't replace the new signature.
+	if copyConfigs.Signer != nil {
+		result.SignatureTag, err = signImage(ctx, copyConfigs.Signer, destRef, destCtx, result.DestDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
 
+// pullThroughCacheSource makes useSource copy from cacheImage, the image of srcImage in the
+// pull-through cache of configs. The cache is read first, which pulls the image through on a
+// miss; if that fails, srcImage is copied from its upstream registry instead unless the
+// fallback is disabled.
+func pullThroughCacheSource(ctx context.Context, srcImage string, cacheImage string, configs *PullThroughCacheConfigs, useSource func(image string, fromCache bool) (types.ImageReference, *types.SystemContext, error)) error {
+	entry := logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_COPY, LOG_SRC: RedactURI(srcImage), "cache": RedactURI(cacheImage)})
+	cacheRef, cacheCtx, err := useSource(cacheImage, true)
+	if err == nil {
+		err = ReadPullThroughCache(ctx, cacheRef, cacheCtx)
+	}
+	if err == nil {
+		entry.Info("Copying from the pull-through cache")
+		return nil
+	}
+	if !aws.ToBool(configs.FallbackOnMiss) || ctx.Err() != nil {
+		return fmt.Errorf("error reading %s from the pull-through cache: %w", RedactURI(cacheImage), err)
+	}
+	entry.WithField("error", RedactURI(err.Error())).Warn("Unable to read the pull-through cache, copying from the upstream registry")
+	_, _, err = useSource(srcImage, false)
+	return err
+}
+
+// dockerHubSource checks that the Docker Hub pull quota left covers copying srcRef. When it
+// doesn't, it returns the image to copy from the pull-through cache of configs instead, or a
+// DockerHubRateLimitError if there is none. It returns "" to copy srcImage as it is, including
+// when the quota can't be checked: the copy itself then reports what is wrong.
+func dockerHubSource(ctx context.Context, srcImage string, srcRef types.ImageReference, srcCtx *types.SystemContext, copyImageIndex bool, inspectsSource bool, configs *DockerHubConfigs) (cacheImage string, err error) {
+	ctx, span := tracer().Start(ctx, SPAN_RATE_LIMIT)
+	defer func() { endSpan(span, err) }()
+
+	entry := logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_COPY, LOG_SRC: RedactURI(srcImage)})
+	rateLimit, checkErr := CheckDockerHubRateLimit(ctx, srcCtx, srcRef, copyImageIndex, inspectsSource)
+	if checkErr != nil {
+		entry.Warnf("Unable to check the Docker Hub rate limit: %v", RedactURI(checkErr.Error()))
+		return "", nil
+	}
+	if rateLimit == nil {
+		return "", nil
+	}
+	span.SetAttributes(
+		attribute.Int("ratelimit.remaining", rateLimit.Remaining),
+		attribute.Int("ratelimit.required", rateLimit.Required),
+	)
+	entry = entry.WithFields(logrus.Fields{"remaining": rateLimit.Remaining, "limit": rateLimit.Limit, "required": rateLimit.Required})
+	if rateLimit.Sufficient() {
+		entry.Info("Docker Hub rate limit checked")
+		return "", nil
+	}
+	if configs.PullThroughCachePrefix == nil {
+		return "", &DockerHubRateLimitError{Image: RedactURI(srcImage), RateLimit: rateLimit}
+	}
+	cached, err := PullThroughCacheReference(srcRef.DockerReference(), *configs.PullThroughCachePrefix)
+	if err != nil {
+		return "", err
+	}
+	cacheImage = "docker://" + cached.String()
+	entry.WithField("cache", cacheImage).Warn("Docker Hub rate limit too low, copying from the pull-through cache")
+	return cacheImage, nil
+}
+
+// precomputesLayerDigests returns whether the layers of srcRef get their digest computed before
+// they are pushed. Archive layers are uncompressed tarballs, compressed on the fly, so their
+// digest at the destination is only known once compressed; computing it first lets a retry,
+// or a later deployment, skip the layers already pushed instead of reading and uploading them
+// again. The compressed layer is buffered in a temporary file.
+func precomputesLayerDigests(srcRef types.ImageReference) bool {
+	switch srcRef.Transport().Name() {
+	case "s3", "docker-archive":
+		return true
+	}
+	return false
+}
+
+// layersFitTemporaryDir reports whether the compressed layers of the archive of srcRef fit in
+// the free space of dir, where they are buffered to compute their digest. The layers of an
+// archive take at most about its size once compressed, even when buffered in parallel.
+func layersFitTemporaryDir(ctx context.Context, srcRef types.ImageReference, dir string) (bool, error) {
+	var size int64
+	switch srcRef.Transport().Name() {
+	case "s3":
+		var err error
+		size, err = GetS3ObjectSize(ctx, "s3:"+srcRef.StringWithinTransport())
+		if err != nil {
+			return false, err
+		}
+	case "docker-archive":
+		path, _, _ := strings.Cut(srcRef.StringWithinTransport(), ":")
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		size = info.Size()
+	default:
+		return false, fmt.Errorf("unsupported transport %s", srcRef.Transport().Name())
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return false, err
+	}
+	return size <= int64(stat.Bavail)*int64(stat.Bsize), nil
+}
+
+// copyWithRetry runs copy.Image, retrying transient errors as configured by retryConfigs.
+// Errors that are not retryable are returned as they are, wrapped. refreshAuth, if not nil,
+// updates the registry tokens of copyOpts before a retry, forcibly after an expired token.
+// The copy report and the retries are logged to entry, with the attempt number also set on
+// reporter if not nil, and the retries are counted in metrics if not nil. Retries wait for the
+// delay the server asked for if it is longer than the backoff, within the limits of RetryDelay.
+// inspect, if not nil, reads the source before the copy and returns the reference to copy; it is
+// retried along with the copy until it succeeds, and its errors that are not retryable are
+// returned as they are.
+func copyWithRetry(ctx context.Context, entry *logrus.Entry, policyContext *signature.PolicyContext, destRef types.ImageReference, srcRef types.ImageReference, copyOpts *copy.Options, retryConfigs *RetryConfigs, reporter *ProgressReporter, metrics *CopyMetrics, refreshAuth func(force bool) error, inspect func(ctx context.Context) (types.ImageReference, error)) ([]byte, error) {
+	var err error
 	attempts := aws.ToInt(retryConfigs.NumAttempts)
-	baseDelay := aws.ToFloat64(retryConfigs.BaseDelay)
-	maxDelay := aws.ToFloat64(retryConfigs.MaxDelay)
 	for i := 0; i < attempts; i++ {
-		_, err = copy.Image(ctx, policyContext, destRef, srcRef, copyOpts)
+		attemptEntry := entry.WithField(LOG_ATTEMPT, i+1)
+		manifests := newManifestSpans(ctx)
+		copyOpts.ReportWriter = newReportWriter(attemptEntry, manifests.Line)
+		reporter.SetAttempt(i + 1)
+		var copiedManifest []byte
+		inspecting := inspect != nil
+		if inspecting {
+			var ref types.ImageReference
+			if ref, err = inspect(ctx); err == nil {
+				srcRef, inspect, inspecting = ref, nil, false
+			}
+		}
+		if !inspecting {
+			copiedManifest, err = copy.Image(ctx, policyContext, destRef, srcRef, copyOpts)
+		}
+		manifests.End(err)
 		if err == nil {
-			return nil
+			return copiedManifest, nil
 		}
-		if IsRetryableError(err) && i < (attempts-1) {
-			wait := BackoffWithJitter(i+1, baseDelay, maxDelay)
-			log.Printf("Transient error on attempt (%v/%v). Retrying in %v... Error: %s", (i + 1), attempts, wait, err.Error())
-			time.Sleep(wait)
+		if refreshAuth != nil && IsAuthExpiredError(err) && i < (attempts-1) {
+			attemptEntry.Warnf("Registry token expired on attempt (%v/%v). Refreshing it and retrying...", (i + 1), attempts)
+			metrics.AddRetry()
+			if err := refreshAuth(true); err != nil {
+				return nil, err
+			}
 			continue
 		}
-		return fmt.Errorf("copy image failed with unknown error: %s", err.Error())
+		if retryConfigs.IsRetryable(err) && i < (attempts-1) {
+			if err := waitToRetry(ctx, attemptEntry, "copy image", err, i, retryConfigs); err != nil {
+				return nil, err
+			}
+			metrics.AddRetry()
+			if refreshAuth != nil {
+				if err := refreshAuth(false); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if inspecting {
+			return nil, err
+		}
+		return nil, fmt.Errorf("copy image failed with unknown error: %w", err)
+	}
+	return nil, fmt.Errorf("copy image failed after %d retries: %w", attempts, err)
+}
+
+// waitToRetry waits before retrying operation after attempt i failed with the transient err,
+// logging the wait to entry. Retries wait for the delay the server asked for if it is longer than
+// the backoff, within the limits of RetryDelay. It returns the error to fail with instead when no
+// time is left to retry before the deadline, or the server asked to wait past it.
+func waitToRetry(ctx context.Context, entry *logrus.Entry, operation string, err error, i int, retryConfigs *RetryConfigs) error {
+	attempts := aws.ToInt(retryConfigs.NumAttempts)
+	wait, hint, ok := RetryDelay(ctx, err, i+1, aws.ToFloat64(retryConfigs.BaseDelay), aws.ToFloat64(retryConfigs.MaxDelay))
+	retryEntry := entry.WithFields(logrus.Fields{"error": RedactURI(err.Error()), "errorCategory": ClassifyError(err)})
+	if hint > 0 {
+		retryEntry = retryEntry.WithField("retryAfter", hint.String())
+	}
+	if !ok && hint > 0 {
+		retryEntry.Warnf("Transient error on attempt (%v/%v), and the server asked to wait past the deadline", (i + 1), attempts)
+		return fmt.Errorf("%s failed, and the server asked to wait %v before retrying, past the deadline of the invocation: %w", operation, hint, err)
+	}
+	if !ok {
+		retryEntry.Warnf("Transient error on attempt (%v/%v), with no time left to retry before the deadline", (i + 1), attempts)
+		return fmt.Errorf("%s failed with no time left to retry: %w", operation, err)
+	}
+	if hint > wait {
+		retryEntry.WithField("maxDelay", wait.String()).Warnf("Server asked to wait %v, longer than the maxDelay of the RetryConfigs. Retrying sooner, which may fail again", hint)
+	}
+	retryEntry.WithField("wait", wait.String()).Warnf("Transient error on attempt (%v/%v). Retrying in %v...", (i + 1), attempts, wait)
+	time.Sleep(wait)
+	return nil
+}
+
+// copyImageReferrers copies the signatures, attestations and other OCI referrers of the copied
+// image, which are only valid if the destination kept the source digest.
+func copyImageReferrers(ctx context.Context, entry *logrus.Entry, srcRef types.ImageReference, destRef types.ImageReference, srcCtx *types.SystemContext, destCtx *types.SystemContext, result *CopyResult, retryConfigs *RetryConfigs) (int, error) {
+	if srcRef.Transport().Name() != docker.Transport.Name() || destRef.Transport().Name() != docker.Transport.Name() {
+		entry.Info("Skipping referrers: only supported between docker registries")
+		return 0, nil
+	}
+	if !result.DigestsMatch() {
+		return 0, fmt.Errorf("referrers can't be copied: destination digest %s differs from source digest %s, set PreserveDigests to keep it", result.DestDigest, result.SrcDigest)
+	}
+
+	var referrers *Referrers
+	var err error
+	for i := 0; ; i++ {
+		if referrers, err = DiscoverReferrers(ctx, srcCtx, srcRef, result.SrcDigest); err == nil {
+			break
+		}
+		if !retryConfigs.IsRetryable(err) || i >= aws.ToInt(retryConfigs.NumAttempts)-1 {
+			return 0, err
+		}
+		if err := waitToRetry(ctx, entry.WithField(LOG_ATTEMPT, i+1), "discover referrers", err, i, retryConfigs); err != nil {
+			return 0, err
+		}
+	}
+	refs, err := referrerRefs(srcRef, destRef, referrers)
+	if err != nil {
+		return 0, err
+	}
+
+	// Referrers are unsigned artifacts that refer to an already verified image.
+	policyContext, err := newPolicyContext(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer policyContext.Destroy()
+	copyOpts := &copy.Options{
+		SourceCtx:       srcCtx,
+		DestinationCtx:  destCtx,
+		PreserveDigests: true,
+		// Only the index itself; the referrer manifests it lists are copied on their own.
+		ImageListSelection:       copy.CopySpecificImages,
+		SparseManifestListAction: copy.KeepSparseManifestList,
+	}
+	for _, ref := range refs {
+		refEntry := entry.WithField(LOG_SRC, RedactURI(transports.ImageName(ref[0])))
+		refEntry.Info("Copying referrer")
+		if _, err := copyWithRetry(ctx, refEntry, policyContext, ref[1], ref[0], copyOpts, retryConfigs, nil, nil, nil, nil); err != nil {
+			return 0, fmt.Errorf("error copying referrer %s: %w", transports.ImageName(ref[0]), err)
+		}
+	}
+	return len(refs), nil
+}
+
+// sourceImageInfo describes the source image as copyImage is going to read it.
+type sourceImageInfo struct {
+	Digest      digest.Digest    // Digest of the top-level manifest, or of the instance selected from an image index
+	MIMEType    string           // MIME type of that manifest
+	IndexDigest digest.Digest    // Digest of the image index, empty if the source is a single image
+	Layers      []types.BlobInfo // Layers of every image that is going to be copied
+}
+
+// VerifyDigest checks that the source is the image identified by expected, which may be
+// the digest of the copied manifest or of the image index it was selected from.
+func (info *sourceImageInfo) VerifyDigest(expected digest.Digest) error {
+	if expected == info.Digest || expected == info.IndexDigest {
+		return nil
+	}
+	if info.IndexDigest != "" {
+		return fmt.Errorf("source digest mismatch: expected %s, got %s (image index %s)", expected, info.Digest, info.IndexDigest)
+	}
+	return fmt.Errorf("source digest mismatch: expected %s, got %s", expected, info.Digest)
+}
+
+// VerifyIndexDigest checks that the source is the image index identified by expected. The
+// instances selected from it are pinned by the index, so it stands for all of them.
+func (info *sourceImageInfo) VerifyIndexDigest(expected digest.Digest) error {
+	if info.IndexDigest == "" {
+		return fmt.Errorf("source digest mismatch: expected image index %s, got single image %s", expected, info.Digest)
+	}
+	if expected != info.IndexDigest {
+		return fmt.Errorf("source digest mismatch: expected image index %s, got %s", expected, info.IndexDigest)
+	}
+	return nil
+}
+
+// pinSourceReference returns a reference to the manifest inspected in info, so that the copy
+// reads exactly what was verified. Docker references are pinned by digest; the sources of
+// other transports, such as archives, are checked against the digest as they are read.
+func pinSourceReference(srcRef types.ImageReference, info *sourceImageInfo) (types.ImageReference, error) {
+	pinned := info.Digest
+	if info.IndexDigest != "" {
+		pinned = info.IndexDigest
+	}
+	if srcRef.Transport().Name() != docker.Transport.Name() || srcRef.DockerReference() == nil {
+		return &digestPinnedReference{ImageReference: srcRef, digest: pinned}, nil
+	}
+	named, err := reference.WithDigest(reference.TrimNamed(srcRef.DockerReference()), pinned)
+	if err != nil {
+		return nil, err
+	}
+	return docker.NewReference(named)
+}
+
+// digestPinnedReference is a source whose top-level manifest must have the given digest, for
+// transports which can't reference a manifest by digest.
+type digestPinnedReference struct {
+	types.ImageReference
+	digest digest.Digest
+}
+
+func (r *digestPinnedReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &digestPinnedSource{ImageSource: src, digest: r.digest}, nil
+}
+
+// digestPinnedSource fails to read a top-level manifest other than the pinned one, such as that
+// of an archive replaced after it was verified. The copy checks the blobs against the manifest.
+type digestPinnedSource struct {
+	types.ImageSource
+	digest digest.Digest
+}
+
+func (s *digestPinnedSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	b, mimeType, err := s.ImageSource.GetManifest(ctx, instanceDigest)
+	if err != nil || instanceDigest != nil {
+		return b, mimeType, err
+	}
+	if ok, err := manifest.MatchesDigest(b, s.digest); err != nil || !ok {
+		actual, _ := manifest.Digest(b)
+		return nil, "", fmt.Errorf("source changed after it was verified: expected manifest %s, got %s", s.digest, actual)
+	}
+	return b, mimeType, nil
+}
+
+// inspectSource reads the source manifests copyImage is going to write: all instances of
+// an image index when copyImageIndex is set, otherwise the single image selected by srcCtx.
+func inspectSource(ctx context.Context, srcRef types.ImageReference, srcCtx *types.SystemContext, copyImageIndex bool) (info *sourceImageInfo, err error) {
+	ctx, span := tracer().Start(ctx, SPAN_RESOLVE_SOURCE)
+	defer func() { endSpan(span, err) }()
+
+	src, err := srcRef.NewImageSource(ctx, srcCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	manifestBlob, manifestType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	info = &sourceImageInfo{MIMEType: manifestType}
+	instances := []*digest.Digest{nil}
+	if manifest.MIMETypeIsMultiImage(manifestType) {
+		list, err := manifest.ListFromBlob(manifestBlob, manifestType)
+		if err != nil {
+			return nil, err
+		}
+		info.IndexDigest, err = manifest.Digest(manifestBlob)
+		if err != nil {
+			return nil, err
+		}
+		if copyImageIndex {
+			instances = nil
+			for _, d := range list.Instances() {
+				instances = append(instances, &d)
+			}
+		} else {
+			instance, err := list.ChooseInstance(srcCtx)
+			if err != nil {
+				return nil, err
+			}
+			instances = []*digest.Digest{&instance}
+			manifestBlob, info.MIMEType, err = src.GetManifest(ctx, &instance)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	info.Digest, err = manifest.Digest(manifestBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	info.Layers = []types.BlobInfo{}
+	for _, instance := range instances {
+		img, err := image.FromUnparsedImage(ctx, srcCtx, image.UnparsedInstance(src, instance))
+		if err != nil {
+			return nil, err
+		}
+		info.Layers = append(info.Layers, img.LayerInfos()...)
 	}
-	return fmt.Errorf("copy image failed after %d retries: %s", attempts, err.Error())
+	return info, nil
 }
 
-func applyArchImageTags(srcImage string, destImage string, srcCreds string, destCreds string, archImageTags string, retryConfigs *RetryConfigs) error {
+func applyArchImageTags(ctx context.Context, srcImage string, destImage string, srcCreds RegistryAuthenticator, destCreds RegistryAuthenticator, archImageTags string, copyConfigs *CopyConfigs) error {
 	tags, err := GetImageTagsMap(archImageTags)
 	if err != nil {
 		return err
 	}
 
+	// Each copy selects another instance of the source index, so only the index digest pins them all.
+	archConfigs := *copyConfigs
+	archConfigs.ExpectsIndexDigest = true
 	for arch, tag := range tags {
 		archDestImage := GetImageDestination(destImage, tag)
-		err := copyImage(srcImage, archDestImage, srcCreds, destCreds, arch, false, retryConfigs)
+		_, err := copyImage(ctx, srcImage, archDestImage, srcCreds, destCreds, arch, false, &archConfigs)
 		if err != nil {
 			return err
 		}
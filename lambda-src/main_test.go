@@ -4,13 +4,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker"
 	"go.podman.io/image/v5/transports/alltransports"
-	"github.com/stretchr/testify/assert"
+	"go.podman.io/image/v5/types"
 
 	_ "cdk-ecr-deployment-handler/s3"
 )
@@ -39,10 +51,11 @@ func TestMain(t *testing.T) {
 	destOpts := NewImageOpts(destImage, "", false)
 	destCtx, err := destOpts.NewSystemContext()
 	assert.NoError(t, err)
+	assert.Equal(t, os.TempDir(), destCtx.BigFilesTemporaryDir)
 
-	ctx, cancel := newTimeoutContext()
+	ctx, cancel := newTimeoutContext(context.Background())
 	defer cancel()
-	policyContext, err := newPolicyContext()
+	policyContext, err := newPolicyContext(nil)
 	assert.NoError(t, err)
 	defer policyContext.Destroy()
 
@@ -85,3 +98,423 @@ func TestGetBoolPropsDefault(t *testing.T) {
 	_, err = getBoolPropsDefault(props, "intKey", false)
 	assert.Error(t, err)
 }
+
+func TestGetRoleProps(t *testing.T) {
+	props := map[string]interface{}{
+		SRC_ROLE_ARN:      "arn:aws:iam::123456789012:role/ecr-pull",
+		DEST_ROLE_ARN:     "arn:aws:iam::210987654321:role/ecr-push",
+		DEST_EXTERNAL_ID:  "ext-123",
+		DEST_SESSION_NAME: "pipeline",
+	}
+
+	role, err := getRoleProps(props, SRC_ROLE_ARN, SRC_EXTERNAL_ID, SRC_SESSION_NAME)
+	require.NoError(t, err)
+	assert.Equal(t, &AssumeRoleConfigs{RoleArn: "arn:aws:iam::123456789012:role/ecr-pull", SessionName: DEFAULT_SESSION_NAME}, role)
+
+	role, err = getRoleProps(props, DEST_ROLE_ARN, DEST_EXTERNAL_ID, DEST_SESSION_NAME)
+	require.NoError(t, err)
+	assert.Equal(t, &AssumeRoleConfigs{RoleArn: "arn:aws:iam::210987654321:role/ecr-push", ExternalId: "ext-123", SessionName: "pipeline"}, role)
+
+	role, err = getRoleProps(map[string]interface{}{}, SRC_ROLE_ARN, SRC_EXTERNAL_ID, SRC_SESSION_NAME)
+	assert.NoError(t, err)
+	assert.Nil(t, role)
+
+	_, err = getRoleProps(map[string]interface{}{SRC_ROLE_ARN: "ecr-pull"}, SRC_ROLE_ARN, SRC_EXTERNAL_ID, SRC_SESSION_NAME)
+	assert.ErrorContains(t, err, "SrcRoleArn: invalid role ARN")
+}
+
+func TestCopyResultDigestsMatch(t *testing.T) {
+	assert.False(t, (&CopyResult{DestDigest: "sha256:aaa"}).DigestsMatch())
+	assert.False(t, (&CopyResult{SrcDigest: "sha256:aaa", DestDigest: "sha256:bbb"}).DigestsMatch())
+	assert.True(t, (&CopyResult{SrcDigest: "sha256:aaa", DestDigest: "sha256:aaa"}).DigestsMatch())
+}
+
+func TestSourceImageInfoVerifyDigest(t *testing.T) {
+	single := &sourceImageInfo{Digest: "sha256:aaa"}
+	assert.NoError(t, single.VerifyDigest("sha256:aaa"))
+	err := single.VerifyDigest("sha256:bbb")
+	assert.Error(t, err)
+	assert.Equal(t, "source digest mismatch: expected sha256:bbb, got sha256:aaa", err.Error())
+
+	instance := &sourceImageInfo{Digest: "sha256:aaa", IndexDigest: "sha256:ccc"}
+	assert.NoError(t, instance.VerifyDigest("sha256:aaa"))
+	assert.NoError(t, instance.VerifyDigest("sha256:ccc"))
+	err = instance.VerifyDigest("sha256:bbb")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "image index sha256:ccc")
+}
+
+func TestSourceImageInfoVerifyIndexDigest(t *testing.T) {
+	instance := &sourceImageInfo{Digest: "sha256:aaa", IndexDigest: "sha256:ccc"}
+	assert.NoError(t, instance.VerifyIndexDigest("sha256:ccc"))
+	// Another arch of the index has another instance digest, so it can't be expected.
+	assert.EqualError(t, instance.VerifyIndexDigest("sha256:aaa"), "source digest mismatch: expected image index sha256:aaa, got sha256:ccc")
+	single := &sourceImageInfo{Digest: "sha256:aaa"}
+	assert.EqualError(t, single.VerifyIndexDigest("sha256:aaa"), "source digest mismatch: expected image index sha256:aaa, got single image sha256:aaa")
+}
+
+func TestPinSourceReference(t *testing.T) {
+	const (
+		instanceDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		indexDigest    = "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	)
+
+	srcRef, err := alltransports.ParseImageName("docker://public.ecr.aws/nginx/nginx:latest")
+	require.NoError(t, err)
+	pinned, err := pinSourceReference(srcRef, &sourceImageInfo{Digest: instanceDigest})
+	require.NoError(t, err)
+	assert.Equal(t, "//public.ecr.aws/nginx/nginx@"+instanceDigest, pinned.StringWithinTransport())
+
+	pinned, err = pinSourceReference(srcRef, &sourceImageInfo{Digest: instanceDigest, IndexDigest: indexDigest})
+	require.NoError(t, err)
+	assert.Equal(t, "//public.ecr.aws/nginx/nginx@"+indexDigest, pinned.StringWithinTransport())
+
+	srcRef, err = alltransports.ParseImageName("s3://cdk-ecr-deployment/nginx.tar:nginx:latest")
+	require.NoError(t, err)
+	pinned, err = pinSourceReference(srcRef, &sourceImageInfo{Digest: instanceDigest})
+	require.NoError(t, err)
+	assert.Equal(t, &digestPinnedReference{ImageReference: srcRef, digest: instanceDigest}, pinned)
+	assert.Equal(t, srcRef.StringWithinTransport(), pinned.StringWithinTransport())
+}
+
+func TestDigestPinnedReference(t *testing.T) {
+	captureLogs(t)
+	srcRef, err := alltransports.ParseImageName(emptyImageArchive)
+	require.NoError(t, err)
+	info, err := inspectSource(context.Background(), srcRef, &types.SystemContext{}, false)
+	require.NoError(t, err)
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+
+	result, err := copyImage(context.Background(), emptyImageArchive, "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{
+		Compression:          &CompressionConfigs{},
+		ExpectedSourceDigest: info.Digest,
+		Retry:                retryConfigs,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, info.Digest, result.SrcDigest)
+
+	// An archive replaced after it was verified is not copied.
+	policyContext, err := newPolicyContext(nil)
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("dir:" + t.TempDir())
+	require.NoError(t, err)
+	pinned := &digestPinnedReference{ImageReference: srcRef, digest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}
+	_, err = copyWithRetry(context.Background(), logger, policyContext, destRef, pinned, &copy.Options{}, retryConfigs, nil, nil, nil, nil)
+	assert.ErrorContains(t, err, "source changed after it was verified: expected manifest sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef, got "+info.Digest.String())
+
+	// Per-arch copies only accept the digest of an image index.
+	_, err = copyImage(context.Background(), emptyImageArchive, "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{
+		Compression:          &CompressionConfigs{},
+		ExpectedSourceDigest: info.Digest,
+		ExpectsIndexDigest:   true,
+		Retry:                retryConfigs,
+	})
+	assert.ErrorContains(t, err, "expected image index")
+}
+
+func TestGetSecretConfigsProps(t *testing.T) {
+	props := map[string]interface{}{SRC_SECRET_CONFIGS: `{"versionStage": "AWSPREVIOUS"}`}
+	configs, err := getSecretConfigsProps(props, SRC_SECRET_CONFIGS, "arn:aws:secretsmanager:us-west-2:123456789012:secret:creds")
+	require.NoError(t, err)
+	assert.Equal(t, "AWSPREVIOUS", *configs.VersionStage)
+
+	configs, err = getSecretConfigsProps(map[string]interface{}{}, DEST_SECRET_CONFIGS, "creds")
+	assert.NoError(t, err)
+	assert.Nil(t, configs)
+
+	_, err = getSecretConfigsProps(props, SRC_SECRET_CONFIGS, "user:pass")
+	assert.ErrorContains(t, err, "SrcSecretConfigs requires the credentials to be a secret")
+	_, err = getSecretConfigsProps(props, SRC_SECRET_CONFIGS, "ssm:/registry/creds")
+	assert.ErrorContains(t, err, "not supported for SSM parameters")
+
+	configs, err = getSecretConfigsProps(map[string]interface{}{DEST_SECRET_CONFIGS: `{"usernameKey": "login"}`}, DEST_SECRET_CONFIGS, "ssm:/registry/creds")
+	require.NoError(t, err)
+	assert.Equal(t, "login", *configs.UsernameKey)
+	_, err = getSecretConfigsProps(props, SRC_SECRET_CONFIGS, "")
+	assert.ErrorContains(t, err, "SrcSecretConfigs requires the credentials to be a secret")
+}
+
+func TestParseCreds(t *testing.T) {
+	tests := []struct {
+		name  string
+		creds string
+		want  RegistryAuthenticator
+	}{
+		{"empty", "", nil},
+		{"text", "user:pass", NewStaticAuthenticator("user:pass")},
+		{"secret name", "registry-creds", &SecretAuthenticator{}},
+		{"secret ARN", "arn:aws:secretsmanager:us-west-2:123456789012:secret:creds", &SecretAuthenticator{}},
+		{"SSM parameter", "ssm:/registry/creds", &SecretAuthenticator{}},
+		{"SSM parameter ARN", "arn:aws:ssm:us-west-2:123456789012:parameter/registry/creds", &SecretAuthenticator{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := parseCreds(tt.creds, nil)
+			require.NoError(t, err)
+			if sa, ok := creds.(*SecretAuthenticator); ok {
+				assert.IsType(t, tt.want, creds)
+				assert.Equal(t, tt.creds, sa.secretId)
+				return
+			}
+			assert.Equal(t, tt.want, creds)
+		})
+	}
+}
+
+func TestCopyWithRetryWaits(t *testing.T) {
+	buf := captureLogs(t)
+	requests := 0
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer registry.Close()
+	srcRef, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(registry.URL, "https://") + "/repo:latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("dir:" + t.TempDir())
+	require.NoError(t, err)
+	policyContext, err := newPolicyContext(nil)
+	require.NoError(t, err)
+	copyOpts := &copy.Options{SourceCtx: &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}}
+	retryConfigs, err := GetRetryConfigs(`{"numAttempts": 2, "baseDelay": 0.01, "maxDelay": 0.01}`)
+	require.NoError(t, err)
+
+	_, err = copyWithRetry(context.Background(), logger, policyContext, destRef, srcRef, copyOpts, retryConfigs, nil, nil, nil, nil)
+	assert.ErrorContains(t, err, "502 Bad Gateway")
+	assert.Equal(t, 2, requests)
+	entries := logEntries(t, buf)
+	require.NotEmpty(t, entries)
+	assert.Equal(t, string(ERROR_SERVER_ERROR), entries[0]["errorCategory"])
+	assert.Equal(t, "10ms", entries[0]["wait"])
+
+	// No retry is attempted without time left before the deadline.
+	requests = 0
+	ctx, cancel := context.WithTimeout(context.Background(), RETRY_DEADLINE_MARGIN-time.Second)
+	defer cancel()
+	_, err = copyWithRetry(ctx, logger, policyContext, destRef, srcRef, copyOpts, retryConfigs, nil, nil, nil, nil)
+	assert.ErrorContains(t, err, "copy image failed with no time left to retry")
+	assert.Equal(t, 1, requests)
+}
+
+func TestCopyWithRetryRegistryRetryAfter(t *testing.T) {
+	captureLogs(t)
+	var requests []time.Time
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer registry.Close()
+	srcRef, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(registry.URL, "https://") + "/repo:latest")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("dir:" + t.TempDir())
+	require.NoError(t, err)
+	policyContext, err := newPolicyContext(nil)
+	require.NoError(t, err)
+	copyOpts := &copy.Options{SourceCtx: &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}}
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+
+	// The docker transport waits for the Retry-After of a registry 429 before sending the request again.
+	_, err = copyWithRetry(context.Background(), logger, policyContext, destRef, srcRef, copyOpts, retryConfigs, nil, nil, nil, nil)
+	assert.ErrorContains(t, err, "502 Bad Gateway")
+	require.Len(t, requests, 2)
+	assert.GreaterOrEqual(t, requests[1].Sub(requests[0]), time.Second)
+}
+
+func TestCopyWithRetryInspectsSource(t *testing.T) {
+	captureLogs(t)
+	srcRef, err := alltransports.ParseImageName(emptyImageArchive)
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("dir:" + t.TempDir())
+	require.NoError(t, err)
+	policyContext, err := newPolicyContext(nil)
+	require.NoError(t, err)
+	retryConfigs, err := GetRetryConfigs(`{"numAttempts": 3, "baseDelay": 0.01, "maxDelay": 0.01}`)
+	require.NoError(t, err)
+
+	// Transient inspection errors are retried, and the source is inspected once it succeeds.
+	inspections := 0
+	inspect := func(ctx context.Context) (types.ImageReference, error) {
+		inspections++
+		if inspections == 1 {
+			return nil, docker.UnexpectedHTTPStatusError{StatusCode: http.StatusBadGateway}
+		}
+		return srcRef, nil
+	}
+	_, err = copyWithRetry(context.Background(), logger, policyContext, destRef, nil, &copy.Options{}, retryConfigs, nil, nil, nil, inspect)
+	require.NoError(t, err)
+	assert.Equal(t, 2, inspections)
+
+	// Failed checks are returned as they are, without copying.
+	mismatch := errors.New("source digest mismatch: expected sha256:bbb, got sha256:aaa")
+	_, err = copyWithRetry(context.Background(), logger, policyContext, destRef, srcRef, &copy.Options{}, retryConfigs, nil, nil, nil, func(ctx context.Context) (types.ImageReference, error) {
+		return nil, mismatch
+	})
+	assert.Equal(t, mismatch, err)
+}
+
+func TestCopyConfigsInspectsSource(t *testing.T) {
+	assert.False(t, (&CopyConfigs{}).InspectsSource())
+	assert.True(t, (&CopyConfigs{ManifestType: "application/vnd.oci.image.manifest.v1+json"}).InspectsSource())
+	assert.True(t, (&CopyConfigs{PreserveDigests: true}).InspectsSource())
+	assert.True(t, (&CopyConfigs{ExpectedSourceDigest: "sha256:aaa"}).InspectsSource())
+	assert.True(t, (&CopyConfigs{CopyReferrers: true}).InspectsSource())
+}
+
+// pushedManifests are the manifests pushed to a registry of newPushRegistry.
+type pushedManifests struct {
+	order      []string          // Tags and digests the manifests were pushed to, in order
+	manifests  map[string][]byte // Manifests by tag or digest
+	mediaTypes map[string]string // Media types of the manifests by tag or digest
+}
+
+// newPushRegistry returns a registry accepting pushes to any repository, which fails the first
+// failManifests manifest uploads. It counts the blob uploads completed, by digest, and records
+// the manifests pushed, which it serves back with the blobs.
+func newPushRegistry(t *testing.T, failManifests int) (*httptest.Server, map[string]int, *pushedManifests) {
+	pushed := &pushedManifests{manifests: map[string][]byte{}, mediaTypes: map[string]string{}}
+	var mu sync.Mutex
+	blobs := map[string][]byte{}
+	uploads := map[string][]byte{}
+	completed := map[string]int{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := r.URL.Path
+		switch {
+		case path == "/v2/":
+		case r.Method == http.MethodHead && strings.Contains(path, "/blobs/"):
+			blob, ok := blobs[path[strings.LastIndex(path, "/")+1:]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		case r.Method == http.MethodGet && strings.Contains(path, "/blobs/"):
+			blob, ok := blobs[path[strings.LastIndex(path, "/")+1:]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(blob)
+		case r.Method == http.MethodGet && strings.Contains(path, "/manifests/"):
+			m, ok := pushed.manifests[path[strings.LastIndex(path, "/")+1:]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", pushed.mediaTypes[path[strings.LastIndex(path, "/")+1:]])
+			_, _ = w.Write(m)
+		case r.Method == http.MethodPost && strings.HasSuffix(path, "/blobs/uploads/"):
+			location := path + strconv.Itoa(len(uploads))
+			uploads[location] = nil
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPatch && strings.Contains(path, "/blobs/uploads/"):
+			body, _ := io.ReadAll(r.Body)
+			uploads[path] = append(uploads[path], body...)
+			w.Header().Set("Location", path)
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method == http.MethodPut && strings.Contains(path, "/blobs/uploads/"):
+			d := r.URL.Query().Get("digest")
+			blobs[d] = uploads[path]
+			completed[d]++
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut && strings.Contains(path, "/manifests/"):
+			if failManifests > 0 {
+				failManifests--
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			name := path[strings.LastIndex(path, "/")+1:]
+			pushed.order = append(pushed.order, name)
+			pushed.manifests[name], _ = io.ReadAll(r.Body)
+			pushed.mediaTypes[name] = r.Header.Get("Content-Type")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, completed, pushed
+}
+
+func TestCopyWithRetryResumesArchiveLayers(t *testing.T) {
+	captureLogs(t)
+	srcRef, err := alltransports.ParseImageName(emptyImageArchive)
+	require.NoError(t, err)
+	policyContext, err := newPolicyContext(nil)
+	require.NoError(t, err)
+	retryConfigs, err := GetRetryConfigs(`{"numAttempts": 2, "baseDelay": 0.01, "maxDelay": 0.01}`)
+	require.NoError(t, err)
+
+	for _, precompute := range []bool{false, true} {
+		registry, completed, _ := newPushRegistry(t, 1)
+		destRef, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(registry.URL, "https://") + "/repo:latest")
+		require.NoError(t, err)
+		copyOpts := &copy.Options{DestinationCtx: &types.SystemContext{
+			DockerInsecureSkipTLSVerify:         types.OptionalBoolTrue,
+			DockerRegistryPushPrecomputeDigests: precompute,
+			BigFilesTemporaryDir:                t.TempDir(),
+		}}
+		_, err = copyWithRetry(context.Background(), logger, policyContext, destRef, srcRef, copyOpts, retryConfigs, nil, nil, nil, nil)
+		require.NoError(t, err)
+
+		// The config digest is known up front, so it is never pushed twice. The layer is only
+		// found at the destination by the retry if its compressed digest is computed first.
+		require.Len(t, completed, 2)
+		uploads := 0
+		for _, n := range completed {
+			uploads += n
+		}
+		if precompute {
+			assert.Equal(t, 2, uploads)
+		} else {
+			assert.Equal(t, 3, uploads)
+		}
+	}
+}
+
+func TestLayersFitTemporaryDir(t *testing.T) {
+	srcRef, err := alltransports.ParseImageName(emptyImageArchive)
+	require.NoError(t, err)
+	fits, err := layersFitTemporaryDir(context.Background(), srcRef, t.TempDir())
+	require.NoError(t, err)
+	assert.True(t, fits)
+
+	srcRef, err = alltransports.ParseImageName("docker-archive:testdata/missing.tar:nginx:latest")
+	require.NoError(t, err)
+	_, err = layersFitTemporaryDir(context.Background(), srcRef, t.TempDir())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPrecomputesLayerDigests(t *testing.T) {
+	tests := []struct {
+		image string
+		want  bool
+	}{
+		{emptyImageArchive, true},
+		{"s3://bucket/image.tar", true},
+		{"docker://public.ecr.aws/nginx/nginx:latest", false},
+		{"dir:/tmp/image", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := alltransports.ParseImageName(tt.image)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, precomputesLayerDigests(ref))
+		})
+	}
+}
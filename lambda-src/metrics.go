@@ -0,0 +1,169 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"cdk-ecr-deployment-handler/internal/tarfile"
+
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+// METRICS_NAMESPACE is the CloudWatch namespace of the copy metrics.
+const METRICS_NAMESPACE = "CdkEcrDeployment"
+
+// Dimensions of the copy metrics.
+const (
+	METRIC_DIM_SRC_REGISTRY    = "SrcRegistry"
+	METRIC_DIM_DEST_REPOSITORY = "DestRepository"
+	METRIC_DIM_REQUEST_TYPE    = "RequestType"
+)
+
+// Outcomes of a deployment, in the Outcome property of the metrics record.
+const (
+	OUTCOME_SUCCESS = "success"
+	OUTCOME_FAILURE = "failure"
+)
+
+// metricsWriter receives the metrics records. Lambda turns the EMF lines of stdout into
+// CloudWatch metrics, without any API call from the handler.
+var metricsWriter io.Writer = os.Stdout
+
+// CopyMetrics collects the figures of the copies of a deployment, emitted as one record in
+// CloudWatch Embedded Metric Format once the deployment is done.
+type CopyMetrics struct {
+	SrcRegistry    string
+	DestRepository string
+	RequestType    string
+
+	start      time.Time
+	blockCache tarfile.CacheStats // Block cache reads of the process when the deployment started
+
+	mu               sync.Mutex
+	bytesTransferred int64
+	layersSkipped    int64
+	retries          int64
+}
+
+// NewCopyMetrics starts collecting the metrics of the copy of srcImage to destImage.
+func NewCopyMetrics(srcImage string, destImage string, requestType string) *CopyMetrics {
+	return &CopyMetrics{
+		SrcRegistry:    metricsRegistry(srcImage),
+		DestRepository: metricsRepository(destImage),
+		RequestType:    requestType,
+		start:          time.Now(),
+		blockCache:     tarfile.BlockCacheStats(),
+	}
+}
+
+// metricsRegistry returns the registry host of a docker image URI, or its transport name.
+func metricsRegistry(uri string) string {
+	if host := registryHost(uri); host != "" {
+		return host
+	}
+	return transportName(uri)
+}
+
+// metricsRepository returns the repository of a docker image URI, without registry host or
+// tag, or its transport name.
+func metricsRepository(uri string) string {
+	ref, err := alltransports.ParseImageName(uri)
+	if err != nil || ref.DockerReference() == nil {
+		return transportName(uri)
+	}
+	return reference.Path(ref.DockerReference())
+}
+
+func transportName(uri string) string {
+	ref, err := alltransports.ParseImageName(uri)
+	if err != nil {
+		return "unknown"
+	}
+	return ref.Transport().Name()
+}
+
+// AddRetry counts a retried copy. It does nothing on nil metrics.
+func (m *CopyMetrics) AddRetry() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+// addProgress counts the blobs transferred and skipped in the progress events of copy.Image.
+func (m *CopyMetrics) addProgress(p types.ProgressProperties) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch p.Event {
+	case types.ProgressEventDone:
+		m.bytesTransferred += int64(p.Offset)
+	case types.ProgressEventSkipped:
+		m.layersSkipped++
+	}
+}
+
+// emfMetric declares a metric of an EMF record.
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// Emit writes the metrics record of the deployment to w, as a single EMF line.
+func (m *CopyMetrics) Emit(w io.Writer, success bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	blockCache := tarfile.BlockCacheStats().Sub(m.blockCache)
+	outcome, successCount := OUTCOME_FAILURE, 0
+	if success {
+		outcome, successCount = OUTCOME_SUCCESS, 1
+	}
+	record := map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": now.UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  METRICS_NAMESPACE,
+				"Dimensions": [][]string{{METRIC_DIM_SRC_REGISTRY, METRIC_DIM_DEST_REPOSITORY, METRIC_DIM_REQUEST_TYPE}},
+				"Metrics": []emfMetric{
+					{"CopyDuration", "Milliseconds"},
+					{"BytesTransferred", "Bytes"},
+					{"LayersSkipped", "Count"},
+					{"Retries", "Count"},
+					{"BlockCacheHits", "Count"},
+					{"BlockCacheMisses", "Count"},
+					{"Success", "Count"},
+					{"Failure", "Count"},
+				},
+			}},
+		},
+		METRIC_DIM_SRC_REGISTRY:    m.SrcRegistry,
+		METRIC_DIM_DEST_REPOSITORY: m.DestRepository,
+		METRIC_DIM_REQUEST_TYPE:    m.RequestType,
+		"Outcome":                  outcome,
+		"CopyDuration":             now.Sub(m.start).Milliseconds(),
+		"BytesTransferred":         m.bytesTransferred,
+		"LayersSkipped":            m.layersSkipped,
+		"Retries":                  m.retries,
+		"BlockCacheHits":           blockCache.Hits,
+		"BlockCacheMisses":         blockCache.Misses,
+		"Success":                  successCount,
+		"Failure":                  1 - successCount,
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,172 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+// captureMetrics sends the metrics records to the returned buffer until the test ends.
+func captureMetrics(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := metricsWriter
+	metricsWriter = &buf
+	t.Cleanup(func() { metricsWriter = saved })
+	return &buf
+}
+
+// metricsRecords decodes the EMF records written to buf.
+func metricsRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	records := []map[string]interface{}{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		record := map[string]interface{}{}
+		require.NoError(t, dec.Decode(&record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestMetricsDimensions(t *testing.T) {
+	tests := []struct {
+		name           string
+		srcImage       string
+		destImage      string
+		wantRegistry   string
+		wantRepository string
+	}{
+		{"docker hub", "docker://nginx:latest", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/web/nginx:v1", "docker.io", "web/nginx"},
+		{"digest", "docker://ghcr.io/owner/repo@sha256:" + strings.Repeat("0", 64), "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/repo", "ghcr.io", "repo"},
+		{"S3 archive", "s3://bucket/nginx.tar", "docker://public.ecr.aws/alias/nginx:latest", "s3", "alias/nginx"},
+		{"other transports", emptyImageArchive, "dir:/tmp/image", "docker-archive", "dir"},
+		{"invalid", "registry/repo", "docker://Invalid", "unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewCopyMetrics(tt.srcImage, tt.destImage, "Create")
+			assert.Equal(t, tt.wantRegistry, m.SrcRegistry)
+			assert.Equal(t, tt.wantRepository, m.DestRepository)
+		})
+	}
+}
+
+func TestCopyMetricsEmit(t *testing.T) {
+	tests := []struct {
+		name        string
+		success     bool
+		wantOutcome string
+	}{
+		{"success", true, OUTCOME_SUCCESS},
+		{"failure", false, OUTCOME_FAILURE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewCopyMetrics("docker://nginx:latest", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/nginx:v1", "Update")
+			progress, stop := trackProgress(m.addProgress)
+			progress <- types.ProgressProperties{Event: types.ProgressEventNewArtifact}
+			progress <- types.ProgressProperties{Event: types.ProgressEventRead, Offset: 512, OffsetUpdate: 512}
+			progress <- types.ProgressProperties{Event: types.ProgressEventDone, Offset: 1024, OffsetUpdate: 512}
+			progress <- types.ProgressProperties{Event: types.ProgressEventDone, Offset: 100}
+			progress <- types.ProgressProperties{Event: types.ProgressEventSkipped}
+			stop()
+			m.AddRetry()
+			m.AddRetry()
+
+			var buf bytes.Buffer
+			require.NoError(t, m.Emit(&buf, tt.success))
+			assert.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("\n")))
+			records := metricsRecords(t, &buf)
+			require.Len(t, records, 1)
+			record := records[0]
+
+			aws := record["_aws"].(map[string]interface{})
+			assert.NotZero(t, aws["Timestamp"])
+			directives := aws["CloudWatchMetrics"].([]interface{})
+			require.Len(t, directives, 1)
+			directive := directives[0].(map[string]interface{})
+			assert.Equal(t, METRICS_NAMESPACE, directive["Namespace"])
+			assert.Equal(t, []interface{}{[]interface{}{"SrcRegistry", "DestRepository", "RequestType"}}, directive["Dimensions"])
+			// Every declared metric has a value in the record.
+			for _, metric := range directive["Metrics"].([]interface{}) {
+				assert.Contains(t, record, metric.(map[string]interface{})["Name"])
+			}
+
+			assert.Equal(t, "docker.io", record["SrcRegistry"])
+			assert.Equal(t, "nginx", record["DestRepository"])
+			assert.Equal(t, "Update", record["RequestType"])
+			assert.Equal(t, tt.wantOutcome, record["Outcome"])
+			assert.Equal(t, float64(1124), record["BytesTransferred"])
+			assert.Equal(t, float64(1), record["LayersSkipped"])
+			assert.Equal(t, float64(2), record["Retries"])
+			assert.Equal(t, float64(0), record["BlockCacheHits"])
+			assert.Equal(t, float64(0), record["BlockCacheMisses"])
+			assert.GreaterOrEqual(t, record["CopyDuration"], float64(0))
+			if tt.success {
+				assert.Equal(t, float64(1), record["Success"])
+				assert.Equal(t, float64(0), record["Failure"])
+			} else {
+				assert.Equal(t, float64(0), record["Success"])
+				assert.Equal(t, float64(1), record["Failure"])
+			}
+		})
+	}
+}
+
+func TestCopyImageMetrics(t *testing.T) {
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+	m := NewCopyMetrics(emptyImageArchive, "dir:"+t.TempDir(), "Create")
+	_, err = copyImage(context.Background(), emptyImageArchive, "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{Compression: &CompressionConfigs{}, Retry: retryConfigs, Metrics: m})
+	require.NoError(t, err)
+
+	// The config blob is the only blob of the image.
+	assert.Positive(t, m.bytesTransferred)
+	assert.Zero(t, m.layersSkipped)
+	assert.Zero(t, m.retries)
+}
+
+func TestHandlerEmitsMetrics(t *testing.T) {
+	captureLogs(t)
+	buf := captureMetrics(t)
+
+	event := cfn.Event{
+		RequestType: cfn.RequestCreate,
+		ResourceProperties: map[string]interface{}{
+			SRC_IMAGE:  emptyImageArchive,
+			DEST_IMAGE: "dir:" + t.TempDir(),
+		},
+	}
+	_, _, err := handler(context.Background(), event)
+	require.NoError(t, err)
+	event.ResourceProperties[SRC_IMAGE] = "dir:" + t.TempDir() + "/missing"
+	_, _, err = handler(context.Background(), event)
+	require.Error(t, err)
+
+	// Invalid properties fail before any copy, and are not measured.
+	event.ResourceProperties[RETRY_CONFIGS] = "{"
+	_, _, err = handler(context.Background(), event)
+	require.Error(t, err)
+	// Deletes copy nothing.
+	event.RequestType = cfn.RequestDelete
+	_, _, err = handler(context.Background(), event)
+	require.NoError(t, err)
+
+	records := metricsRecords(t, buf)
+	require.Len(t, records, 2)
+	assert.Equal(t, OUTCOME_SUCCESS, records[0]["Outcome"])
+	assert.Equal(t, "docker-archive", records[0]["SrcRegistry"])
+	assert.Equal(t, "Create", records[0]["RequestType"])
+	assert.Equal(t, OUTCOME_FAILURE, records[1]["Outcome"])
+	assert.Equal(t, "dir", records[1]["SrcRegistry"])
+}
@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	"go.podman.io/image/v5/signature"
+)
+
+// registriesDirConfig enables reading and writing sigstore signatures as OCI attachments
+// for every registry, which sigstoreSigned policy requirements depend on.
+const registriesDirConfig = `default-docker:
+  use-sigstore-attachments: true
+`
+
+var (
+	registriesDirOnce sync.Once
+	registriesDir     string
+	registriesDirErr  error
+)
+
+// GetSignaturePolicy loads the SignaturePolicy property into a signature.Policy.
+// The property is either an inline containers-policy.json document, an `s3://bucket/key`
+// URI or an SSM parameter (`ssm:<name>` or parameter ARN) holding the document.
+// An empty property returns a nil policy, meaning any image is accepted, signed or not.
+func GetSignaturePolicy(s string) (*signature.Policy, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var doc []byte
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(s), "{"):
+		doc = []byte(s)
+	case strings.HasPrefix(s, "s3://"):
+		b, err := GetS3Object(s, iolimits.MaxPolicyBodySize)
+		if err != nil {
+			return nil, err
+		}
+		doc = b
+	case IsSSMParameterRef(s):
+		v, err := GetSSMParameter(s)
+		if err != nil {
+			return nil, err
+		}
+		doc = []byte(v)
+	default:
+		return nil, fmt.Errorf("invalid signature policy: expected an inline JSON document, an s3:// URI or an SSM parameter")
+	}
+
+	policy, err := signature.NewPolicyFromBytes(doc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing signature policy: %v", err.Error())
+	}
+	return policy, nil
+}
+
+// GetRegistriesDir returns a registries.d directory that enables sigstore attachments,
+// creating it under the temporary directory on first use.
+func GetRegistriesDir() (string, error) {
+	registriesDirOnce.Do(func() {
+		dir := filepath.Join(os.TempDir(), "registries.d")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			registriesDirErr = err
+			return
+		}
+		registriesDirErr = os.WriteFile(filepath.Join(dir, "sigstore.yaml"), []byte(registriesDirConfig), 0o644)
+		registriesDir = dir
+	})
+	return registriesDir, registriesDirErr
+}
+
+// AsPolicyRequirementError returns the policy requirement a copy failed on, if any.
+func AsPolicyRequirementError(err error) (signature.PolicyRequirementError, bool) {
+	var pre signature.PolicyRequirementError
+	if errors.As(err, &pre) {
+		return pre, true
+	}
+	return "", false
+}
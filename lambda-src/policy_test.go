@@ -0,0 +1,96 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/signature"
+	"go.podman.io/image/v5/signature/sigstore"
+)
+
+const emptyImageArchive = "docker-archive:testdata/empty-image.tar"
+
+func TestGetSignaturePolicy(t *testing.T) {
+	policy, err := GetSignaturePolicy("")
+	assert.NoError(t, err)
+	assert.Nil(t, policy)
+
+	policy, err = GetSignaturePolicy(`{"default": [{"type": "insecureAcceptAnything"}]}`)
+	require.NoError(t, err)
+	assert.Len(t, policy.Default, 1)
+
+	keys, err := sigstore.GenerateKeyPair([]byte("passphrase"))
+	require.NoError(t, err)
+	policy, err = GetSignaturePolicy(fmt.Sprintf(`{
+		"default": [{"type": "reject"}],
+		"transports": {
+			"docker": {
+				"123456789012.dkr.ecr.us-west-2.amazonaws.com": [{"type": "sigstoreSigned", "keyData": "%s"}]
+			}
+		}
+	}`, base64.StdEncoding.EncodeToString(keys.PublicKey)))
+	require.NoError(t, err)
+	assert.Len(t, policy.Transports["docker"]["123456789012.dkr.ecr.us-west-2.amazonaws.com"], 1)
+
+	_, err = GetSignaturePolicy(`{"default": []}`)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error parsing signature policy")
+
+	_, err = GetSignaturePolicy(`{"default": [{"type": "signedBy", "keyType": "GPGKeys"}]}`)
+	assert.Error(t, err)
+
+	_, err = GetSignaturePolicy("policy.json")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid signature policy")
+}
+
+func TestGetRegistriesDir(t *testing.T) {
+	dir, err := GetRegistriesDir()
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "sigstore.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "use-sigstore-attachments: true")
+}
+
+func TestAsPolicyRequirementError(t *testing.T) {
+	pre, ok := AsPolicyRequirementError(fmt.Errorf("Source image rejected: %w", signature.PolicyRequirementError("Running image is rejected by policy.")))
+	assert.True(t, ok)
+	assert.Equal(t, "Running image is rejected by policy.", pre.Error())
+
+	_, ok = AsPolicyRequirementError(fmt.Errorf("toomanyrequests: Rate exceeded"))
+	assert.False(t, ok)
+}
+
+func TestCopyImageSignaturePolicy(t *testing.T) {
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+
+	rejectAll, err := GetSignaturePolicy(`{"default": [{"type": "reject"}]}`)
+	require.NoError(t, err)
+	_, err = copyImage(context.Background(), emptyImageArchive, "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{
+		Compression:     &CompressionConfigs{},
+		SignaturePolicy: rejectAll,
+		Retry:           retryConfigs,
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "source image rejected by signature policy")
+
+	acceptAll, err := GetSignaturePolicy(`{"default": [{"type": "insecureAcceptAnything"}]}`)
+	require.NoError(t, err)
+	result, err := copyImage(context.Background(), emptyImageArchive, "dir:"+t.TempDir(), nil, nil, "", false, &CopyConfigs{
+		Compression:     &CompressionConfigs{},
+		SignaturePolicy: acceptAll,
+		Retry:           retryConfigs,
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.DestDigest)
+}
@@ -0,0 +1,359 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	eventbridgetypes "github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"go.podman.io/image/v5/types"
+)
+
+// DEFAULT_PROGRESS_INTERVAL is the default interval between two progress reports of a blob.
+const DEFAULT_PROGRESS_INTERVAL = 10 * time.Second
+
+// Source and detail type of the progress events put on EventBridge.
+const (
+	PROGRESS_EVENT_SOURCE      = "cdk-ecr-deployment"
+	PROGRESS_EVENT_DETAIL_TYPE = "Image Copy Progress"
+)
+
+// Kinds of progress events, in the event field of ProgressEvent.
+const (
+	PROGRESS_NEW     = "new"
+	PROGRESS_READ    = "read"
+	PROGRESS_DONE    = "done"
+	PROGRESS_SKIPPED = "skipped"
+)
+
+// Progress reporting configuration: how often the copy of each blob is reported, and where to
+// besides the logs.
+type ProgressConfigs struct {
+	Interval    *float64 `json:"interval,omitempty"`    // The interval between two reports of a blob (in seconds), 10 by default
+	SNSTopicArn *string  `json:"snsTopicArn,omitempty"` // The ARN of an SNS topic to publish the reports to
+	EventBusArn *string  `json:"eventBusArn,omitempty"` // The ARN of an EventBridge bus to put the reports on
+}
+
+// GetProgressConfigs parses the ProgressConfigs property.
+func GetProgressConfigs(data string) (*ProgressConfigs, error) {
+	config := ProgressConfigs{
+		Interval: float64Ptr(DEFAULT_PROGRESS_INTERVAL.Seconds()),
+	}
+
+	if data != "" {
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("unable to parse progress configuration from data: %v with error: %v", data, err)
+		}
+	}
+	if err := config.ValidateFields(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ValidateFields checks the interval and the SNS topic ARN.
+func (pc *ProgressConfigs) ValidateFields() error {
+	if aws.ToFloat64(pc.Interval) <= 0.0 {
+		return fmt.Errorf("interval cannot be less than or equal to 0")
+	}
+	if pc.SNSTopicArn != nil {
+		a, err := arn.Parse(*pc.SNSTopicArn)
+		if err != nil || a.Service != "sns" {
+			return fmt.Errorf("snsTopicArn %v is not an SNS topic ARN", *pc.SNSTopicArn)
+		}
+	}
+	if pc.EventBusArn != nil && *pc.EventBusArn == "" {
+		return fmt.Errorf("eventBusArn cannot be empty")
+	}
+	return nil
+}
+
+// IntervalDuration returns the interval between two reports of a blob.
+func (pc *ProgressConfigs) IntervalDuration() time.Duration {
+	return time.Duration(aws.ToFloat64(pc.Interval) * float64(time.Second))
+}
+
+// NewSinks returns the sinks the reports are sent to besides the logs, with clients created
+// by clients in the region of their ARN, or the region of the Lambda.
+func (pc *ProgressConfigs) NewSinks(clients *AWSClients) ([]ProgressSink, error) {
+	sinks := []ProgressSink{}
+	if pc.SNSTopicArn != nil {
+		a, _ := arn.Parse(*pc.SNSTopicArn)
+		cfg, err := clients.LoadConfig(a.Region, nil)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, NewSNSProgressSink(clients.NewSNS(cfg), *pc.SNSTopicArn))
+	}
+	if pc.EventBusArn != nil {
+		region := ""
+		if a, err := arn.Parse(*pc.EventBusArn); err == nil {
+			region = a.Region
+		}
+		cfg, err := clients.LoadConfig(region, nil)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, NewEventBridgeProgressSink(clients.NewEventBridge(cfg), *pc.EventBusArn))
+	}
+	return sinks, nil
+}
+
+// ProgressEvent is a progress report of the copy of one blob.
+type ProgressEvent struct {
+	Src        string    `json:"src"`
+	Dest       string    `json:"dest"`
+	Digest     string    `json:"digest"`
+	Event      string    `json:"event"`
+	BytesDone  int64     `json:"bytesDone"`
+	BytesTotal int64     `json:"bytesTotal"`    // -1 if unknown
+	Throughput float64   `json:"throughput"`    // Bytes per second since the copy of the blob started
+	ETA        float64   `json:"eta,omitempty"` // Seconds until the copy of the blob is done, 0 if unknown
+	Time       time.Time `json:"time"`
+}
+
+// ProgressSink receives the progress reports of the copies.
+type ProgressSink interface {
+	Send(ctx context.Context, event ProgressEvent) error
+}
+
+// LogProgressSink logs the progress reports to entry, with the attempt number if it is set.
+type LogProgressSink struct {
+	entry   *logrus.Entry
+	attempt atomic.Int64
+}
+
+func NewLogProgressSink(entry *logrus.Entry) *LogProgressSink {
+	return &LogProgressSink{entry: entry}
+}
+
+// SetAttempt sets the attempt number of the next reports.
+func (s *LogProgressSink) SetAttempt(attempt int) {
+	s.attempt.Store(int64(attempt))
+}
+
+func (s *LogProgressSink) Send(ctx context.Context, event ProgressEvent) error {
+	entry := s.entry
+	if attempt := s.attempt.Load(); attempt > 0 {
+		entry = entry.WithField(LOG_ATTEMPT, attempt)
+	}
+	entry = entry.WithFields(logrus.Fields{
+		LOG_DIGEST:   event.Digest,
+		"event":      event.Event,
+		"bytesDone":  event.BytesDone,
+		"bytesTotal": event.BytesTotal,
+		"throughput": event.Throughput,
+	})
+	if event.ETA > 0 {
+		entry = entry.WithField("eta", event.ETA)
+	}
+	// The report of copy.Image already tells when a blob starts.
+	if event.Event == PROGRESS_NEW {
+		entry.Debug("Blob copy progress")
+		return nil
+	}
+	entry.Info("Blob copy progress")
+	return nil
+}
+
+// snsAPI is the subset of the SNS client used to publish progress reports.
+type snsAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// SNSProgressSink publishes the progress reports to an SNS topic, as JSON messages.
+type SNSProgressSink struct {
+	client   snsAPI
+	topicArn string
+}
+
+func NewSNSProgressSink(client snsAPI, topicArn string) *SNSProgressSink {
+	return &SNSProgressSink{client: client, topicArn: topicArn}
+}
+
+func (s *SNSProgressSink) Send(ctx context.Context, event ProgressEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicArn),
+		Message:  aws.String(string(b)),
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing progress to %v: %v", s.topicArn, err.Error())
+	}
+	return nil
+}
+
+// eventBridgeAPI is the subset of the EventBridge client used to put progress reports.
+type eventBridgeAPI interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+// EventBridgeProgressSink puts the progress reports on an EventBridge bus, as the detail of
+// PROGRESS_EVENT_DETAIL_TYPE events from PROGRESS_EVENT_SOURCE.
+type EventBridgeProgressSink struct {
+	client  eventBridgeAPI
+	busName string
+}
+
+func NewEventBridgeProgressSink(client eventBridgeAPI, busName string) *EventBridgeProgressSink {
+	return &EventBridgeProgressSink{client: client, busName: busName}
+}
+
+func (s *EventBridgeProgressSink) Send(ctx context.Context, event ProgressEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []eventbridgetypes.PutEventsRequestEntry{{
+			EventBusName: aws.String(s.busName),
+			Source:       aws.String(PROGRESS_EVENT_SOURCE),
+			DetailType:   aws.String(PROGRESS_EVENT_DETAIL_TYPE),
+			Detail:       aws.String(string(b)),
+			Time:         aws.Time(event.Time),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("error putting progress on %v: %v", s.busName, err.Error())
+	}
+	if resp.FailedEntryCount > 0 && len(resp.Entries) > 0 {
+		return fmt.Errorf("error putting progress on %v: %v", s.busName, aws.ToString(resp.Entries[0].ErrorMessage))
+	}
+	return nil
+}
+
+// MemoryProgressSink keeps the progress reports in memory, for tests.
+type MemoryProgressSink struct {
+	mu     sync.Mutex
+	events []ProgressEvent
+}
+
+func (s *MemoryProgressSink) Send(ctx context.Context, event ProgressEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// Events returns the reports received so far.
+func (s *MemoryProgressSink) Events() []ProgressEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ProgressEvent(nil), s.events...)
+}
+
+// ProgressReporter turns the progress events of copy.Image into reports sent to its sinks.
+// Sink errors are logged, and don't fail the copy.
+type ProgressReporter struct {
+	ctx   context.Context
+	entry *logrus.Entry
+	src   string
+	dest  string
+	log   *LogProgressSink
+	sinks []ProgressSink
+	now   func() time.Time
+
+	started map[digest.Digest]time.Time // When the copy of each blob started
+}
+
+// NewProgressReporter returns a reporter of the copy of src to dest, which logs to entry.
+func NewProgressReporter(ctx context.Context, entry *logrus.Entry, src string, dest string, sinks []ProgressSink) *ProgressReporter {
+	log := NewLogProgressSink(entry)
+	return &ProgressReporter{
+		ctx:     ctx,
+		entry:   entry,
+		src:     RedactURI(src),
+		dest:    RedactURI(dest),
+		log:     log,
+		sinks:   append([]ProgressSink{log}, sinks...),
+		now:     time.Now,
+		started: map[digest.Digest]time.Time{},
+	}
+}
+
+// SetAttempt sets the attempt number logged with the next reports. It does nothing on a nil
+// reporter.
+func (r *ProgressReporter) SetAttempt(attempt int) {
+	if r == nil {
+		return
+	}
+	r.log.SetAttempt(attempt)
+}
+
+// Report sends the report of p to the sinks.
+func (r *ProgressReporter) Report(p types.ProgressProperties) {
+	now := r.now()
+	event := ProgressEvent{
+		Src:        r.src,
+		Dest:       r.dest,
+		Digest:     p.Artifact.Digest.String(),
+		BytesDone:  int64(p.Offset),
+		BytesTotal: p.Artifact.Size,
+		Time:       now,
+	}
+	switch p.Event {
+	case types.ProgressEventNewArtifact:
+		event.Event = PROGRESS_NEW
+		r.started[p.Artifact.Digest] = now
+	case types.ProgressEventRead:
+		event.Event = PROGRESS_READ
+	case types.ProgressEventDone:
+		event.Event = PROGRESS_DONE
+	case types.ProgressEventSkipped:
+		event.Event = PROGRESS_SKIPPED
+		event.BytesDone = 0
+	default:
+		return
+	}
+	if start, ok := r.started[p.Artifact.Digest]; ok && now.After(start) {
+		event.Throughput = float64(event.BytesDone) / now.Sub(start).Seconds()
+		if event.Event == PROGRESS_READ && event.Throughput > 0 && event.BytesTotal > event.BytesDone {
+			event.ETA = float64(event.BytesTotal-event.BytesDone) / event.Throughput
+		}
+	}
+	if event.Event == PROGRESS_DONE || event.Event == PROGRESS_SKIPPED {
+		delete(r.started, p.Artifact.Digest)
+	}
+	for _, sink := range r.sinks {
+		if err := sink.Send(r.ctx, event); err != nil {
+			r.entry.Warnf("error reporting progress: %v", err)
+		}
+	}
+}
+
+// trackProgress returns a progress channel for copy.Options, whose events are passed to each
+// handler in turn, and the function to call once the copies using it are done.
+func trackProgress(handlers ...func(types.ProgressProperties)) (chan types.ProgressProperties, func()) {
+	progress := make(chan types.ProgressProperties)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for p := range progress {
+			for _, handle := range handlers {
+				handle(p)
+			}
+		}
+	}()
+	return progress, func() {
+		close(progress)
+		<-done
+	}
+}
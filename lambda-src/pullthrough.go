@@ -0,0 +1,141 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/types"
+)
+
+// ecrRepositoryPrefixRegexp matches the repository prefixes of ECR pull-through cache rules.
+var ecrRepositoryPrefixRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+
+// Pull-through cache configuration: the ECR pull-through cache rules the source images of
+// upstream registries are copied through, so that ECR serves and caches them.
+type PullThroughCacheConfigs struct {
+	// The ECR registry of the rules, such as `123456789012.dkr.ecr.us-west-2.amazonaws.com`, the
+	// destination registry by default
+	Registry *string `json:"registry,omitempty"`
+	// The repository prefix of the rule of each upstream registry, such as `{"docker.io": "docker-hub"}`
+	Rules map[string]string `json:"rules,omitempty"`
+	// Whether to copy from the upstream registry when the image can't be read from the cache, true by default
+	FallbackOnMiss *bool `json:"fallbackOnMiss,omitempty"`
+}
+
+// GetPullThroughCacheConfigs parses the PullThroughCacheConfigs property.
+func GetPullThroughCacheConfigs(data string) (*PullThroughCacheConfigs, error) {
+	config := PullThroughCacheConfigs{
+		FallbackOnMiss: aws.Bool(true),
+	}
+
+	if data != "" {
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("unable to parse pull-through cache configuration from data: %v with error: %v", data, err)
+		}
+	}
+	if err := config.ValidateFields(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ValidateFields checks the registry and the repository prefixes of the rules.
+func (pc *PullThroughCacheConfigs) ValidateFields() error {
+	if pc.Registry != nil {
+		if _, ok := ParseECRRegistry(*pc.Registry); !ok || strings.Contains(*pc.Registry, "/") {
+			return fmt.Errorf("registry %q is not a private ECR registry", *pc.Registry)
+		}
+	}
+	for upstream, prefix := range pc.Rules {
+		if upstream == "" || strings.Contains(upstream, "/") {
+			return fmt.Errorf("rules: upstream registry %q is not a registry hostname", upstream)
+		}
+		if !ecrRepositoryPrefixRegexp.MatchString(prefix) {
+			return fmt.Errorf("rules: %q is not a repository prefix", prefix)
+		}
+	}
+	return nil
+}
+
+// CacheImage returns the image URI of srcRef in the pull-through cache of its registry, or ""
+// if srcRef is not in a registry with a rule. destImage is the destination of the copy, whose
+// registry holds the rules unless another one is set.
+func (pc *PullThroughCacheConfigs) CacheImage(srcRef types.ImageReference, destImage string) (string, error) {
+	if srcRef.Transport().Name() != docker.Transport.Name() || srcRef.DockerReference() == nil {
+		return "", nil
+	}
+	named := srcRef.DockerReference()
+	prefix, ok := pc.Rules[reference.Domain(named)]
+	if !ok {
+		return "", nil
+	}
+	registry := aws.ToString(pc.Registry)
+	if registry == "" {
+		destRegistry, ok := ParseECRRegistry(destImage)
+		if !ok {
+			return "", fmt.Errorf("the pull-through cache registry must be set when the destination is not in ECR")
+		}
+		registry = destRegistry.Host
+	}
+	cached, err := PullThroughCacheReference(named, registry+"/"+prefix)
+	if err != nil {
+		return "", err
+	}
+	return "docker://" + cached.String(), nil
+}
+
+// ReadPullThroughCache reads the manifest of ref in a pull-through cache, which pulls the image
+// through from its upstream registry if it isn't cached yet. A HEAD request wouldn't.
+func ReadPullThroughCache(ctx context.Context, ref types.ImageReference, sys *types.SystemContext) error {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, _, err = src.GetManifest(ctx, nil)
+	return err
+}
+
+// ValidatePullThroughCachePrefix checks that prefix is `<ECR registry>/<repository prefix>`.
+func ValidatePullThroughCachePrefix(prefix string) error {
+	host, path, _ := strings.Cut(prefix, "/")
+	if _, ok := ParseECRRegistry(host); !ok {
+		return fmt.Errorf("%q is not in a private ECR registry", prefix)
+	}
+	if _, err := reference.ParseNormalizedNamed(prefix); err != nil || path == "" {
+		return fmt.Errorf("%q is not a repository prefix", prefix)
+	}
+	return nil
+}
+
+// PullThroughCacheReference returns the reference of named in the ECR pull-through cache at
+// prefix, keeping its tag and digest: `docker.io/library/nginx:1.27` is
+// `<prefix>/library/nginx:1.27`.
+func PullThroughCacheReference(named reference.Named, prefix string) (reference.Named, error) {
+	cached, err := reference.ParseNamed(prefix + "/" + reference.Path(named))
+	if err != nil {
+		return nil, err
+	}
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		if cached, err = reference.WithTag(cached, tagged.Tag()); err != nil {
+			return nil, err
+		}
+	}
+	if digested, ok := named.(reference.Canonical); ok {
+		if cached, err = reference.WithDigest(cached, digested.Digest()); err != nil {
+			return nil, err
+		}
+	}
+	return cached, nil
+}
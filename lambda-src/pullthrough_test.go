@@ -0,0 +1,139 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+func TestGetPullThroughCacheConfigs(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         string
+		wantFallback bool
+		wantErr      string
+	}{
+		{"default", "", true, ""},
+		{"rules", `{"rules": {"docker.io": "docker-hub", "ghcr.io": "github/cache"}}`, true, ""},
+		{"registry", `{"registry": "123456789012.dkr.ecr.us-west-2.amazonaws.com", "rules": {"docker.io": "docker-hub"}, "fallbackOnMiss": false}`, false, ""},
+		{"registry not in ECR", `{"registry": "mirror.gcr.io"}`, false, `registry "mirror.gcr.io" is not a private ECR registry`},
+		{"registry with repository", `{"registry": "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub"}`, false, "is not a private ECR registry"},
+		{"upstream with path", `{"rules": {"docker.io/library": "docker-hub"}}`, false, "is not a registry hostname"},
+		{"invalid prefix", `{"rules": {"docker.io": "Docker-Hub"}}`, false, `"Docker-Hub" is not a repository prefix`},
+		{"empty prefix", `{"rules": {"docker.io": ""}}`, false, "is not a repository prefix"},
+		{"unknown field", `{"prefixes": {"docker.io": "docker-hub"}}`, false, "unable to parse pull-through cache configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs, err := GetPullThroughCacheConfigs(tt.data)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFallback, aws.ToBool(configs.FallbackOnMiss))
+		})
+	}
+}
+
+func TestPullThroughCacheImage(t *testing.T) {
+	const destImage = "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/app:latest"
+	configs, err := GetPullThroughCacheConfigs(`{"rules": {"docker.io": "docker-hub", "ghcr.io": "github"}}`)
+	require.NoError(t, err)
+	withRegistry, err := GetPullThroughCacheConfigs(`{"registry": "210987654321.dkr.ecr.eu-west-1.amazonaws.com", "rules": {"docker.io": "docker-hub"}}`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		configs   *PullThroughCacheConfigs
+		srcImage  string
+		destImage string
+		want      string
+		wantErr   string
+	}{
+		{"official image", configs, "docker://nginx:1.27", destImage, "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub/library/nginx:1.27", ""},
+		{"github image", configs, "docker://ghcr.io/org/app", destImage, "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/github/org/app:latest", ""},
+		{"no rule", configs, "docker://quay.io/org/app:v1", destImage, "", ""},
+		{"not in a registry", configs, emptyImageArchive, destImage, "", ""},
+		{"set registry", withRegistry, "docker://nginx:1.27", "dir:/tmp/image", "docker://210987654321.dkr.ecr.eu-west-1.amazonaws.com/docker-hub/library/nginx:1.27", ""},
+		{"destination not in ECR", configs, "docker://nginx:1.27", "dir:/tmp/image", "", "the pull-through cache registry must be set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcRef, err := alltransports.ParseImageName(tt.srcImage)
+			require.NoError(t, err)
+			cacheImage, err := tt.configs.CacheImage(srcRef, tt.destImage)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cacheImage)
+		})
+	}
+}
+
+func TestPullThroughCacheSource(t *testing.T) {
+	captureLogs(t)
+	tests := []struct {
+		name       string
+		data       string
+		cacheImage string
+		wantUsed   []string
+		wantErr    string
+	}{
+		{"hit", "", emptyImageArchive, []string{emptyImageArchive}, ""},
+		{"miss", "", "dir:/nonexistent", []string{"dir:/nonexistent", "docker://nginx"}, ""},
+		{"miss without fallback", `{"fallbackOnMiss": false}`, "dir:/nonexistent", []string{"dir:/nonexistent"}, "error reading dir:/nonexistent from the pull-through cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs, err := GetPullThroughCacheConfigs(tt.data)
+			require.NoError(t, err)
+			used := []string{}
+			useSource := func(image string, fromCache bool) (types.ImageReference, *types.SystemContext, error) {
+				assert.Equal(t, image == tt.cacheImage, fromCache)
+				used = append(used, image)
+				ref, err := alltransports.ParseImageName(image)
+				return ref, &types.SystemContext{}, err
+			}
+			err = pullThroughCacheSource(context.Background(), "docker://nginx", tt.cacheImage, configs, useSource)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantUsed, used)
+		})
+	}
+}
+
+func TestPullThroughCacheReference(t *testing.T) {
+	prefix := "123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub"
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx:1.27", prefix + "/library/nginx:1.27"},
+		{"bitnami/redis", prefix + "/bitnami/redis"},
+		{"nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", prefix + "/library/nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			named, err := reference.ParseNormalizedNamed(tt.image)
+			require.NoError(t, err)
+			cached, err := PullThroughCacheReference(named, prefix)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cached.String())
+		})
+	}
+}
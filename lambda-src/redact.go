@@ -0,0 +1,136 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// REDACTED replaces secret values in logs.
+const REDACTED = "*****"
+
+var (
+	// userinfoRegexp matches the `user:pass@` part of URIs.
+	userinfoRegexp = regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://)[^/@\s"]+@`)
+	// queryTokenRegexp matches the values of query parameters carrying signatures or tokens.
+	queryTokenRegexp = regexp.MustCompile(`(?i)([?&](?:x-amz-signature|x-amz-security-token|x-amz-credential|access_token|token|sig|signature)=)[^&\s"]+`)
+)
+
+// sensitiveJSONKeys are the keys whose values are redacted in JSON properties, unless the
+// value references a secret instead of holding it.
+var sensitiveJSONKeys = map[string]bool{
+	"auth":              true,
+	"identitytoken":     true,
+	"password":          true,
+	"token":             true,
+	"clientSecret":      true,
+	"privateKey":        true,
+	"serviceAccountKey": true,
+}
+
+// RedactURI masks the userinfo and the signature or token query parameters of the URIs in s.
+func RedactURI(s string) string {
+	s = userinfoRegexp.ReplaceAllString(s, "${1}"+REDACTED+"@")
+	return queryTokenRegexp.ReplaceAllString(s, "${1}"+REDACTED)
+}
+
+// RedactCreds masks the password of `user:pass` credentials. Secret and parameter references
+// are kept, as they are not secret themselves.
+func RedactCreds(creds string) string {
+	if creds == "" || GetCredsType(creds) != SECRET_TEXT {
+		return creds
+	}
+	user, _, _ := strings.Cut(creds, ":")
+	return user + ":" + REDACTED
+}
+
+// RedactJSON masks the values of sensitiveJSONKeys in an inline JSON property. Properties
+// referencing a document elsewhere are kept, and invalid JSON is masked as a whole.
+func RedactJSON(s string) string {
+	if !strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return RedactURI(s)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return REDACTED
+	}
+	b, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return REDACTED
+	}
+	return string(b)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if s, ok := child.(string); ok && sensitiveJSONKeys[k] && !isSecretRef(s) {
+				v[k] = REDACTED
+			} else {
+				v[k] = redactValue(child)
+			}
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// isSecretRef checks whether s references a Secrets Manager secret or an SSM parameter by ARN
+// or `ssm:` prefix.
+func isSecretRef(s string) bool {
+	if IsSSMParameterRef(s) {
+		return true
+	}
+	a, err := arn.Parse(s)
+	return err == nil && a.Service == "secretsmanager"
+}
+
+// RedactProps returns a copy of resource properties safe to log.
+func RedactProps(props map[string]interface{}) map[string]interface{} {
+	if props == nil {
+		return nil
+	}
+	redacted := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		s, ok := v.(string)
+		if !ok {
+			redacted[k] = v
+			continue
+		}
+		switch k {
+		case SRC_CREDS, DEST_CREDS:
+			redacted[k] = RedactCreds(s)
+		case SRC_AUTH_CONFIG, DEST_AUTH_CONFIG, SRC_REGISTRY_AUTH, DEST_REGISTRY_AUTH:
+			redacted[k] = RedactJSON(s)
+		default:
+			redacted[k] = RedactURI(s)
+		}
+	}
+	return redacted
+}
+
+// RedactEvent returns a copy of event safe to log. The presigned response URL is cut at its
+// query, which holds the signature.
+func RedactEvent(event cfn.Event) cfn.Event {
+	event.ResourceProperties = RedactProps(event.ResourceProperties)
+	event.OldResourceProperties = RedactProps(event.OldResourceProperties)
+	if u, err := url.Parse(event.ResponseURL); err == nil && u.RawQuery != "" {
+		u.RawQuery = REDACTED
+		event.ResponseURL = u.String()
+	}
+	return event
+}
@@ -0,0 +1,397 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/pkg/tlsclientconfig"
+	"go.podman.io/image/v5/types"
+)
+
+// Suffixes of the tags cosign uses for signatures, attestations and SBOMs of sha256-<digest>.
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// errReferrersAPIUnsupported is returned when a registry doesn't serve the OCI 1.1 referrers API.
+var errReferrersAPIUnsupported = errors.New("registry does not support the referrers API")
+
+// registryTransport is the transport of the registry requests sent outside of containers/image,
+// such as the referrers API queries, before the TLS settings of their SystemContext apply.
+var registryTransport = http.DefaultTransport.(*http.Transport)
+
+// registryCertDirs are the directories of the per-host client certificates and CAs that
+// containers/image reads when the SystemContext sets none.
+var registryCertDirs = []string{"/etc/containers/certs.d", "/etc/docker/certs.d"}
+
+// Referrers lists what refers to a subject manifest in a repository.
+type Referrers struct {
+	Digests []digest.Digest // Manifests whose subject is the image, found via the referrers API or the fallback tag
+	Tags    []string        // The referrers fallback tag and cosign tags that exist for the image
+}
+
+// ReferrersTagPrefix returns the tag schema name of subject, `<algorithm>-<encoded>`.
+func ReferrersTagPrefix(subject digest.Digest) string {
+	return fmt.Sprintf("%s-%s", subject.Algorithm(), subject.Encoded())
+}
+
+// ReferrerTags returns the tags that may hold referrers of subject: the OCI referrers fallback
+// tag and the cosign signature, attestation and SBOM tags.
+func ReferrerTags(subject digest.Digest) []string {
+	prefix := ReferrersTagPrefix(subject)
+	tags := []string{prefix}
+	for _, suffix := range cosignTagSuffixes {
+		tags = append(tags, prefix+suffix)
+	}
+	return tags
+}
+
+// DiscoverReferrers finds the referrers of subject in the repository of ref. The referrers
+// API is queried first; registries without it are covered by the referrers fallback tag.
+// The referrer tags are looked up one by one rather than by listing the repository tags.
+func DiscoverReferrers(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, subject digest.Digest) (*Referrers, error) {
+	named := reference.TrimNamed(ref.DockerReference())
+	referrers := &Referrers{}
+	var fallback []byte
+	var fallbackType string
+	for _, tag := range ReferrerTags(subject) {
+		b, mimeType, err := getTaggedManifest(ctx, sys, named, tag)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			continue
+		}
+		referrers.Tags = append(referrers.Tags, tag)
+		if tag == ReferrersTagPrefix(subject) {
+			fallback, fallbackType = b, mimeType
+		}
+	}
+
+	index, err := fetchReferrersIndex(ctx, sys, named, subject)
+	if errors.Is(err, errReferrersAPIUnsupported) {
+		index, err = nil, nil
+		if fallback != nil {
+			index, err = parseReferrersFallbackIndex(named, subject, fallback, fallbackType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		for _, m := range index.Manifests {
+			referrers.Digests = append(referrers.Digests, m.Digest)
+		}
+	}
+	return referrers, nil
+}
+
+// getTaggedManifest reads the manifest of named tagged tag through containers/image, with the
+// credentials and TLS settings of sys. It returns a nil manifest if the tag doesn't exist.
+func getTaggedManifest(ctx context.Context, sys *types.SystemContext, named reference.Named, tag string) ([]byte, string, error) {
+	tagged, err := reference.WithTag(named, tag)
+	if err != nil {
+		return nil, "", err
+	}
+	ref, err := docker.NewReference(tagged)
+	if err != nil {
+		return nil, "", err
+	}
+	// The docker transport reads the manifest when opening the source already.
+	src, err := ref.NewImageSource(ctx, sys)
+	if IsManifestUnknownError(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+	b, mimeType, err := src.GetManifest(ctx, nil)
+	if IsManifestUnknownError(err) {
+		return nil, "", nil
+	}
+	return b, mimeType, err
+}
+
+// parseReferrersFallbackIndex parses the index stored under the referrers fallback tag of subject.
+func parseReferrersFallbackIndex(named reference.Named, subject digest.Digest, b []byte, mimeType string) (*imgspecv1.Index, error) {
+	tagged := named.String() + ":" + ReferrersTagPrefix(subject)
+	if mimeType != imgspecv1.MediaTypeImageIndex {
+		return nil, fmt.Errorf("referrers fallback tag %s is a %s, not an image index", tagged, mimeType)
+	}
+	index := &imgspecv1.Index{}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, fmt.Errorf("error parsing referrers fallback index %s: %v", tagged, err.Error())
+	}
+	return index, nil
+}
+
+// fetchReferrersIndex queries GET /v2/<name>/referrers/<digest>, authenticating with the
+// credentials in sys. It returns errReferrersAPIUnsupported if the registry has no such endpoint.
+func fetchReferrersIndex(ctx context.Context, sys *types.SystemContext, named reference.Named, subject digest.Digest) (*imgspecv1.Index, error) {
+	endpoint := fmt.Sprintf("https://%s/v2/%s/referrers/%s", registryEndpointHost(named), reference.Path(named), subject)
+
+	resp, err := doRegistryRequest(ctx, sys, http.MethodGet, endpoint, imgspecv1.MediaTypeImageIndex, fmt.Sprintf("repository:%s:pull", reference.Path(named)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return nil, errReferrersAPIUnsupported
+	default:
+		return nil, fmt.Errorf("error querying referrers of %s@%s: %w", named, subject, NewRegistryResponseError(resp))
+	}
+	if mt := resp.Header.Get("Content-Type"); !strings.HasPrefix(mt, imgspecv1.MediaTypeImageIndex) {
+		// Some registries answer unknown /v2/ paths with something other than 404.
+		return nil, errReferrersAPIUnsupported
+	}
+	b, err := iolimits.ReadAtMost(resp.Body, iolimits.MaxManifestBodySize)
+	if err != nil {
+		return nil, err
+	}
+	index := &imgspecv1.Index{}
+	if err := json.Unmarshal(b, index); err != nil {
+		return nil, fmt.Errorf("error parsing referrers of %s@%s: %v", named, subject, err.Error())
+	}
+	return index, nil
+}
+
+// registryEndpointHost returns the host serving the registry API of named, which is not the
+// domain of the reference for Docker Hub.
+func registryEndpointHost(named reference.Named) string {
+	host := reference.Domain(named)
+	if host == DOCKER_HUB_DOMAIN {
+		return dockerHubRegistryHost
+	}
+	return host
+}
+
+// newRegistryHTTPClient returns the client of the requests to the registry at host, with the TLS
+// settings of sys as containers/image applies them: skipping verification, or the client
+// certificates and CAs of the certificate directory of the host.
+func newRegistryHTTPClient(sys *types.SystemContext, host string) (*http.Client, error) {
+	transport := registryTransport.Clone()
+	tlsConfig := &tls.Config{}
+	if transport.TLSClientConfig != nil {
+		tlsConfig = transport.TLSClientConfig.Clone()
+	}
+	transport.TLSClientConfig = tlsConfig
+	if sys == nil {
+		return &http.Client{Transport: transport}, nil
+	}
+	tlsConfig.InsecureSkipVerify = sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	certDirs := []string{}
+	switch {
+	case sys.DockerCertPath != "":
+		certDirs = append(certDirs, sys.DockerCertPath)
+	case sys.DockerPerHostCertDirPath != "":
+		certDirs = append(certDirs, filepath.Join(sys.DockerPerHostCertDirPath, host))
+	default:
+		for _, dir := range registryCertDirs {
+			certDirs = append(certDirs, filepath.Join(dir, host))
+		}
+	}
+	for _, dir := range certDirs {
+		if err := tlsclientconfig.SetupCertificates(dir, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// doRegistryRequest sends a request accepting the accept media types to a registry endpoint,
+// with the TLS settings of sys. The bearer token of sys is sent as it is; otherwise a Basic or
+// Bearer authentication challenge is answered with the credentials in sys.
+func doRegistryRequest(ctx context.Context, sys *types.SystemContext, method string, endpoint string, accept string, scope string) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", accept)
+		req.Header.Set("User-Agent", sys.DockerRegistryUserAgent)
+		if sys.DockerBearerRegistryToken != "" {
+			req.Header.Set("Authorization", "Bearer "+sys.DockerBearerRegistryToken)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	client, err := newRegistryHTTPClient(sys, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || sys.DockerBearerRegistryToken != "" {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	auth := sys.DockerAuthConfig
+	switch scheme {
+	case "basic":
+		if auth == nil || auth.Username == "" {
+			return nil, fmt.Errorf("registry %s requires credentials", req.URL.Host)
+		}
+		req.SetBasicAuth(auth.Username, auth.Password)
+	case "bearer":
+		token, err := fetchBearerToken(ctx, client, auth, params, scope)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return nil, fmt.Errorf("unsupported authentication challenge from %s: %q", req.URL.Host, resp.Header.Get("WWW-Authenticate"))
+	}
+	return client.Do(req)
+}
+
+// fetchBearerToken requests a token from the realm of a Bearer challenge.
+func fetchBearerToken(ctx context.Context, client *http.Client, auth *types.DockerAuthConfig, params map[string]string, scope string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid bearer realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth != nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching registry token from %s: %w", realm.Host, NewRegistryResponseError(resp))
+	}
+	b, err := iolimits.ReadAtMost(resp.Body, iolimits.MaxAuthTokenBodySize)
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &token); err != nil {
+		return "", fmt.Errorf("error parsing registry token: %v", err.Error())
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header into its lowercased scheme and parameters.
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	for _, part := range splitChallengeParams(rest) {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return strings.ToLower(scheme), params
+}
+
+// splitChallengeParams splits challenge parameters on commas outside of quoted values.
+func splitChallengeParams(s string) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// referrerRefs returns the source and destination references of every referrer, keeping
+// digests for referrer manifests and tag names for tags.
+func referrerRefs(srcRef types.ImageReference, destRef types.ImageReference, referrers *Referrers) ([][2]types.ImageReference, error) {
+	srcNamed := reference.TrimNamed(srcRef.DockerReference())
+	destNamed := reference.TrimNamed(destRef.DockerReference())
+	refs := [][2]types.ImageReference{}
+	add := func(src reference.Named, dest reference.Named) error {
+		s, err := docker.NewReference(src)
+		if err != nil {
+			return err
+		}
+		d, err := docker.NewReference(dest)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, [2]types.ImageReference{s, d})
+		return nil
+	}
+
+	for _, d := range referrers.Digests {
+		src, err := reference.WithDigest(srcNamed, d)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := reference.WithDigest(destNamed, d)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(src, dest); err != nil {
+			return nil, err
+		}
+	}
+	// Tags go last so that the fallback index is only written once the manifests it lists exist.
+	for _, tag := range referrers.Tags {
+		src, err := reference.WithTag(srcNamed, tag)
+		if err != nil {
+			return nil, err
+		}
+		dest, err := reference.WithTag(destNamed, tag)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(src, dest); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
@@ -0,0 +1,319 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+const subjectDigest = digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+func TestReferrerTags(t *testing.T) {
+	prefix := "sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	assert.Equal(t, prefix, ReferrersTagPrefix(subjectDigest))
+	assert.Equal(t, []string{prefix, prefix + ".sig", prefix + ".att", prefix + ".sbom"}, ReferrerTags(subjectDigest))
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	assert.Equal(t, "bearer", scheme)
+	assert.Equal(t, "https://auth.docker.io/token", params["realm"])
+	assert.Equal(t, "registry.docker.io", params["service"])
+	assert.Equal(t, "repository:library/nginx:pull,push", params["scope"])
+
+	scheme, params = parseAuthChallenge(`Basic realm="https://123456789012.dkr.ecr.us-west-2.amazonaws.com/",service="ecr.amazonaws.com"`)
+	assert.Equal(t, "basic", scheme)
+	assert.Equal(t, "ecr.amazonaws.com", params["service"])
+}
+
+// referrerManifest returns an OCI manifest of a single layer of the given media type, with its
+// config and layer blobs.
+func referrerManifest(t *testing.T, layerType string, content string) ([]byte, map[digest.Digest][]byte) {
+	layer := []byte(content)
+	config, err := json.Marshal(imgspecv1.Image{RootFS: imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}}})
+	require.NoError(t, err)
+	m, err := json.Marshal(imgspecv1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Config:    imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:    []imgspecv1.Descriptor{{MediaType: layerType, Digest: digest.FromBytes(layer), Size: int64(len(layer))}},
+		Subject:   &imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageManifest, Digest: subjectDigest, Size: 2},
+	})
+	require.NoError(t, err)
+	return m, map[digest.Digest][]byte{digest.FromBytes(config): config, digest.FromBytes(layer): layer}
+}
+
+// referrersRegistry is the content of repo/app served by newReferrersServer.
+type referrersRegistry struct {
+	server    *httptest.Server
+	sbom      digest.Digest     // Digest of the SBOM referrer, listed by the referrers API or the fallback tag
+	manifests map[string][]byte // Manifests by tag or digest
+}
+
+// newReferrersServer serves repo/app behind bearer auth, with an SBOM referrer of subjectDigest
+// and a cosign signature tag. The SBOM is listed by the referrers API if referrersAPI is set,
+// or else by the referrers fallback tag.
+func newReferrersServer(t *testing.T, referrersAPI bool) *referrersRegistry {
+	registry := &referrersRegistry{manifests: map[string][]byte{}}
+	blobs := map[digest.Digest][]byte{}
+	sbom, sbomBlobs := referrerManifest(t, "application/spdx+json", `{"spdxVersion":"SPDX-2.3"}`)
+	sig, sigBlobs := referrerManifest(t, sigstoreSignatureMIMEType, `{"critical":{}}`)
+	maps.Copy(blobs, sbomBlobs)
+	maps.Copy(blobs, sigBlobs)
+	registry.sbom = digest.FromBytes(sbom)
+	registry.manifests[registry.sbom.String()] = sbom
+	registry.manifests[SigstoreAttachmentTag(subjectDigest)] = sig
+	index, err := json.Marshal(imgspecv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imgspecv1.MediaTypeImageIndex,
+		Manifests: []imgspecv1.Descriptor{
+			{MediaType: imgspecv1.MediaTypeImageManifest, Digest: registry.sbom, Size: int64(len(sbom)), ArtifactType: "application/spdx+json"},
+		},
+	})
+	require.NoError(t, err)
+	if !referrersAPI {
+		registry.manifests[ReferrersTagPrefix(subjectDigest)] = index
+	}
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v2/repo/app/")
+		switch {
+		case r.URL.Path == "/token":
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "user" || pass != "pass" || r.URL.Query().Get("scope") != "repository:repo/app:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"token":"t0ken"}`))
+		case r.Header.Get("Authorization") != "Bearer t0ken":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/":
+		case path == "referrers/"+subjectDigest.String() && referrersAPI:
+			w.Header().Set("Content-Type", imgspecv1.MediaTypeImageIndex)
+			_, _ = w.Write(index)
+		case strings.HasPrefix(path, "manifests/"):
+			m, ok := registry.manifests[strings.TrimPrefix(path, "manifests/")]
+			if !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+				return
+			}
+			var mediaType struct {
+				MediaType string `json:"mediaType"`
+			}
+			_ = json.Unmarshal(m, &mediaType)
+			w.Header().Set("Content-Type", mediaType.MediaType)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(m).String())
+			_, _ = w.Write(m)
+		case strings.HasPrefix(path, "blobs/"):
+			b, ok := blobs[digest.Digest(strings.TrimPrefix(path, "blobs/"))]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(b)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	registryTransport = server.Client().Transport.(*http.Transport)
+	t.Cleanup(func() { registryTransport = http.DefaultTransport.(*http.Transport) })
+	registry.server = server
+	return registry
+}
+
+func TestFetchReferrersIndex(t *testing.T) {
+	registry := newReferrersServer(t, true)
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(registry.server.URL, "https://") + "/repo/app")
+	require.NoError(t, err)
+
+	sys := &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", Password: "pass"}}
+	index, err := fetchReferrersIndex(context.Background(), sys, named, subjectDigest)
+	require.NoError(t, err)
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, "application/spdx+json", index.Manifests[0].ArtifactType)
+
+	// A bearer token is sent as it is, without answering the challenge.
+	sys = &types.SystemContext{DockerBearerRegistryToken: "t0ken"}
+	index, err = fetchReferrersIndex(context.Background(), sys, named, subjectDigest)
+	require.NoError(t, err)
+	require.Len(t, index.Manifests, 1)
+
+	sys = &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", Password: "wrong"}}
+	_, err = fetchReferrersIndex(context.Background(), sys, named, subjectDigest)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error fetching registry token")
+}
+
+func TestFetchReferrersIndexRetryAfter(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	registryTransport = server.Client().Transport.(*http.Transport)
+	t.Cleanup(func() { registryTransport = http.DefaultTransport.(*http.Transport) })
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(server.URL, "https://") + "/repo/app")
+	require.NoError(t, err)
+
+	_, err = fetchReferrersIndex(context.Background(), &types.SystemContext{}, named, subjectDigest)
+	assert.ErrorContains(t, err, "429 Too Many Requests")
+	assert.Equal(t, ERROR_RATE_LIMIT, ClassifyError(err))
+	delay, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, delay)
+}
+
+func TestNewRegistryHTTPClient(t *testing.T) {
+	client, err := newRegistryHTTPClient(&types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}, "registry.example.com")
+	require.NoError(t, err)
+	assert.True(t, client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+
+	client, err = newRegistryHTTPClient(&types.SystemContext{DockerPerHostCertDirPath: t.TempDir()}, "registry.example.com")
+	require.NoError(t, err)
+	assert.False(t, client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+
+	// Client certificates need their key.
+	certDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(certDir, "client.cert"), nil, 0o600))
+	_, err = newRegistryHTTPClient(&types.SystemContext{DockerCertPath: certDir}, "registry.example.com")
+	assert.ErrorContains(t, err, "missing key client.key for client certificate client.cert")
+}
+
+func TestFetchReferrersIndexUnsupported(t *testing.T) {
+	registry := newReferrersServer(t, false)
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(registry.server.URL, "https://") + "/repo/app")
+	require.NoError(t, err)
+
+	sys := &types.SystemContext{DockerAuthConfig: &types.DockerAuthConfig{Username: "user", Password: "pass"}}
+	_, err = fetchReferrersIndex(context.Background(), sys, named, subjectDigest)
+	assert.ErrorIs(t, err, errReferrersAPIUnsupported)
+}
+
+func TestDiscoverReferrers(t *testing.T) {
+	sys := &types.SystemContext{
+		DockerAuthConfig:            &types.DockerAuthConfig{Username: "user", Password: "pass"},
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	}
+	for _, referrersAPI := range []bool{true, false} {
+		registry := newReferrersServer(t, referrersAPI)
+		ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(registry.server.URL, "https://") + "/repo/app:v1")
+		require.NoError(t, err)
+
+		referrers, err := DiscoverReferrers(context.Background(), sys, ref, subjectDigest)
+		require.NoError(t, err)
+		assert.Equal(t, []digest.Digest{registry.sbom}, referrers.Digests)
+		if referrersAPI {
+			assert.Equal(t, []string{SigstoreAttachmentTag(subjectDigest)}, referrers.Tags)
+		} else {
+			// Registries without the referrers API list the referrers under the fallback tag.
+			assert.Equal(t, []string{ReferrersTagPrefix(subjectDigest), SigstoreAttachmentTag(subjectDigest)}, referrers.Tags)
+		}
+	}
+}
+
+func TestCopyImageReferrersRetriesDiscovery(t *testing.T) {
+	captureLogs(t)
+	var queries []time.Time
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+		case strings.Contains(r.URL.Path, "/referrers/"):
+			queries = append(queries, time.Now())
+			if len(queries) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": [{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown"}]}`))
+		}
+	}))
+	defer server.Close()
+	ref, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(server.URL, "https://") + "/repo/app:v1")
+	require.NoError(t, err)
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	retryConfigs, err := GetRetryConfigs(`{"numAttempts": 2, "baseDelay": 0.01, "maxDelay": 2}`)
+	require.NoError(t, err)
+
+	// The discovery is retried after the Retry-After of the throttled referrers query.
+	copied, err := copyImageReferrers(context.Background(), logger, ref, ref, sys, sys, &CopyResult{SrcDigest: subjectDigest, DestDigest: subjectDigest}, retryConfigs)
+	require.NoError(t, err)
+	assert.Equal(t, 0, copied)
+	require.Len(t, queries, 2)
+	assert.GreaterOrEqual(t, queries[1].Sub(queries[0]), time.Second)
+}
+
+func TestCopyImageReferrers(t *testing.T) {
+	captureLogs(t)
+	registry := newReferrersServer(t, false)
+	dest, _, pushed := newPushRegistry(t, 0)
+	srcRef, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(registry.server.URL, "https://") + "/repo/app:v1")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(dest.URL, "https://") + "/app:v1")
+	require.NoError(t, err)
+	srcCtx := &types.SystemContext{
+		DockerAuthConfig:            &types.DockerAuthConfig{Username: "user", Password: "pass"},
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+	}
+	destCtx := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	retryConfigs, err := GetRetryConfigs("")
+	require.NoError(t, err)
+
+	result := &CopyResult{SrcDigest: subjectDigest, DestDigest: subjectDigest}
+	n, err := copyImageReferrers(context.Background(), logger, srcRef, destRef, srcCtx, destCtx, result, retryConfigs)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	// The referrers keep their digests, and the fallback index is written last.
+	assert.Equal(t, []string{registry.sbom.String(), ReferrersTagPrefix(subjectDigest), SigstoreAttachmentTag(subjectDigest)}, pushed.order)
+	for _, name := range pushed.order {
+		assert.Equal(t, registry.manifests[name], pushed.manifests[name], name)
+	}
+
+	_, err = copyImageReferrers(context.Background(), logger, srcRef, destRef, srcCtx, destCtx, &CopyResult{SrcDigest: subjectDigest, DestDigest: "sha256:aaa"}, retryConfigs)
+	assert.ErrorContains(t, err, "set PreserveDigests to keep it")
+}
+
+func TestReferrerRefs(t *testing.T) {
+	srcRef, err := alltransports.ParseImageName("docker://ghcr.io/org/app:v1")
+	require.NoError(t, err)
+	destRef, err := alltransports.ParseImageName("docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/app:v1")
+	require.NoError(t, err)
+
+	refs, err := referrerRefs(srcRef, destRef, &Referrers{
+		Digests: []digest.Digest{"sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"},
+		Tags:    []string{ReferrersTagPrefix(subjectDigest) + ".sig"},
+	})
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	assert.Equal(t, "docker://ghcr.io/org/app@sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210", transports.ImageName(refs[0][0]))
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/app@sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210", transports.ImageName(refs[0][1]))
+	assert.Equal(t, "docker://ghcr.io/org/app:sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.sig", transports.ImageName(refs[1][0]))
+	assert.Equal(t, "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/app:sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.sig", transports.ImageName(refs[1][1]))
+}
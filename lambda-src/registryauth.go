@@ -0,0 +1,389 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+)
+
+// RegistryAuthenticator logs into the registries it is registered for. The returned
+// credentials are cached until their ExpiresAt, under the key CacheKey returns.
+type RegistryAuthenticator interface {
+	CacheKey(host string) string
+	Authenticate(ctx context.Context, host string) (*ECRAuth, error)
+}
+
+type registeredAuthenticator struct {
+	match         func(host string) bool
+	authenticator RegistryAuthenticator
+}
+
+// AuthenticatorRegistry selects the authenticator of a registry by hostname pattern.
+type AuthenticatorRegistry struct {
+	entries []registeredAuthenticator
+}
+
+// Register adds an authenticator for the hosts matching pattern, a path.Match pattern such
+// as `*.azurecr.io`. Patterns registered first take precedence.
+func (r *AuthenticatorRegistry) Register(pattern string, authenticator RegistryAuthenticator) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid registry pattern %q: %v", pattern, err.Error())
+	}
+	r.RegisterMatcher(func(host string) bool {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}, authenticator)
+	return nil
+}
+
+// RegisterMatcher adds an authenticator for the hosts match accepts, for registries whose
+// hostnames can't be told apart by a pattern alone.
+func (r *AuthenticatorRegistry) RegisterMatcher(match func(host string) bool, authenticator RegistryAuthenticator) {
+	r.entries = append(r.entries, registeredAuthenticator{match, authenticator})
+}
+
+// Lookup returns the authenticator of host, or nil if no pattern matches it.
+func (r *AuthenticatorRegistry) Lookup(host string) RegistryAuthenticator {
+	if r == nil {
+		return nil
+	}
+	host = strings.ToLower(host)
+	for _, e := range r.entries {
+		if e.match(host) {
+			return e.authenticator
+		}
+	}
+	return nil
+}
+
+// ECR_PUBLIC_REGISTRY is the hostname of public ECR.
+const ECR_PUBLIC_REGISTRY = "public.ecr.aws"
+
+// Hostname patterns of the cloud registries with native authentication.
+var (
+	gcpRegistryPatterns    = []string{"gcr.io", "*.gcr.io", "*-docker.pkg.dev"}
+	azureRegistryPatterns  = []string{"*.azurecr.io", "*.azurecr.cn", "*.azurecr.us"}
+	githubRegistryPatterns = []string{"ghcr.io"}
+)
+
+// ECRAuthenticator logs into private ECR registries with the Lambda's credentials, or those of
+// an assumed role.
+type ECRAuthenticator struct {
+	region  string // Region of the ECR API, the registry's region if empty
+	role    *AssumeRoleConfigs
+	clients *AWSClients
+}
+
+func NewECRAuthenticator(region string, role *AssumeRoleConfigs, clients *AWSClients) *ECRAuthenticator {
+	return &ECRAuthenticator{region: region, role: role, clients: clients}
+}
+
+// registryRegion returns the parsed registry of host and the region its tokens are requested in.
+func (a *ECRAuthenticator) registryRegion(host string) (*ECRRegistry, string, error) {
+	registry, ok := ParseECRRegistry(host)
+	if !ok {
+		return nil, "", fmt.Errorf("%s is not an ECR registry", host)
+	}
+	if a.region != "" {
+		return registry, a.region, nil
+	}
+	return registry, registry.Region, nil
+}
+
+func (a *ECRAuthenticator) CacheKey(host string) string {
+	registry, region, err := a.registryRegion(host)
+	if err != nil {
+		return ""
+	}
+	return AuthCacheKey(fmt.Sprintf("%s.dkr.ecr.%s", registry.AccountID, region), a.role)
+}
+
+func (a *ECRAuthenticator) Authenticate(ctx context.Context, host string) (auth *ECRAuth, err error) {
+	ctx, span := tracer().Start(ctx, SPAN_ECR_LOGIN, trace.WithAttributes(attribute.String("registry", host)))
+	defer func() { endSpan(span, err) }()
+
+	registry, region, err := a.registryRegion(host)
+	if err != nil {
+		return nil, err
+	}
+	auths, err := a.clients.GetECRLogin(ctx, registry, region, a.role)
+	if err != nil {
+		return nil, err
+	}
+	return SelectECRAuth(auths, registry)
+}
+
+// ECRPublicAuthenticator logs into public ECR, whose tokens lift the anonymous pull limits.
+type ECRPublicAuthenticator struct {
+	role    *AssumeRoleConfigs
+	clients *AWSClients
+}
+
+func NewECRPublicAuthenticator(role *AssumeRoleConfigs, clients *AWSClients) *ECRPublicAuthenticator {
+	return &ECRPublicAuthenticator{role: role, clients: clients}
+}
+
+func (a *ECRPublicAuthenticator) CacheKey(host string) string {
+	return AuthCacheKey(ECR_PUBLIC_REGISTRY, a.role)
+}
+
+func (a *ECRPublicAuthenticator) Authenticate(ctx context.Context, host string) (auth *ECRAuth, err error) {
+	ctx, span := tracer().Start(ctx, SPAN_ECR_LOGIN, trace.WithAttributes(attribute.String("registry", ECR_PUBLIC_REGISTRY)))
+	defer func() { endSpan(span, err) }()
+
+	return a.clients.GetECRPublicLogin(ctx, a.role)
+}
+
+// NewAWSAuthenticatorRegistry returns the authenticators of private and public ECR. region
+// overrides the region of the ECR API if it is set.
+func NewAWSAuthenticatorRegistry(region string, role *AssumeRoleConfigs, clients *AWSClients) *AuthenticatorRegistry {
+	registry := &AuthenticatorRegistry{}
+	registry.RegisterMatcher(func(host string) bool {
+		_, ok := ParseECRRegistry(host)
+		return ok
+	}, NewECRAuthenticator(region, role, clients))
+	registry.RegisterMatcher(func(host string) bool {
+		return host == ECR_PUBLIC_REGISTRY
+	}, NewECRPublicAuthenticator(role, clients))
+	return registry
+}
+
+// StaticAuthenticator logs in with fixed `user:pass` credentials. Its credentials are never
+// cached, as they can't expire.
+type StaticAuthenticator struct {
+	user string
+	pass string
+}
+
+// NewStaticAuthenticator parses `user:pass` credentials; a value without a colon is a user
+// without password.
+func NewStaticAuthenticator(creds string) *StaticAuthenticator {
+	user, pass, _ := strings.Cut(creds, ":")
+	return &StaticAuthenticator{user: user, pass: pass}
+}
+
+func (a *StaticAuthenticator) CacheKey(host string) string {
+	return ""
+}
+
+func (a *StaticAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	return &ECRAuth{User: a.user, Pass: a.pass}, nil
+}
+
+// SecretAuthenticator logs in with the credentials of a Secrets Manager secret, in one of the
+// formats ParseSecretCreds reads. The secret is fetched once per authenticator, on first use.
+type SecretAuthenticator struct {
+	secretId  string
+	configs   *SecretConfigs
+	getSecret func(secretId string, sc *SecretConfigs) (string, error)
+
+	mu   sync.Mutex
+	auth *ECRAuth
+}
+
+func NewSecretAuthenticator(secretId string, configs *SecretConfigs) *SecretAuthenticator {
+	return &SecretAuthenticator{secretId: secretId, configs: configs, getSecret: GetSecretVersion}
+}
+
+// NewSSMParameterAuthenticator returns an authenticator reading the credentials from an SSM
+// parameter, decrypted if it is a SecureString. Parameters have no version stages, so only
+// the keys of configs apply.
+func NewSSMParameterAuthenticator(ref string, configs *SecretConfigs) *SecretAuthenticator {
+	return &SecretAuthenticator{secretId: ref, configs: configs, getSecret: func(ref string, _ *SecretConfigs) (string, error) {
+		return GetSSMParameter(ref)
+	}}
+}
+
+func (a *SecretAuthenticator) CacheKey(host string) string {
+	return ""
+}
+
+func (a *SecretAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.auth == nil {
+		auth, err := a.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		a.auth = auth
+	}
+	auth := *a.auth
+	return &auth, nil
+}
+
+func (a *SecretAuthenticator) fetch(ctx context.Context) (auth *ECRAuth, err error) {
+	_, span := tracer().Start(ctx, SPAN_FETCH_SECRET, trace.WithAttributes(attribute.String("secret.id", a.secretId)))
+	defer func() { endSpan(span, err) }()
+
+	secret, err := a.getSecret(a.secretId, a.configs)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSecretCreds(secret, a.configs)
+}
+
+// Native authentication configuration for non-AWS cloud registries. Secret values can be
+// given as-is, or as a Secrets Manager secret ARN or SSM parameter (`ssm:<name>` or ARN).
+type RegistryAuthConfigs struct {
+	GCP    *GCPAuthConfigs    `json:"gcp,omitempty"`    // Google Container Registry and Artifact Registry
+	Azure  *AzureAuthConfigs  `json:"azure,omitempty"`  // Azure Container Registry
+	GitHub *GitHubAuthConfigs `json:"github,omitempty"` // GitHub Container Registry
+}
+
+type GCPAuthConfigs struct {
+	ServiceAccountKey *string                `json:"serviceAccountKey,omitempty"` // The JSON key of a service account
+	WorkloadIdentity  *GCPWorkloadIdentities `json:"workloadIdentity,omitempty"`  // Federation of the Lambda's AWS identity, instead of a key
+}
+
+type GCPWorkloadIdentities struct {
+	Audience            *string `json:"audience,omitempty"`            // The full resource name of the workload identity pool provider
+	ServiceAccountEmail *string `json:"serviceAccountEmail,omitempty"` // The service account to impersonate, if the federated identity isn't granted access directly
+}
+
+type AzureAuthConfigs struct {
+	TenantId     *string `json:"tenantId,omitempty"`     // The Azure AD tenant of the service principal
+	ClientId     *string `json:"clientId,omitempty"`     // The application (client) ID of the service principal
+	ClientSecret *string `json:"clientSecret,omitempty"` // The client secret of the service principal
+}
+
+type GitHubAuthConfigs struct {
+	AppId          *string `json:"appId,omitempty"`          // The ID of the GitHub App
+	InstallationId *string `json:"installationId,omitempty"` // The ID of the App installation with access to the packages
+	PrivateKey     *string `json:"privateKey,omitempty"`     // The PEM private key of the GitHub App
+}
+
+// Helper function to parse the specified registry auth configuration in the form of JSON data into a
+// RegistryAuthConfigs object
+func GetRegistryAuthConfigs(data string) (*RegistryAuthConfigs, error) {
+	config := RegistryAuthConfigs{}
+
+	if data != "" {
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			// The data holds secrets, so only the error is reported.
+			return nil, fmt.Errorf("unable to parse registry auth configuration with error: %v", err)
+		}
+	}
+	if err := config.ValidateFields(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Helper function for RegistryAuthConfigs to validate that each provider has the fields it needs.
+func (rc *RegistryAuthConfigs) ValidateFields() error {
+	if gcp := rc.GCP; gcp != nil {
+		if (gcp.ServiceAccountKey == nil) == (gcp.WorkloadIdentity == nil) {
+			return fmt.Errorf("gcp requires exactly one of serviceAccountKey and workloadIdentity")
+		}
+		if gcp.WorkloadIdentity != nil && gcp.WorkloadIdentity.Audience == nil {
+			return fmt.Errorf("gcp workloadIdentity requires an audience")
+		}
+	}
+	if azure := rc.Azure; azure != nil {
+		if azure.TenantId == nil || azure.ClientId == nil || azure.ClientSecret == nil {
+			return fmt.Errorf("azure requires tenantId, clientId and clientSecret")
+		}
+	}
+	if github := rc.GitHub; github != nil {
+		if github.AppId == nil || github.InstallationId == nil || github.PrivateKey == nil {
+			return fmt.Errorf("github requires appId, installationId and privateKey")
+		}
+	}
+	return nil
+}
+
+// NewAuthenticatorRegistry builds the authenticators configured in rc, registered for the
+// hostname patterns of their registries.
+func NewAuthenticatorRegistry(rc *RegistryAuthConfigs) (*AuthenticatorRegistry, error) {
+	registry := &AuthenticatorRegistry{}
+	register := func(patterns []string, authenticator RegistryAuthenticator) error {
+		for _, pattern := range patterns {
+			if err := registry.Register(pattern, authenticator); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if rc.GCP != nil {
+		var authenticator RegistryAuthenticator
+		if rc.GCP.ServiceAccountKey != nil {
+			key, err := resolveSecretRef(*rc.GCP.ServiceAccountKey)
+			if err != nil {
+				return nil, err
+			}
+			authenticator, err = NewGCPServiceAccountAuthenticator([]byte(key), http.DefaultClient)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			wi := rc.GCP.WorkloadIdentity
+			authenticator = NewGCPWorkloadIdentityAuthenticator(*wi.Audience, aws.ToString(wi.ServiceAccountEmail), nil, http.DefaultClient)
+		}
+		if err := register(gcpRegistryPatterns, authenticator); err != nil {
+			return nil, err
+		}
+	}
+	if rc.Azure != nil {
+		secret, err := resolveSecretRef(*rc.Azure.ClientSecret)
+		if err != nil {
+			return nil, err
+		}
+		authenticator := NewAzureAuthenticator(*rc.Azure.TenantId, *rc.Azure.ClientId, secret, http.DefaultClient)
+		if err := register(azureRegistryPatterns, authenticator); err != nil {
+			return nil, err
+		}
+	}
+	if rc.GitHub != nil {
+		key, err := resolveSecretRef(*rc.GitHub.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		authenticator, err := NewGitHubAppAuthenticator(*rc.GitHub.AppId, *rc.GitHub.InstallationId, []byte(key), http.DefaultClient)
+		if err != nil {
+			return nil, err
+		}
+		if err := register(githubRegistryPatterns, authenticator); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// resolveSecretRef returns the value of a Secrets Manager secret ARN or SSM parameter
+// reference, or s itself if it is neither.
+func resolveSecretRef(s string) (string, error) {
+	if IsSSMParameterRef(s) {
+		return GetSSMParameter(s)
+	}
+	if a, err := arn.Parse(s); err == nil && a.Service == "secretsmanager" {
+		return GetSecret(s)
+	}
+	return s, nil
+}
+
+// registryHost returns the registry hostname of an image URI, or "" if it isn't in a registry.
+func registryHost(uri string) string {
+	ref, err := alltransports.ParseImageName(uri)
+	if err != nil || ref.DockerReference() == nil {
+		return ""
+	}
+	return reference.Domain(ref.DockerReference())
+}
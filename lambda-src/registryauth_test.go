@@ -0,0 +1,358 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	ecrtypes "github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	ecrpublictypes "github.com/aws/aws-sdk-go-v2/service/ecrpublic/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
+)
+
+type fakeAuthenticator struct {
+	name  string
+	calls int
+}
+
+func (f *fakeAuthenticator) CacheKey(host string) string {
+	return "fake|" + f.name + "|" + host
+}
+
+func (f *fakeAuthenticator) Authenticate(ctx context.Context, host string) (*ECRAuth, error) {
+	f.calls++
+	return &ECRAuth{User: f.name, Pass: "token-for-" + host, ExpiresAt: time.Now().Add(time.Hour)}, nil
+}
+
+func TestAuthenticatorRegistryLookup(t *testing.T) {
+	gcp, azure, github := &fakeAuthenticator{name: "gcp"}, &fakeAuthenticator{name: "azure"}, &fakeAuthenticator{name: "github"}
+	registry := &AuthenticatorRegistry{}
+	for _, p := range gcpRegistryPatterns {
+		require.NoError(t, registry.Register(p, gcp))
+	}
+	for _, p := range azureRegistryPatterns {
+		require.NoError(t, registry.Register(p, azure))
+	}
+	for _, p := range githubRegistryPatterns {
+		require.NoError(t, registry.Register(p, github))
+	}
+	assert.ErrorContains(t, registry.Register("[", gcp), "invalid registry pattern")
+
+	tests := []struct {
+		host string
+		want RegistryAuthenticator
+	}{
+		{"gcr.io", gcp},
+		{"eu.gcr.io", gcp},
+		{"europe-west1-docker.pkg.dev", gcp},
+		{"myregistry.azurecr.io", azure},
+		{"MyRegistry.azurecr.cn", azure},
+		{"ghcr.io", github},
+		{"docker.io", nil},
+		{"evil.gcr.io.example.com", nil},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.want, registry.Lookup(tt.host))
+		})
+	}
+
+	var empty *AuthenticatorRegistry
+	assert.Nil(t, empty.Lookup("gcr.io"))
+}
+
+func TestGetRegistryAuthConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"gcp key", `{"gcp": {"serviceAccountKey": "arn:aws:secretsmanager:us-east-1:123456789012:secret:gcp"}}`, ""},
+		{"gcp workload identity", `{"gcp": {"workloadIdentity": {"audience": "//iam.googleapis.com/pool"}}}`, ""},
+		{"gcp both", `{"gcp": {"serviceAccountKey": "k", "workloadIdentity": {"audience": "a"}}}`, "exactly one of"},
+		{"gcp no audience", `{"gcp": {"workloadIdentity": {}}}`, "requires an audience"},
+		{"azure", `{"azure": {"tenantId": "t", "clientId": "c", "clientSecret": "s"}}`, ""},
+		{"azure missing secret", `{"azure": {"tenantId": "t", "clientId": "c"}}`, "azure requires"},
+		{"github", `{"github": {"appId": "1", "installationId": "2", "privateKey": "ssm:/github/key"}}`, ""},
+		{"github missing key", `{"github": {"appId": "1", "installationId": "2"}}`, "github requires"},
+		{"unknown field", `{"quay": {}}`, "unable to parse registry auth configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GetRegistryAuthConfigs(tt.data)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	// Inline secrets are not echoed in parse errors.
+	_, err := GetRegistryAuthConfigs(`{"azure": {"clientSecret": "super-secret", "extra": 1}}`)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "super-secret")
+}
+
+func TestNewAuthenticatorRegistry(t *testing.T) {
+	_, keyPEM := generateRSAKey(t)
+	configs := &RegistryAuthConfigs{
+		Azure:  &AzureAuthConfigs{TenantId: aws.String("t"), ClientId: aws.String("c"), ClientSecret: aws.String("s")},
+		GitHub: &GitHubAuthConfigs{AppId: aws.String("1"), InstallationId: aws.String("2"), PrivateKey: aws.String(string(keyPEM))},
+	}
+	registry, err := NewAuthenticatorRegistry(configs)
+	require.NoError(t, err)
+	assert.IsType(t, &AzureAuthenticator{}, registry.Lookup("myregistry.azurecr.io"))
+	assert.IsType(t, &GitHubAppAuthenticator{}, registry.Lookup("ghcr.io"))
+	assert.Nil(t, registry.Lookup("gcr.io"))
+
+	registry, err = NewAuthenticatorRegistry(&RegistryAuthConfigs{})
+	require.NoError(t, err)
+	assert.Nil(t, registry.Lookup("ghcr.io"))
+}
+
+func TestNewSystemContextAuthenticator(t *testing.T) {
+	fake := &fakeAuthenticator{name: "github"}
+	registry := &AuthenticatorRegistry{}
+	require.NoError(t, registry.Register("ghcr.io", fake))
+
+	opts := NewImageOpts("docker://ghcr.io/owner/repo:v1", "amd64", false)
+	opts.SetAuthenticators(registry)
+	key := authCacheKey(opts)
+	assert.Equal(t, "fake|github|ghcr.io", key)
+	defer ecrAuthCache.Invalidate(key)
+
+	ctx, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "github", Password: "token-for-ghcr.io"}, ctx.DockerAuthConfig)
+
+	// The token is cached like ECR tokens.
+	require.NoError(t, opts.RefreshAuth(ctx, false))
+	assert.Equal(t, 1, fake.calls)
+
+	// Registries without an authenticator stay anonymous.
+	opts = NewImageOpts("docker://quay.io/org/repo:v1", "amd64", false)
+	opts.SetAuthenticators(registry)
+	key = authCacheKey(opts)
+	assert.Empty(t, key)
+}
+
+// fakeECR returns a token of the proxy endpoint, after resolving the credentials it would sign with.
+type fakeECR struct {
+	cfg      aws.Config
+	endpoint string
+	input    *ecr.GetAuthorizationTokenInput
+	creds    aws.Credentials
+}
+
+func (f *fakeECR) GetAuthorizationToken(ctx context.Context, params *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.input = params
+	creds, err := f.cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.creds = creds
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []ecrtypes.AuthorizationData{{
+			AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:ecr-token"))),
+			ExpiresAt:          aws.Time(time.Now().Add(12 * time.Hour)),
+			ProxyEndpoint:      aws.String(f.endpoint),
+		}},
+	}, nil
+}
+
+type fakeECRPublic struct {
+	calls int
+	err   error
+}
+
+func (f *fakeECRPublic) GetAuthorizationToken(ctx context.Context, params *ecrpublic.GetAuthorizationTokenInput, optFns ...func(*ecrpublic.Options)) (*ecrpublic.GetAuthorizationTokenOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &ecrpublic.GetAuthorizationTokenOutput{
+		AuthorizationData: &ecrpublictypes.AuthorizationData{
+			AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:public-token"))),
+			ExpiresAt:          aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+// fakeAWSClients returns clients answering with fake, and keeps the config of each ECR client.
+func fakeAWSClients(ecrClient *fakeECR, ecrPublicClient *fakeECRPublic, stsClient *fakeSTS) *AWSClients {
+	return &AWSClients{
+		NewECR: func(cfg aws.Config) ecrAPI {
+			ecrClient.cfg = cfg
+			return ecrClient
+		},
+		NewECRPublic: func(cfg aws.Config) ecrPublicAPI { return ecrPublicClient },
+		NewSTS:       func(cfg aws.Config) stscreds.AssumeRoleAPIClient { return stsClient },
+	}
+}
+
+func TestNewSystemContextECR(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDLAMBDA")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	tests := []struct {
+		name      string
+		uri       string
+		endpoint  string
+		role      *AssumeRoleConfigs
+		wantKeyId string
+		wantFIPS  aws.FIPSEndpointState
+	}{
+		{"lambda credentials", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/repo:tag", "https://123456789012.dkr.ecr.us-west-2.amazonaws.com", nil, "AKIDLAMBDA", aws.FIPSEndpointStateUnset},
+		{"assumed role", "docker://210987654321.dkr.ecr.eu-west-1.amazonaws.com/repo:tag", "https://210987654321.dkr.ecr.eu-west-1.amazonaws.com", &AssumeRoleConfigs{RoleArn: "arn:aws:iam::210987654321:role/ecr-push", SessionName: DEFAULT_SESSION_NAME}, "ASIAEXAMPLE", aws.FIPSEndpointStateUnset},
+		{"fips", "docker://123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/repo:tag", "https://123456789012.dkr.ecr.us-gov-west-1.amazonaws.com", nil, "AKIDLAMBDA", aws.FIPSEndpointStateEnabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ecrClient, stsClient := &fakeECR{endpoint: tt.endpoint}, &fakeSTS{}
+			opts := NewImageOpts(tt.uri, "amd64", false)
+			opts.SetRole(tt.role)
+			opts.clients = fakeAWSClients(ecrClient, &fakeECRPublic{}, stsClient)
+			defer ecrAuthCache.Invalidate(authCacheKey(opts))
+
+			ctx, err := opts.NewSystemContext()
+			require.NoError(t, err)
+			assert.Equal(t, &types.DockerAuthConfig{Username: "AWS", Password: "ecr-token"}, ctx.DockerAuthConfig)
+			registry, _ := ParseECRRegistry(tt.uri)
+			assert.Equal(t, []string{registry.AccountID}, ecrClient.input.RegistryIds)
+			assert.Equal(t, registry.Region, ecrClient.cfg.Region)
+			assert.Equal(t, tt.wantKeyId, ecrClient.creds.AccessKeyID)
+			if tt.role != nil {
+				assert.Equal(t, tt.role.RoleArn, aws.ToString(stsClient.input.RoleArn))
+			}
+			fips, _, _ := awsConfigFIPS(ecrClient.cfg)
+			assert.Equal(t, tt.wantFIPS, fips)
+		})
+	}
+
+	// A token of another registry is rejected.
+	opts := NewImageOpts("docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/repo:tag", "amd64", false)
+	opts.clients = fakeAWSClients(&fakeECR{endpoint: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com"}, &fakeECRPublic{}, &fakeSTS{})
+	_, err := opts.NewSystemContext()
+	assert.ErrorContains(t, err, "no ECR auth token for registry")
+}
+
+// awsConfigFIPS returns the FIPS endpoint setting of cfg.
+func awsConfigFIPS(cfg aws.Config) (aws.FIPSEndpointState, bool, error) {
+	for _, source := range cfg.ConfigSources {
+		if s, ok := source.(interface {
+			GetUseFIPSEndpoint(context.Context) (aws.FIPSEndpointState, bool, error)
+		}); ok {
+			if state, found, err := s.GetUseFIPSEndpoint(context.TODO()); found || err != nil {
+				return state, found, err
+			}
+		}
+	}
+	return aws.FIPSEndpointStateUnset, false, nil
+}
+
+func TestNewSystemContextECRPublic(t *testing.T) {
+	ecrPublicClient := &fakeECRPublic{}
+	opts := NewImageOpts("docker://public.ecr.aws/nginx/nginx:latest", "amd64", false)
+	opts.clients = fakeAWSClients(&fakeECR{}, ecrPublicClient, &fakeSTS{})
+	defer ecrAuthCache.Invalidate(authCacheKey(opts))
+
+	ctx, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "AWS", Password: "public-token"}, ctx.DockerAuthConfig)
+	require.NoError(t, opts.RefreshAuth(ctx, true))
+	assert.Equal(t, 2, ecrPublicClient.calls)
+
+	ecrAuthCache.Invalidate(authCacheKey(opts))
+	opts.clients = fakeAWSClients(&fakeECR{}, &fakeECRPublic{err: errors.New("access denied")}, &fakeSTS{})
+	_, err = opts.NewSystemContext()
+	assert.EqualError(t, err, "error logging into ECR Public: access denied")
+}
+
+func TestNewSystemContextCreds(t *testing.T) {
+	// Credentials replace ECR auto login, so ECR is never called.
+	clients := fakeAWSClients(&fakeECR{}, &fakeECRPublic{err: errors.New("unexpected call")}, &fakeSTS{})
+	tests := []struct {
+		name  string
+		creds RegistryAuthenticator
+		want  types.DockerAuthConfig
+	}{
+		{"static", NewStaticAuthenticator("user:pass:word"), types.DockerAuthConfig{Username: "user", Password: "pass:word"}},
+		{"user only", NewStaticAuthenticator("token"), types.DockerAuthConfig{Username: "token"}},
+		{"secret text", &SecretAuthenticator{secretId: "creds", getSecret: func(string, *SecretConfigs) (string, error) { return "user:pass", nil }}, types.DockerAuthConfig{Username: "user", Password: "pass"}},
+		{"secret JSON", &SecretAuthenticator{secretId: "creds", getSecret: func(string, *SecretConfigs) (string, error) { return `{"username": "user", "password": "pass"}`, nil }}, types.DockerAuthConfig{Username: "user", Password: "pass"}},
+		{"secret token", &SecretAuthenticator{secretId: "creds", getSecret: func(string, *SecretConfigs) (string, error) { return `{"token": "bearer"}`, nil }}, types.DockerAuthConfig{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewImageOpts("docker://public.ecr.aws/nginx/nginx:latest", "amd64", false)
+			opts.SetCreds(tt.creds)
+			opts.clients = clients
+			assert.Empty(t, authCacheKey(opts))
+			ctx, err := opts.NewSystemContext()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *ctx.DockerAuthConfig)
+		})
+	}
+
+	opts := NewImageOpts("docker://registry.example.com/repo:v1", "amd64", false)
+	opts.SetCreds(&SecretAuthenticator{secretId: "creds", getSecret: func(string, *SecretConfigs) (string, error) { return `{"token": "bearer"}`, nil }})
+	ctx, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Equal(t, "bearer", ctx.DockerBearerRegistryToken)
+}
+
+func TestSSMParameterAuthenticator(t *testing.T) {
+	// Parameters share the parsing of secrets.
+	a := NewSSMParameterAuthenticator("ssm:/registry/creds", &SecretConfigs{UsernameKey: aws.String("login")})
+	fetched := ""
+	a.getSecret = func(ref string, sc *SecretConfigs) (string, error) {
+		fetched = ref
+		return `{"login": "user", "password": "pass"}`, nil
+	}
+	auth, err := a.Authenticate(context.Background(), "docker.io")
+	require.NoError(t, err)
+	assert.Equal(t, &ECRAuth{User: "user", Pass: "pass"}, auth)
+	assert.Equal(t, "ssm:/registry/creds", fetched)
+}
+
+func TestSecretAuthenticator(t *testing.T) {
+	fetches := 0
+	a := &SecretAuthenticator{secretId: "arn:aws:secretsmanager:us-east-1:123456789012:secret:creds", getSecret: func(secretId string, sc *SecretConfigs) (string, error) {
+		fetches++
+		return `{"username": "user", "password": "pass"}`, nil
+	}}
+	for i := 0; i < 2; i++ {
+		auth, err := a.Authenticate(context.Background(), "docker.io")
+		require.NoError(t, err)
+		assert.Equal(t, "pass", auth.Pass)
+	}
+	assert.Equal(t, 1, fetches)
+
+	// The secret configuration selects the version and the keys.
+	configs := &SecretConfigs{UsernameKey: aws.String("login"), VersionStage: aws.String("AWSPREVIOUS")}
+	a = &SecretAuthenticator{secretId: "creds", configs: configs, getSecret: func(secretId string, sc *SecretConfigs) (string, error) {
+		assert.Equal(t, configs, sc)
+		return `{"login": "previous", "password": "pass"}`, nil
+	}}
+	auth, err := a.Authenticate(context.Background(), "docker.io")
+	require.NoError(t, err)
+	assert.Equal(t, "previous", auth.User)
+
+	a = &SecretAuthenticator{secretId: "creds", getSecret: func(string, *SecretConfigs) (string, error) { return `{"user": "u"}`, nil }}
+	_, err = a.Authenticate(context.Background(), "docker.io")
+	assert.ErrorContains(t, err, "error parsing username from json secret")
+}
@@ -25,7 +25,7 @@ func newImageSource(ctx context.Context, sys *types.SystemContext, ref *s3Archiv
 	if err != nil {
 		return nil, err
 	}
-	f, err := tarfile.NewS3File(cfg, *ref.s3uri)
+	f, err := tarfile.NewS3File(ctx, cfg, *ref.s3uri)
 	if err != nil {
 		return nil, err
 	}
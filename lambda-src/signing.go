@@ -0,0 +1,461 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cdk-ecr-deployment-handler/internal/iolimits"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/blobinfocache/none"
+	"go.podman.io/image/v5/types"
+)
+
+// Constants of the sigstore (cosign) signature format, as read by sigstoreSigned policy requirements.
+const (
+	sigstoreSignatureType          = "cosign container image signature"
+	sigstoreSignatureMIMEType      = "application/vnd.dev.cosign.simplesigning.v1+json"
+	sigstoreSignatureAnnotationKey = "dev.cosignproject.cosign/signature"
+	sigstoreSignatureCreator       = "cdk-ecr-deployment"
+)
+
+// FILE_SIGNING_KEY_PREFIX marks a SigningKey that is a PEM private key file rather than a KMS key.
+const FILE_SIGNING_KEY_PREFIX = "file://"
+
+// ImageSigner signs sigstore payloads. Signatures are made over the SHA-256 digest of the
+// payload, which is what sigstore verifiers expect.
+type ImageSigner interface {
+	Sign(ctx context.Context, payload []byte) ([]byte, error)
+	PublicKey(ctx context.Context) (crypto.PublicKey, error)
+}
+
+// kmsAPI is the subset of the KMS client used by KMSSigner.
+type kmsAPI interface {
+	Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error)
+	GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error)
+}
+
+// KMSSigner signs with an asymmetric KMS key of spec ECC_NIST_P256 or RSA_*.
+type KMSSigner struct {
+	client kmsAPI
+	keyID  string
+
+	once      sync.Once
+	publicKey crypto.PublicKey
+	algorithm kmstypes.SigningAlgorithmSpec
+	err       error
+}
+
+// NewKMSSigner returns a signer using keyID, which is a key ID, key ARN, alias name or alias ARN.
+func NewKMSSigner(client kmsAPI, keyID string) *KMSSigner {
+	return &KMSSigner{client: client, keyID: keyID}
+}
+
+// loadKey fetches the public key once and picks the signing algorithm matching its spec.
+func (s *KMSSigner) loadKey(ctx context.Context) error {
+	s.once.Do(func() {
+		resp, err := s.client.GetPublicKey(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(s.keyID)})
+		if err != nil {
+			s.err = fmt.Errorf("fetch kms public key error: %v", err.Error())
+			return
+		}
+		if resp.KeyUsage != kmstypes.KeyUsageTypeSignVerify {
+			s.err = fmt.Errorf("kms key %s can't sign: key usage is %s", s.keyID, resp.KeyUsage)
+			return
+		}
+		switch resp.KeySpec {
+		case kmstypes.KeySpecEccNistP256:
+			s.algorithm = kmstypes.SigningAlgorithmSpecEcdsaSha256
+		case kmstypes.KeySpecRsa2048, kmstypes.KeySpecRsa3072, kmstypes.KeySpecRsa4096:
+			s.algorithm = kmstypes.SigningAlgorithmSpecRsassaPkcs1V15Sha256
+		default:
+			// Sigstore verifiers hash payloads with SHA-256, which KMS only pairs with these specs.
+			s.err = fmt.Errorf("kms key %s has unsupported key spec %s: expected ECC_NIST_P256 or RSA_*", s.keyID, resp.KeySpec)
+			return
+		}
+		s.publicKey, s.err = x509.ParsePKIXPublicKey(resp.PublicKey)
+	})
+	return s.err
+}
+
+func (s *KMSSigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	if err := s.loadKey(ctx); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(payload)
+	resp, err := s.client.Sign(ctx, &kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          sum[:],
+		MessageType:      kmstypes.MessageTypeDigest,
+		SigningAlgorithm: s.algorithm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms sign error: %v", err.Error())
+	}
+	return resp.Signature, nil
+}
+
+func (s *KMSSigner) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	if err := s.loadKey(ctx); err != nil {
+		return nil, err
+	}
+	return s.publicKey, nil
+}
+
+// FileSigner signs with a local ECDSA P-256 or RSA private key. It stands in for KMS when
+// running locally and in tests.
+type FileSigner struct {
+	key crypto.Signer
+}
+
+// NewFileSigner parses a PEM-encoded PKCS #8, SEC 1 or PKCS #1 private key.
+func NewFileSigner(pemBytes []byte) (*FileSigner, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("invalid signing key: no PEM block found")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %v", err.Error())
+	}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("invalid signing key: only P-256 ECDSA keys are supported")
+		}
+		return &FileSigner{key: k}, nil
+	case *rsa.PrivateKey:
+		return &FileSigner{key: k}, nil
+	default:
+		return nil, fmt.Errorf("invalid signing key: unsupported key type %T", key)
+	}
+}
+
+func (s *FileSigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	sum := sha256.Sum256(payload)
+	// ECDSA keys produce ASN.1 signatures and RSA keys PKCS #1 v1.5 ones, as KMS does.
+	return s.key.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
+
+func (s *FileSigner) PublicKey(ctx context.Context) (crypto.PublicKey, error) {
+	return s.key.Public(), nil
+}
+
+// GetImageSigner builds the signer of the SigningKey property: a KMS key ID, key ARN, alias
+// name or alias ARN, or `file://<path>` to a PEM private key. An empty property returns nil.
+func GetImageSigner(s string) (ImageSigner, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if path, ok := strings.CutPrefix(s, FILE_SIGNING_KEY_PREFIX); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key: %v", err.Error())
+		}
+		signer, err := NewFileSigner(b)
+		if err != nil {
+			return nil, err
+		}
+		return signer, nil
+	}
+
+	opts := []func(*config.LoadOptions) error{}
+	if a, err := arn.Parse(s); err == nil {
+		opts = append(opts, config.WithRegion(a.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_SIGN, "keyId": s, "region": cfg.Region}).Info("Signing with KMS key")
+	return NewKMSSigner(kms.NewFromConfig(cfg), s), nil
+}
+
+// SigstoreSignature is a signed sigstore payload.
+type SigstoreSignature struct {
+	Payload   []byte
+	Signature []byte
+}
+
+// LayerDescriptor returns the descriptor of the signature in a sigstore attachment manifest.
+func (s *SigstoreSignature) LayerDescriptor() imgspecv1.Descriptor {
+	return imgspecv1.Descriptor{
+		MediaType: sigstoreSignatureMIMEType,
+		Digest:    digest.FromBytes(s.Payload),
+		Size:      int64(len(s.Payload)),
+		Annotations: map[string]string{
+			sigstoreSignatureAnnotationKey: base64.StdEncoding.EncodeToString(s.Signature),
+		},
+	}
+}
+
+// NewSigstorePayload returns the payload claiming that the image named dockerReference has
+// the manifest manifestDigest.
+func NewSigstorePayload(dockerReference string, manifestDigest digest.Digest, timestamp time.Time) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"critical": map[string]any{
+			"type":     sigstoreSignatureType,
+			"image":    map[string]string{"docker-manifest-digest": manifestDigest.String()},
+			"identity": map[string]string{"docker-reference": dockerReference},
+		},
+		"optional": map[string]any{
+			"creator":   sigstoreSignatureCreator,
+			"timestamp": timestamp.Unix(),
+		},
+	})
+}
+
+// SignManifest signs manifestDigest as the image named dockerReference.
+func SignManifest(ctx context.Context, signer ImageSigner, dockerReference string, manifestDigest digest.Digest) (*SigstoreSignature, error) {
+	payload, err := NewSigstorePayload(dockerReference, manifestDigest, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signer.Sign(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &SigstoreSignature{Payload: payload, Signature: sig}, nil
+}
+
+// sigstoreIdentity returns the docker-reference identity claimed by a sigstore payload, or ""
+// if the payload can't be parsed.
+func sigstoreIdentity(payload []byte) string {
+	var p struct {
+		Critical struct {
+			Identity struct {
+				DockerReference string `json:"docker-reference"`
+			} `json:"identity"`
+		} `json:"critical"`
+	}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return ""
+	}
+	return p.Critical.Identity.DockerReference
+}
+
+// signedWith reports whether the signature of a sigstore attachment layer verifies with
+// publicKey. Signatures are made over the SHA-256 digest of the payload, which is the layer digest.
+func signedWith(publicKey crypto.PublicKey, layer imgspecv1.Descriptor) bool {
+	if layer.MediaType != sigstoreSignatureMIMEType || layer.Digest.Algorithm() != digest.SHA256 {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(layer.Annotations[sigstoreSignatureAnnotationKey])
+	if err != nil {
+		return false
+	}
+	sum, err := hex.DecodeString(layer.Digest.Encoded())
+	if err != nil {
+		return false
+	}
+	switch k := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, sum, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum, sig) == nil
+	default:
+		return false
+	}
+}
+
+// SigstoreAttachmentTag returns the tag cosign stores the signatures of manifestDigest under.
+func SigstoreAttachmentTag(manifestDigest digest.Digest) string {
+	return ReferrersTagPrefix(manifestDigest) + ".sig"
+}
+
+// signImage signs the destination manifest and attaches the signature to the destination
+// repository, next to the signatures it already has. It returns the attachment tag.
+func signImage(ctx context.Context, signer ImageSigner, destRef types.ImageReference, destCtx *types.SystemContext, manifestDigest digest.Digest) (string, error) {
+	if destRef.Transport().Name() != docker.Transport.Name() {
+		logger.WithField(LOG_PHASE, PHASE_SIGN).Info("Skipping signing: only supported for docker registries")
+		return "", nil
+	}
+	named := destRef.DockerReference()
+	sig, err := SignManifest(ctx, signer, named.String(), manifestDigest)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := signer.PublicKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	tag := SigstoreAttachmentTag(manifestDigest)
+	b, _, err := getTaggedManifest(ctx, destCtx, reference.TrimNamed(named), tag)
+	if err != nil {
+		return "", fmt.Errorf("error reading tag %s of %s: %w", tag, reference.TrimNamed(named), err)
+	}
+	exists := b != nil
+	tagged, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return "", err
+	}
+	sigRef, err := docker.NewReference(tagged)
+	if err != nil {
+		return "", err
+	}
+	if err := putSigstoreAttachment(ctx, destCtx, sigRef, exists, sig, publicKey); err != nil {
+		return "", fmt.Errorf("error attaching signature to %s: %w", tagged, err)
+	}
+	return tagged.String(), nil
+}
+
+// putSigstoreAttachment writes sig to the sigstore attachment manifest at ref, keeping the
+// signatures of the existing manifest if there is one. Existing signatures of publicKey with the
+// same identity as sig, left by earlier deployments, are replaced rather than piled up.
+func putSigstoreAttachment(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, exists bool, sig *SigstoreSignature, publicKey crypto.PublicKey) error {
+	ociManifest := manifest.OCI1FromComponents(imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig}, nil)
+	ociConfig := imgspecv1.Image{}
+	ociConfig.RootFS.Type = "layers"
+	if exists {
+		var payloads map[digest.Digest][]byte
+		var err error
+		ociManifest, ociConfig, payloads, err = getSigstoreAttachment(ctx, sys, ref, publicKey)
+		if err != nil {
+			return err
+		}
+		identity := sigstoreIdentity(sig.Payload)
+		layers := []imgspecv1.Descriptor{}
+		diffIDs := []digest.Digest{}
+		for i, layer := range ociManifest.Layers {
+			// Payloads are found by digest, so a layer of another key with the same payload is kept.
+			if payload, ok := payloads[layer.Digest]; ok && signedWith(publicKey, layer) && sigstoreIdentity(payload) == identity {
+				logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_SIGN, "identity": identity, "layer": layer.Digest}).Info("Replacing the earlier signature of the same key and identity")
+				continue
+			}
+			layers = append(layers, layer)
+			if i < len(ociConfig.RootFS.DiffIDs) {
+				diffIDs = append(diffIDs, ociConfig.RootFS.DiffIDs[i])
+			}
+		}
+		ociManifest.Layers = layers
+		ociConfig.RootFS.DiffIDs = diffIDs
+	}
+
+	dest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	layer := sig.LayerDescriptor()
+	if _, err := dest.PutBlob(ctx, bytes.NewReader(sig.Payload), types.BlobInfo{Digest: layer.Digest, Size: layer.Size, MediaType: layer.MediaType}, none.NoCache, false); err != nil {
+		return err
+	}
+	ociManifest.Layers = append(ociManifest.Layers, layer)
+	ociConfig.RootFS.DiffIDs = append(ociConfig.RootFS.DiffIDs, layer.Digest)
+
+	configBlob, err := json.Marshal(ociConfig)
+	if err != nil {
+		return err
+	}
+	configInfo, err := dest.PutBlob(ctx, bytes.NewReader(configBlob), types.BlobInfo{Digest: digest.FromBytes(configBlob), Size: int64(len(configBlob)), MediaType: imgspecv1.MediaTypeImageConfig}, none.NoCache, true)
+	if err != nil {
+		return err
+	}
+	ociManifest.Config = imgspecv1.Descriptor{MediaType: imgspecv1.MediaTypeImageConfig, Digest: configInfo.Digest, Size: configInfo.Size}
+
+	manifestBlob, err := ociManifest.Serialize()
+	if err != nil {
+		return err
+	}
+	if err := dest.PutManifest(ctx, manifestBlob, nil); err != nil {
+		return err
+	}
+	return dest.Commit(ctx, nil)
+}
+
+// getSigstoreAttachment reads the sigstore attachment manifest at ref and its config, with the
+// payloads of the signatures made by publicKey, by layer digest.
+func getSigstoreAttachment(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, publicKey crypto.PublicKey) (*manifest.OCI1, imgspecv1.Image, map[digest.Digest][]byte, error) {
+	ociConfig := imgspecv1.Image{}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, ociConfig, nil, err
+	}
+	defer src.Close()
+
+	b, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, ociConfig, nil, err
+	}
+	if mimeType != imgspecv1.MediaTypeImageManifest {
+		return nil, ociConfig, nil, fmt.Errorf("sigstore attachment is a %s, not an OCI image manifest", mimeType)
+	}
+	ociManifest, err := manifest.OCI1FromManifest(b)
+	if err != nil {
+		return nil, ociConfig, nil, err
+	}
+
+	configBlob, err := readBlob(ctx, src, ociManifest.Config, iolimits.MaxConfigBodySize)
+	if err != nil {
+		return nil, ociConfig, nil, err
+	}
+	if err := json.Unmarshal(configBlob, &ociConfig); err != nil {
+		return nil, ociConfig, nil, fmt.Errorf("error parsing sigstore attachment config: %v", err.Error())
+	}
+
+	payloads := map[digest.Digest][]byte{}
+	for _, layer := range ociManifest.Layers {
+		if !signedWith(publicKey, layer) {
+			continue
+		}
+		payload, err := readBlob(ctx, src, layer, iolimits.MaxSignatureBodySize)
+		if err != nil {
+			return nil, ociConfig, nil, err
+		}
+		// The signature covers the layer digest, so only a payload of that digest is the signed one.
+		if digest.FromBytes(payload) == layer.Digest {
+			payloads[layer.Digest] = payload
+		}
+	}
+	return ociManifest, ociConfig, payloads, nil
+}
+
+// readBlob reads the blob of desc from src, up to limit bytes.
+func readBlob(ctx context.Context, src types.ImageSource, desc imgspecv1.Descriptor, limit int) ([]byte, error) {
+	rc, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: desc.Digest, Size: desc.Size}, none.NoCache)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return iolimits.ReadAtMost(rc, limit)
+}
@@ -0,0 +1,278 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/oci/layout"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+)
+
+const signedDigest = digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+// fakeKMS signs with a local key, standing in for a KMS asymmetric key.
+type fakeKMS struct {
+	key      *FileSigner
+	keySpec  kmstypes.KeySpec
+	keyUsage kmstypes.KeyUsageType
+	signed   []*kms.SignInput
+}
+
+func (f *fakeKMS) GetPublicKey(ctx context.Context, params *kms.GetPublicKeyInput, optFns ...func(*kms.Options)) (*kms.GetPublicKeyOutput, error) {
+	der, err := x509.MarshalPKIXPublicKey(f.key.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GetPublicKeyOutput{KeyId: params.KeyId, KeySpec: f.keySpec, KeyUsage: f.keyUsage, PublicKey: der}, nil
+}
+
+func (f *fakeKMS) Sign(ctx context.Context, params *kms.SignInput, optFns ...func(*kms.Options)) (*kms.SignOutput, error) {
+	f.signed = append(f.signed, params)
+	sig, err := f.key.key.Sign(rand.Reader, params.Message, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: params.KeyId, Signature: sig}, nil
+}
+
+func generatePEMKey(t *testing.T, curve elliptic.Curve) []byte {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func verifySignature(t *testing.T, signer ImageSigner, payload []byte, sig []byte) {
+	publicKey, err := signer.PublicKey(context.TODO())
+	require.NoError(t, err)
+	sum := sha256.Sum256(payload)
+	switch k := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		assert.True(t, ecdsa.VerifyASN1(k, sum[:], sig))
+	case *rsa.PublicKey:
+		assert.NoError(t, rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig))
+	default:
+		t.Fatalf("unexpected public key type %T", publicKey)
+	}
+}
+
+func TestNewFileSigner(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr string
+	}{
+		{"PKCS #8 ECDSA", generatePEMKey(t, elliptic.P256()), ""},
+		{"SEC 1 ECDSA", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}), ""},
+		{"PKCS #1 RSA", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), ""},
+		{"P-384 ECDSA", generatePEMKey(t, elliptic.P384()), "only P-256"},
+		{"not PEM", []byte("not a key"), "no PEM block"},
+		{"invalid key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")}), "invalid signing key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewFileSigner(tt.pem)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			sig, err := signer.Sign(context.TODO(), []byte("payload"))
+			require.NoError(t, err)
+			verifySignature(t, signer, []byte("payload"), sig)
+		})
+	}
+}
+
+func TestGetImageSigner(t *testing.T) {
+	signer, err := GetImageSigner("")
+	assert.NoError(t, err)
+	assert.Nil(t, signer)
+
+	path := filepath.Join(t.TempDir(), "cosign.key")
+	require.NoError(t, os.WriteFile(path, generatePEMKey(t, elliptic.P256()), 0o600))
+	signer, err = GetImageSigner(FILE_SIGNING_KEY_PREFIX + path)
+	require.NoError(t, err)
+	assert.IsType(t, &FileSigner{}, signer)
+
+	_, err = GetImageSigner(FILE_SIGNING_KEY_PREFIX + filepath.Join(t.TempDir(), "missing.key"))
+	assert.ErrorContains(t, err, "error reading signing key")
+}
+
+func TestKMSSigner(t *testing.T) {
+	key, err := NewFileSigner(generatePEMKey(t, elliptic.P256()))
+	require.NoError(t, err)
+
+	client := &fakeKMS{key: key, keySpec: kmstypes.KeySpecEccNistP256, keyUsage: kmstypes.KeyUsageTypeSignVerify}
+	signer := NewKMSSigner(client, "alias/image-signing")
+	sig, err := signer.Sign(context.TODO(), []byte("payload"))
+	require.NoError(t, err)
+	verifySignature(t, signer, []byte("payload"), sig)
+	require.Len(t, client.signed, 1)
+	assert.Equal(t, kmstypes.MessageTypeDigest, client.signed[0].MessageType)
+	assert.Equal(t, kmstypes.SigningAlgorithmSpecEcdsaSha256, client.signed[0].SigningAlgorithm)
+
+	client = &fakeKMS{key: key, keySpec: kmstypes.KeySpecEccNistP384, keyUsage: kmstypes.KeyUsageTypeSignVerify}
+	_, err = NewKMSSigner(client, "alias/image-signing").Sign(context.TODO(), []byte("payload"))
+	assert.ErrorContains(t, err, "unsupported key spec")
+	assert.Empty(t, client.signed)
+
+	client = &fakeKMS{key: key, keySpec: kmstypes.KeySpecEccNistP256, keyUsage: kmstypes.KeyUsageTypeEncryptDecrypt}
+	_, err = NewKMSSigner(client, "alias/image-signing").Sign(context.TODO(), []byte("payload"))
+	assert.ErrorContains(t, err, "can't sign")
+}
+
+func TestSignManifest(t *testing.T) {
+	signer, err := NewFileSigner(generatePEMKey(t, elliptic.P256()))
+	require.NoError(t, err)
+
+	sig, err := SignManifest(context.TODO(), signer, "123456789012.dkr.ecr.us-west-2.amazonaws.com/app:v1", signedDigest)
+	require.NoError(t, err)
+	verifySignature(t, signer, sig.Payload, sig.Signature)
+
+	var payload struct {
+		Critical struct {
+			Identity map[string]string `json:"identity"`
+			Image    map[string]string `json:"image"`
+			Type     string            `json:"type"`
+		} `json:"critical"`
+	}
+	require.NoError(t, json.Unmarshal(sig.Payload, &payload))
+	assert.Equal(t, "cosign container image signature", payload.Critical.Type)
+	assert.Equal(t, signedDigest.String(), payload.Critical.Image["docker-manifest-digest"])
+	assert.Equal(t, "123456789012.dkr.ecr.us-west-2.amazonaws.com/app:v1", payload.Critical.Identity["docker-reference"])
+
+	layer := sig.LayerDescriptor()
+	assert.Equal(t, "application/vnd.dev.cosign.simplesigning.v1+json", layer.MediaType)
+	assert.Equal(t, digest.FromBytes(sig.Payload), layer.Digest)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sig.Signature), layer.Annotations["dev.cosignproject.cosign/signature"])
+}
+
+func TestPutSigstoreAttachment(t *testing.T) {
+	captureLogs(t)
+	signer, err := NewFileSigner(generatePEMKey(t, elliptic.P256()))
+	require.NoError(t, err)
+	publicKey, err := signer.PublicKey(context.TODO())
+	require.NoError(t, err)
+	other, err := NewFileSigner(generatePEMKey(t, elliptic.P256()))
+	require.NoError(t, err)
+	otherKey, err := other.PublicKey(context.TODO())
+	require.NoError(t, err)
+	ref, err := layout.ParseReference(t.TempDir() + ":" + SigstoreAttachmentTag(signedDigest))
+	require.NoError(t, err)
+	assert.Equal(t, "sha256-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.sig", SigstoreAttachmentTag(signedDigest))
+
+	first, err := SignManifest(context.TODO(), signer, "example.com/app:v1", signedDigest)
+	require.NoError(t, err)
+	require.NoError(t, putSigstoreAttachment(context.TODO(), nil, ref, false, first, publicKey))
+	second, err := SignManifest(context.TODO(), signer, "example.com/app:v2", signedDigest)
+	require.NoError(t, err)
+	require.NoError(t, putSigstoreAttachment(context.TODO(), nil, ref, true, second, publicKey))
+	foreign, err := SignManifest(context.TODO(), other, "example.com/app:v1", signedDigest)
+	require.NoError(t, err)
+	require.NoError(t, putSigstoreAttachment(context.TODO(), nil, ref, true, foreign, otherKey))
+
+	ociManifest, ociConfig, payloads, err := getSigstoreAttachment(context.TODO(), nil, ref, publicKey)
+	require.NoError(t, err)
+	require.Len(t, ociManifest.Layers, 3)
+	assert.Equal(t, first.LayerDescriptor(), ociManifest.Layers[0])
+	assert.Equal(t, second.LayerDescriptor(), ociManifest.Layers[1])
+	assert.Equal(t, foreign.LayerDescriptor(), ociManifest.Layers[2])
+	assert.Equal(t, "layers", ociConfig.RootFS.Type)
+	assert.Equal(t, []digest.Digest{ociManifest.Layers[0].Digest, ociManifest.Layers[1].Digest, ociManifest.Layers[2].Digest}, ociConfig.RootFS.DiffIDs)
+	// Only the payloads of the signatures of publicKey are read.
+	assert.Equal(t, map[digest.Digest][]byte{ociManifest.Layers[0].Digest: first.Payload, ociManifest.Layers[1].Digest: second.Payload}, payloads)
+
+	// Signing v1 again with the same key replaces its earlier signature, and keeps the others.
+	again, err := SignManifest(context.TODO(), signer, "example.com/app:v1", signedDigest)
+	require.NoError(t, err)
+	require.NoError(t, putSigstoreAttachment(context.TODO(), nil, ref, true, again, publicKey))
+	ociManifest, ociConfig, _, err = getSigstoreAttachment(context.TODO(), nil, ref, publicKey)
+	require.NoError(t, err)
+	require.Len(t, ociManifest.Layers, 3)
+	assert.Equal(t, second.LayerDescriptor(), ociManifest.Layers[0])
+	assert.Equal(t, foreign.LayerDescriptor(), ociManifest.Layers[1])
+	assert.Equal(t, again.LayerDescriptor(), ociManifest.Layers[2])
+	assert.Equal(t, []digest.Digest{ociManifest.Layers[0].Digest, ociManifest.Layers[1].Digest, ociManifest.Layers[2].Digest}, ociConfig.RootFS.DiffIDs)
+}
+
+func TestSignImage(t *testing.T) {
+	captureLogs(t)
+	registry, _, pushed := newPushRegistry(t, 0)
+	destRef, err := alltransports.ParseImageName("docker://" + strings.TrimPrefix(registry.URL, "https://") + "/app:v1")
+	require.NoError(t, err)
+	destCtx := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	signer, err := NewFileSigner(generatePEMKey(t, elliptic.P256()))
+	require.NoError(t, err)
+
+	// Redeploying the image replaces its signature rather than adding another one.
+	for range 2 {
+		tag, err := signImage(context.TODO(), signer, destRef, destCtx, signedDigest)
+		require.NoError(t, err)
+		assert.Equal(t, strings.TrimPrefix(registry.URL, "https://")+"/app:"+SigstoreAttachmentTag(signedDigest), tag)
+
+		ociManifest, err := manifest.OCI1FromManifest(pushed.manifests[SigstoreAttachmentTag(signedDigest)])
+		require.NoError(t, err)
+		require.Len(t, ociManifest.Layers, 1)
+		assert.True(t, signedWith(signer.key.Public(), ociManifest.Layers[0]))
+	}
+}
+
+func TestSignedWith(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaSigner := &FileSigner{key: rsaKey}
+	ecSigner, err := NewFileSigner(generatePEMKey(t, elliptic.P256()))
+	require.NoError(t, err)
+
+	for _, signer := range []*FileSigner{rsaSigner, ecSigner} {
+		sig, err := SignManifest(context.TODO(), signer, "example.com/app:v1", signedDigest)
+		require.NoError(t, err)
+		publicKey, err := signer.PublicKey(context.TODO())
+		require.NoError(t, err)
+		layer := sig.LayerDescriptor()
+		assert.True(t, signedWith(publicKey, layer))
+		assert.Equal(t, "example.com/app:v1", sigstoreIdentity(sig.Payload))
+
+		tampered := layer
+		tampered.Digest = digest.FromString("other payload")
+		assert.False(t, signedWith(publicKey, tampered))
+	}
+	ecKey, err := ecSigner.PublicKey(context.TODO())
+	require.NoError(t, err)
+	sig, err := SignManifest(context.TODO(), rsaSigner, "example.com/app:v1", signedDigest)
+	require.NoError(t, err)
+	assert.False(t, signedWith(ecKey, sig.LayerDescriptor()))
+	assert.Equal(t, "", sigstoreIdentity([]byte("not json")))
+}
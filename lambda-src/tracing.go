@@ -0,0 +1,209 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.podman.io/image/v5/types"
+)
+
+// TRACER_NAME is the instrumentation scope of the spans of the handler.
+const TRACER_NAME = "cdk-ecr-deployment-handler"
+
+// Environment variables of the tracing setup.
+const (
+	EnvTracesExporter    = "OTEL_TRACES_EXPORTER"        // otlp or none
+	EnvOTLPEndpoint      = "OTEL_EXPORTER_OTLP_ENDPOINT" // Selects otlp when OTEL_TRACES_EXPORTER is not set
+	EnvOTLPTraceEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	EnvXRayTraceHeader   = "_X_AMZN_TRACE_ID"
+)
+
+// xrayTraceHeader is the header the X-Ray propagator reads the trace of the invocation from.
+const xrayTraceHeader = "X-Amzn-Trace-Id"
+
+// Span names of the phases of a deployment.
+const (
+	SPAN_DEPLOY         = "Deploy"
+	SPAN_PARSE          = "ParseProperties"
+	SPAN_FETCH_SECRET   = "FetchSecret"
+	SPAN_ECR_LOGIN      = "ECRLogin"
+	SPAN_COPY_IMAGE     = "CopyImage"
+	SPAN_RESOLVE_SOURCE = "ResolveSourceManifest"
+	SPAN_RATE_LIMIT     = "CheckRateLimit"
+	SPAN_COPY_BLOB      = "CopyBlob"
+	SPAN_PUT_MANIFEST   = "PutManifest"
+)
+
+// tracerProvider is the provider set up from the environment, nil if tracing is disabled.
+var tracerProvider *sdktrace.TracerProvider
+
+// tracer returns the tracer of the handler. It is looked up on each use, so that tests can
+// replace the global provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// setupTracing sets the global tracer provider up from the environment. Spans are only
+// recorded when an exporter is configured. Their IDs follow the X-Ray format, so that the
+// AWS Distro for OpenTelemetry collector can export them to X-Ray.
+func setupTracing() error {
+	exporter, err := newSpanExporter(os.Getenv(EnvTracesExporter))
+	if err != nil || exporter == nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithIDGenerator(xray.NewIDGenerator()),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(xray.Propagator{})
+	return nil
+}
+
+// newSpanExporter returns the exporter named name, or the OTLP one if an OTLP endpoint is set.
+// It returns nil if tracing is disabled.
+func newSpanExporter(name string) (sdktrace.SpanExporter, error) {
+	if name == "" && (os.Getenv(EnvOTLPEndpoint) != "" || os.Getenv(EnvOTLPTraceEndpoint) != "") {
+		name = "otlp"
+	}
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		// The endpoint, headers and protocol options come from the OTEL_EXPORTER_OTLP_* variables.
+		return otlptracehttp.New(context.Background())
+	}
+	return nil, fmt.Errorf("unknown %v: %v, valid values are otlp and none", EnvTracesExporter, name)
+}
+
+// flushTraces exports the spans of the invocation before Lambda freezes the process.
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		logger.Warnf("error exporting traces: %v", err)
+	}
+}
+
+// endSpan ends span, with an error status if err is not nil. The message is redacted, as it
+// may quote registry URLs.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, RedactURI(err.Error()))
+	}
+	span.End()
+}
+
+// lambdaTraceContext returns ctx with the trace of the invocation as remote parent, taken from
+// the X-Ray trace header of the Lambda context or environment.
+func lambdaTraceContext(ctx context.Context) context.Context {
+	header, _ := ctx.Value("x-amzn-trace-id").(string)
+	if header == "" {
+		header = os.Getenv(EnvXRayTraceHeader)
+	}
+	if header == "" {
+		return ctx
+	}
+	return xray.Propagator{}.Extract(ctx, propagation.MapCarrier{xrayTraceHeader: header})
+}
+
+// blobSpans records a span for the copy of each blob, from the progress events of copy.Image.
+type blobSpans struct {
+	ctx   context.Context
+	mu    sync.Mutex
+	spans map[digest.Digest]trace.Span
+}
+
+func newBlobSpans(ctx context.Context) *blobSpans {
+	return &blobSpans{ctx: ctx, spans: map[digest.Digest]trace.Span{}}
+}
+
+// Report starts or ends the span of the blob of p.
+func (b *blobSpans) Report(p types.ProgressProperties) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := p.Artifact.Digest
+	switch p.Event {
+	case types.ProgressEventNewArtifact:
+		_, span := tracer().Start(b.ctx, SPAN_COPY_BLOB, trace.WithAttributes(
+			attribute.String("blob.digest", d.String()),
+			attribute.Int64("blob.size", p.Artifact.Size),
+		))
+		b.spans[d] = span
+	case types.ProgressEventDone:
+		if span, ok := b.spans[d]; ok {
+			span.SetAttributes(attribute.Int64("blob.bytes", int64(p.Offset)))
+			span.End()
+			delete(b.spans, d)
+		}
+	case types.ProgressEventSkipped:
+		// Blobs already present at the destination have no new artifact event.
+		_, span := tracer().Start(b.ctx, SPAN_COPY_BLOB, trace.WithAttributes(
+			attribute.String("blob.digest", d.String()),
+			attribute.Bool("blob.skipped", true),
+		))
+		span.End()
+	}
+}
+
+// End ends the spans of the blobs whose copy did not complete, as failed.
+func (b *blobSpans) End() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for d, span := range b.spans {
+		endSpan(span, fmt.Errorf("copy of blob %s did not complete", d))
+		delete(b.spans, d)
+	}
+}
+
+// manifestSpans records a span for each manifest written by copy.Image, from the lines of its
+// report: a manifest is written between the line announcing it and the next line, or the end
+// of the copy.
+type manifestSpans struct {
+	ctx  context.Context
+	mu   sync.Mutex
+	span trace.Span
+}
+
+func newManifestSpans(ctx context.Context) *manifestSpans {
+	return &manifestSpans{ctx: ctx}
+}
+
+func (m *manifestSpans) Line(line string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.span != nil {
+		m.span.End()
+		m.span = nil
+	}
+	if strings.HasPrefix(line, "Writing manifest") {
+		_, m.span = tracer().Start(m.ctx, SPAN_PUT_MANIFEST, trace.WithAttributes(attribute.Bool("manifest.list", strings.HasPrefix(line, "Writing manifest list"))))
+	}
+}
+
+// End ends the span of the manifest being written, with the error of the copy.
+func (m *manifestSpans) End(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.span != nil {
+		endSpan(m.span, err)
+		m.span = nil
+	}
+}
@@ -7,56 +7,156 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
+	"os"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"cdk-ecr-deployment-handler/internal/iolimits"
+	"cdk-ecr-deployment-handler/internal/tarfile"
+
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/ecr"
 	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	"github.com/aws/smithy-go"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/pkg/compression"
+	compressiontypes "go.podman.io/image/v5/pkg/compression/types"
 	"go.podman.io/image/v5/types"
 )
 
 const (
-	SRC_IMAGE          string = "SrcImage"
-	DEST_IMAGE         string = "DestImage"
-	IMAGE_ARCH         string = "ImageArch"
-	SRC_CREDS          string = "SrcCreds"
-	DEST_CREDS         string = "DestCreds"
-	COPY_IMAGE_INDEX   string = "CopyImageIndex"
-	ARCH_IMAGE_TAGS    string = "ArchImageTags"
-	RETRY_CONFIGS      string = "RetryConfigs"
-	ECRRateExceedError string = "toomanyrequests: Rate exceeded"
+	SRC_IMAGE              string = "SrcImage"
+	DEST_IMAGE             string = "DestImage"
+	IMAGE_ARCH             string = "ImageArch"
+	SRC_CREDS              string = "SrcCreds"
+	DEST_CREDS             string = "DestCreds"
+	COPY_IMAGE_INDEX       string = "CopyImageIndex"
+	ARCH_IMAGE_TAGS        string = "ArchImageTags"
+	RETRY_CONFIGS          string = "RetryConfigs"
+	MANIFEST_FORMAT        string = "ManifestFormat"
+	COMPRESSION_CONFIGS    string = "CompressionConfigs"
+	PRESERVE_DIGESTS       string = "PreserveDigests"
+	EXPECTED_SOURCE_DIGEST string = "ExpectedSourceDigest"
+	SIGNATURE_POLICY       string = "SignaturePolicy"
+	COPY_REFERRERS         string = "CopyReferrers"
+	SIGNING_KEY            string = "SigningKey"
+	SRC_ROLE_ARN           string = "SrcRoleArn"
+	SRC_EXTERNAL_ID        string = "SrcExternalId"
+	SRC_SESSION_NAME       string = "SrcSessionName"
+	DEST_ROLE_ARN          string = "DestRoleArn"
+	DEST_EXTERNAL_ID       string = "DestExternalId"
+	DEST_SESSION_NAME      string = "DestSessionName"
+	SRC_AUTH_CONFIG        string = "SrcAuthConfig"
+	DEST_AUTH_CONFIG       string = "DestAuthConfig"
+	SRC_REGISTRY_AUTH      string = "SrcRegistryAuth"
+	DEST_REGISTRY_AUTH     string = "DestRegistryAuth"
+	SRC_SECRET_CONFIGS     string = "SrcSecretConfigs"
+	DEST_SECRET_CONFIGS    string = "DestSecretConfigs"
+	PROGRESS_CONFIGS       string = "ProgressConfigs"
+	DOCKER_HUB_CONFIGS     string = "DockerHubConfigs"
+	PULL_THROUGH_CACHE     string = "PullThroughCacheConfigs"
+	ECRRateExceedError     string = "toomanyrequests: Rate exceeded"
+)
+
+// Keys of the custom resource response data.
+const (
+	SRC_DIGEST       string = "SrcDigest"
+	DEST_DIGEST      string = "DestDigest"
+	DIGESTS_MATCH    string = "DigestsMatch"
+	REFERRERS_COPIED string = "ReferrersCopied"
+	SIGNATURE_TAG    string = "SignatureTag"
 )
 
 type ECRAuth struct {
 	Token         string
 	User          string
 	Pass          string
+	BearerToken   string // Sent as-is instead of User and Pass if set
 	ProxyEndpoint string
 	ExpiresAt     time.Time
 }
 
+// Compression configuration for the layers written to the destination. When no format is
+// set, layers keep the compression used by the source.
+type CompressionConfigs struct {
+	Format          *string `json:"format,omitempty"`          // The compression algorithm for destination layers: "gzip", "zstd" or "zstd:chunked"
+	Level           *int    `json:"level,omitempty"`           // The compression level passed to the algorithm
+	ForceRecompress *bool   `json:"forceRecompress,omitempty"` // Whether to recompress layers that are already compressed with a different algorithm
+}
+
 // Retriable configuration in the case the lambda function encounters any "retriable error" (i.e. rate limit exceeded).
 type RetryConfigs struct {
 	NumAttempts *int     `json:"numAttempts,omitempty"` // The maximum number of attempts to retry
 	BaseDelay   *float64 `json:"baseDelay,omitempty"`   // The base duration for the delay/sleep time in between each attempt (in seconds)
 	MaxDelay    *float64 `json:"maxDelay,omitempty"`    // The maimum duration for the delay/sleep time in between each attempt (in seconds)
+	// Whether each category of transient errors is retried, by ErrorCategory; all of them are by default
+	RetryableErrors map[string]bool `json:"retryableErrors,omitempty"`
+}
+
+// Secret configuration of the SrcCreds or DestCreds secret: the version to read, and the JSON
+// keys of the credentials. A secret holding only a token is sent as a bearer token.
+type SecretConfigs struct {
+	UsernameKey  *string `json:"usernameKey,omitempty"`  // The JSON key of the username, `username` by default
+	PasswordKey  *string `json:"passwordKey,omitempty"`  // The JSON key of the password, `password` by default
+	TokenKey     *string `json:"tokenKey,omitempty"`     // The JSON key of a bearer token, `token` by default
+	VersionStage *string `json:"versionStage,omitempty"` // The staging label of the version to read, `AWSCURRENT` by default
+	VersionId    *string `json:"versionId,omitempty"`    // The ID of the version to read, instead of a staging label
+}
+
+// ecrRegistryRegexp matches private ECR registry hostnames: `<account>.dkr.ecr.<region>.<domain>`,
+// their FIPS variant `dkr.ecr-fips` and the dual-stack `dkr-ecr[-fips].<region>.on.aws` ones.
+var ecrRegistryRegexp = regexp.MustCompile(`^([0-9]+)\.dkr([.-])ecr(-fips)?\.([a-z0-9-]+)\.(amazonaws\.com|amazonaws\.com\.cn|on\.aws|c2s\.ic\.gov|sc2s\.sgov\.gov)$`)
+
+// ECRRegistry is a private ECR registry, identified by its hostname.
+type ECRRegistry struct {
+	Host      string
+	AccountID string
+	Region    string
+	FIPS      bool // Whether the host is a FIPS endpoint
+	DualStack bool // Whether the host is a dual-stack (IPv4 and IPv6) endpoint
+}
+
+// ParseECRRegistry parses the registry of an image URI such as `docker://<host>/<repo>:<tag>`,
+// or a registry URL such as an ECR proxy endpoint. It returns false if it is not private ECR.
+func ParseECRRegistry(uri string) (*ECRRegistry, bool) {
+	host := uri
+	if _, rest, ok := strings.Cut(host, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	host = strings.ToLower(host)
+	m := ecrRegistryRegexp.FindStringSubmatch(host)
+	if m == nil {
+		return nil, false
+	}
+	return &ECRRegistry{
+		Host:      host,
+		AccountID: m[1],
+		Region:    m[4],
+		FIPS:      m[3] != "",
+		DualStack: m[2] == "-",
+	}, true
 }
 
 func GetECRRegion(uri string) string {
-	re := regexp.MustCompile(`dkr\.ecr\.(.+?)\.`)
-	m := re.FindStringSubmatch(uri)
-	if m != nil {
-		return m[1]
+	if registry, ok := ParseECRRegistry(uri); ok {
+		return registry.Region
 	}
 	return "us-east-1"
 }
@@ -79,82 +179,246 @@ func newECRAuth(encodedToken string, expiresAt time.Time) (*ECRAuth, error) {
 	}, nil
 }
 
-func GetECRLogin(region string) ([]ECRAuth, error) {
+// DEFAULT_SESSION_NAME is the session name of assumed roles when none is configured.
+const DEFAULT_SESSION_NAME = "cdk-ecr-deployment"
+
+var sessionNameRegexp = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// AssumeRoleConfigs is the role assumed to log into ECR on one side of the copy, for
+// registries in another account that don't trust the Lambda role.
+type AssumeRoleConfigs struct {
+	RoleArn     string
+	ExternalId  string // Optional external ID required by the role trust policy
+	SessionName string
+}
+
+// NewAssumeRoleConfigs validates the role properties of one side. An empty roleArn returns
+// nil, meaning the Lambda's own credentials are used.
+func NewAssumeRoleConfigs(roleArn string, externalId string, sessionName string) (*AssumeRoleConfigs, error) {
+	if roleArn == "" {
+		if externalId != "" || sessionName != "" {
+			return nil, fmt.Errorf("external ID and session name require a role ARN")
+		}
+		return nil, nil
+	}
+	a, err := arn.Parse(roleArn)
+	if err != nil || a.Service != "iam" || !strings.HasPrefix(a.Resource, "role/") {
+		return nil, fmt.Errorf("invalid role ARN: %s", roleArn)
+	}
+	if sessionName == "" {
+		sessionName = DEFAULT_SESSION_NAME
+	}
+	if !sessionNameRegexp.MatchString(sessionName) {
+		return nil, fmt.Errorf("invalid session name %q: expected 2 to 64 letters, digits or characters of _+=,.@-", sessionName)
+	}
+	return &AssumeRoleConfigs{
+		RoleArn:     roleArn,
+		ExternalId:  externalId,
+		SessionName: sessionName,
+	}, nil
+}
+
+// newAssumeRoleProvider returns credentials of role, assumed with client.
+func newAssumeRoleProvider(client stscreds.AssumeRoleAPIClient, role *AssumeRoleConfigs) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(client, role.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = role.SessionName
+		if role.ExternalId != "" {
+			o.ExternalID = aws.String(role.ExternalId)
+		}
+	}))
+}
+
+// ecrAPI is the subset of the ECR client used to log into private registries.
+type ecrAPI interface {
+	GetAuthorizationToken(ctx context.Context, params *ecr.GetAuthorizationTokenInput, optFns ...func(*ecr.Options)) (*ecr.GetAuthorizationTokenOutput, error)
+}
+
+// ecrPublicAPI is the subset of the ECR Public client used to log into public.ecr.aws.
+type ecrPublicAPI interface {
+	GetAuthorizationToken(ctx context.Context, params *ecrpublic.GetAuthorizationTokenInput, optFns ...func(*ecrpublic.Options)) (*ecrpublic.GetAuthorizationTokenOutput, error)
+}
+
+// AWSClients creates the AWS API clients used to log into ECR and report progress, so that
+// tests can replace them with fakes.
+type AWSClients struct {
+	NewECR       func(cfg aws.Config) ecrAPI
+	NewECRPublic func(cfg aws.Config) ecrPublicAPI
+	NewSTS       func(cfg aws.Config) stscreds.AssumeRoleAPIClient
+	// The clients of the progress sinks.
+	NewSNS         func(cfg aws.Config) snsAPI
+	NewEventBridge func(cfg aws.Config) eventBridgeAPI
+}
+
+var defaultAWSClients = &AWSClients{
+	NewECR:         func(cfg aws.Config) ecrAPI { return ecr.NewFromConfig(cfg) },
+	NewECRPublic:   func(cfg aws.Config) ecrPublicAPI { return ecrpublic.NewFromConfig(cfg) },
+	NewSTS:         func(cfg aws.Config) stscreds.AssumeRoleAPIClient { return sts.NewFromConfig(cfg) },
+	NewSNS:         func(cfg aws.Config) snsAPI { return sns.NewFromConfig(cfg) },
+	NewEventBridge: func(cfg aws.Config) eventBridgeAPI { return eventbridge.NewFromConfig(cfg) },
+}
+
+// LoadConfig loads the default config for region, with the credentials of role if it is set.
+func (c *AWSClients) LoadConfig(region string, role *AssumeRoleConfigs, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
 	cfg, err := config.LoadDefaultConfig(
 		context.TODO(),
-		config.WithRegion(region),
+		append([]func(*config.LoadOptions) error{config.WithRegion(region)}, optFns...)...,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+		return cfg, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	if role != nil {
+		logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_AUTH, "roleArn": role.RoleArn, "sessionName": role.SessionName}).Info("Assuming role")
+		cfg.Credentials = newAssumeRoleProvider(c.NewSTS(cfg), role)
+	}
+	return cfg, nil
+}
+
+// GetECRLogin returns the authorization tokens of registry, requested as role if it is set.
+// The ECR API is called in region, through the same kind of endpoint (FIPS, dual-stack) as
+// the registry.
+func (c *AWSClients) GetECRLogin(ctx context.Context, registry *ECRRegistry, region string, role *AssumeRoleConfigs) ([]ECRAuth, error) {
+	optFns := []func(*config.LoadOptions) error{}
+	if registry.FIPS {
+		optFns = append(optFns, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	if registry.DualStack {
+		optFns = append(optFns, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	cfg, err := c.LoadConfig(region, role, optFns...)
+	if err != nil {
+		return nil, err
 	}
 
-	resp, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(context.TODO(), &ecr.GetAuthorizationTokenInput{})
+	resp, err := c.NewECR(cfg).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []string{registry.AccountID},
+	})
 	if err != nil {
 		return nil, fmt.Errorf("error login into ECR: %v", err.Error())
 	}
 
 	auths := make([]ECRAuth, len(resp.AuthorizationData))
 	for i, auth := range resp.AuthorizationData {
-		a, err := newECRAuth(*auth.AuthorizationToken, *auth.ExpiresAt)
+		a, err := newECRAuth(aws.ToString(auth.AuthorizationToken), aws.ToTime(auth.ExpiresAt))
 		if err != nil {
 			return nil, err
 		}
-		a.ProxyEndpoint = *auth.ProxyEndpoint
+		a.ProxyEndpoint = aws.ToString(auth.ProxyEndpoint)
 		auths[i] = *a
 	}
 	return auths, nil
 }
 
+// SelectECRAuth returns the token whose proxy endpoint is registry. Tokens are valid for
+// every endpoint of a registry, so the FIPS and dual-stack variants of the host match too.
+func SelectECRAuth(auths []ECRAuth, registry *ECRRegistry) (*ECRAuth, error) {
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("empty ECR login auth token list")
+	}
+	for i := range auths {
+		endpoint, ok := ParseECRRegistry(auths[i].ProxyEndpoint)
+		if ok && endpoint.AccountID == registry.AccountID && endpoint.Region == registry.Region {
+			return &auths[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no ECR auth token for registry %s", registry.Host)
+}
+
 // GetECRPublicLogin authenticates to public ECR (public.ecr.aws).
 // Public ECR auth must always target us-east-1.
 // See https://docs.aws.amazon.com/AmazonECR/latest/public/public-registry-auth.html
-func GetECRPublicLogin() (*ECRAuth, error) {
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithRegion("us-east-1"),
-	)
+func (c *AWSClients) GetECRPublicLogin(ctx context.Context, role *AssumeRoleConfigs) (*ECRAuth, error) {
+	cfg, err := c.LoadConfig("us-east-1", role)
 	if err != nil {
-		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+		return nil, err
 	}
 
-	resp, err := ecrpublic.NewFromConfig(cfg).GetAuthorizationToken(context.TODO(), &ecrpublic.GetAuthorizationTokenInput{})
+	resp, err := c.NewECRPublic(cfg).GetAuthorizationToken(ctx, &ecrpublic.GetAuthorizationTokenInput{})
 	if err != nil {
 		return nil, fmt.Errorf("error logging into ECR Public: %v", err.Error())
 	}
+	if resp.AuthorizationData == nil {
+		return nil, fmt.Errorf("error logging into ECR Public: empty auth token")
+	}
 
-	return newECRAuth(*resp.AuthorizationData.AuthorizationToken, *resp.AuthorizationData.ExpiresAt)
+	return newECRAuth(aws.ToString(resp.AuthorizationData.AuthorizationToken), aws.ToTime(resp.AuthorizationData.ExpiresAt))
 }
 
 type ImageOpts struct {
-	uri                   string
-	requireECRLogin       bool
-	requireECRPublicLogin bool
-	region                string
-	creds                 string
-	arch                  string
-	copyImageIndex        bool
+	uri            string
+	region         string // Region of the ECR API, empty if the image isn't in ECR
+	creds          RegistryAuthenticator
+	arch           string
+	copyImageIndex bool
+	compression    *CompressionConfigs
+	role           *AssumeRoleConfigs
+	authConfig     []byte                  // docker config.json-style document, nil if not set
+	authConfigAuth *types.DockerAuthConfig // Entry of authConfig for the image, looked up on first use
+	authenticators *AuthenticatorRegistry  // Native authenticators of non-AWS registries, nil if not set
+	clients        *AWSClients
+	ctx            context.Context // Context of the registry logins, background if not set
 }
 
 func NewImageOpts(uri string, arch string, copyImageIndex bool) *ImageOpts {
-	requireECRLogin := strings.Contains(uri, "dkr.ecr")
-	requireECRPublicLogin := strings.Contains(uri, "public.ecr.aws")
-	if requireECRLogin {
-		return &ImageOpts{uri, requireECRLogin, false, GetECRRegion(uri), "", arch, copyImageIndex}
-	} else if requireECRPublicLogin {
-		return &ImageOpts{uri, false, requireECRPublicLogin, "us-east-1", "", arch, copyImageIndex}
-	} else {
-		return &ImageOpts{uri, false, false, "", "", arch, copyImageIndex}
+	opts := &ImageOpts{uri: uri, arch: arch, copyImageIndex: copyImageIndex, clients: defaultAWSClients}
+	host := registryHost(uri)
+	if registry, ok := ParseECRRegistry(host); ok {
+		opts.region = registry.Region
+	} else if host == ECR_PUBLIC_REGISTRY {
+		opts.region = "us-east-1"
 	}
+	return opts
 }
 
 func (s *ImageOpts) SetRegion(region string) {
 	s.region = region
 }
 
-func (s *ImageOpts) SetCreds(creds string) {
+// SetCreds sets the credentials of the registry, which take precedence over any other login.
+func (s *ImageOpts) SetCreds(creds RegistryAuthenticator) {
 	s.creds = creds
 }
 
+func (s *ImageOpts) SetCompression(compression *CompressionConfigs) {
+	s.compression = compression
+}
+
+func (s *ImageOpts) SetRole(role *AssumeRoleConfigs) {
+	s.role = role
+}
+
+func (s *ImageOpts) SetAuthConfig(authConfig []byte) {
+	s.authConfig = authConfig
+	s.authConfigAuth = nil
+}
+
+// authConfigEntry returns the credentials of the auth config for the registry of the image, or
+// nil if there is no auth config or it has no entry for that registry.
+func (s *ImageOpts) authConfigEntry() (*types.DockerAuthConfig, error) {
+	if s.authConfig == nil {
+		return nil, nil
+	}
+	if s.authConfigAuth == nil {
+		auth, err := LookupAuthConfig(s.authConfig, s.uri)
+		if err != nil {
+			return nil, err
+		}
+		s.authConfigAuth = auth
+	}
+	if *s.authConfigAuth == (types.DockerAuthConfig{}) {
+		return nil, nil
+	}
+	return s.authConfigAuth, nil
+}
+
+func (s *ImageOpts) SetAuthenticators(authenticators *AuthenticatorRegistry) {
+	s.authenticators = authenticators
+}
+
+// SetContext sets the context of the registry logins, which carries their trace.
+func (s *ImageOpts) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
 func GetArchChoice(arch string, copyImageIndex bool) string {
 	if !copyImageIndex {
 		return arch
@@ -167,48 +431,112 @@ func (s *ImageOpts) NewSystemContext() (*types.SystemContext, error) {
 		DockerRegistryUserAgent: "ecr-deployment",
 		DockerAuthConfig:        &types.DockerAuthConfig{},
 		ArchitectureChoice:      GetArchChoice(s.arch, s.copyImageIndex),
+		// The default /var/tmp is read-only in Lambda.
+		BigFilesTemporaryDir: os.TempDir(),
 	}
 
-	if s.creds != "" {
-		log.Printf("Credentials login mode for %v", s.uri)
+	if s.compression != nil && s.compression.Format != nil {
+		algo, err := compression.AlgorithmByName(*s.compression.Format)
+		if err != nil {
+			return nil, err
+		}
+		ctx.CompressionFormat = &algo
+		ctx.CompressionLevel = s.compression.Level
+	}
 
-		token := strings.SplitN(s.creds, ":", 2)
-		ctx.DockerAuthConfig = &types.DockerAuthConfig{
-			Username: token[0],
+	authLog := logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_AUTH, "uri": RedactURI(s.uri)})
+	if s.creds == nil && s.authConfig != nil {
+		auth, err := s.authConfigEntry()
+		if err != nil {
+			return nil, err
 		}
-		if len(token) == 2 {
-			ctx.DockerAuthConfig.Password = token[1]
+		if auth != nil {
+			authLog.Info("Auth config login mode")
+			ctx.DockerAuthConfig = auth
+			return ctx, nil
 		}
+		authLog.Info("No auth config entry, falling back to the other logins")
+	}
+
+	_, authenticator := s.authenticator()
+	switch authenticator.(type) {
+	case *StaticAuthenticator, *SecretAuthenticator:
+		authLog.Info("Credentials login mode")
+	case *ECRAuthenticator:
+		authLog.Info("ECR auto login mode")
+	case *ECRPublicAuthenticator:
+		authLog.Info("ECR Public auto login mode")
+	case nil:
+	default:
+		authLog.Info("Registry authenticator login mode")
+	}
+	if err := s.RefreshAuth(ctx, false); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// authenticator returns the registry host of the image and the authenticator logging into
+// it, or a nil authenticator for anonymous access or an auth config entry. Credentials come
+// first, then the auth config, then the native authenticators, then ECR auto login.
+func (s *ImageOpts) authenticator() (string, RegistryAuthenticator) {
+	host := registryHost(s.uri)
+	if s.creds != nil {
+		return host, s.creds
+	}
+	if host == "" {
+		return host, nil
+	}
+	// A document that can't be read fails NewSystemContext before any login.
+	if auth, err := s.authConfigEntry(); auth != nil || err != nil {
+		return host, nil
+	}
+	if authenticator := s.authenticators.Lookup(host); authenticator != nil {
+		return host, authenticator
+	}
+	return host, NewAWSAuthenticatorRegistry(s.region, s.role, s.clients).Lookup(host)
+}
+
+// RefreshAuth sets the registry credentials of ctx. Tokens come from the cache, which fetches
+// a new one when it is about to expire. force drops the cached token first, for tokens the
+// registry rejected.
+func (s *ImageOpts) RefreshAuth(ctx *types.SystemContext, force bool) error {
+	host, authenticator := s.authenticator()
+	if authenticator == nil {
+		return nil
+	}
+	authCtx := s.ctx
+	if authCtx == nil {
+		authCtx = context.Background()
+	}
+	fetch := func() (*ECRAuth, error) {
+		return authenticator.Authenticate(authCtx, host)
+	}
+
+	var auth *ECRAuth
+	var err error
+	if key := authenticator.CacheKey(host); key == "" {
+		auth, err = fetch()
 	} else {
-		if s.requireECRLogin {
-			log.Printf("ECR auto login mode for %v", s.uri)
-
-			auths, err := GetECRLogin(s.region)
-			if err != nil {
-				return nil, err
-			}
-			if len(auths) == 0 {
-				return nil, fmt.Errorf("empty ECR login auth token list")
-			}
-			auth0 := auths[0]
-			ctx.DockerAuthConfig = &types.DockerAuthConfig{
-				Username: auth0.User,
-				Password: auth0.Pass,
-			}
-		} else if s.requireECRPublicLogin {
-			log.Printf("ECR Public auto login mode for %v", s.uri)
-
-			auth, err := GetECRPublicLogin()
-			if err != nil {
-				return nil, err
-			}
-			ctx.DockerAuthConfig = &types.DockerAuthConfig{
-				Username: auth.User,
-				Password: auth.Pass,
-			}
+		if force {
+			ecrAuthCache.Invalidate(key)
 		}
+		auth, err = ecrAuthCache.Get(key, fetch)
 	}
-	return ctx, nil
+	if err != nil {
+		return err
+	}
+	if auth.BearerToken != "" {
+		ctx.DockerAuthConfig = &types.DockerAuthConfig{}
+		ctx.DockerBearerRegistryToken = auth.BearerToken
+		return nil
+	}
+	ctx.DockerAuthConfig = &types.DockerAuthConfig{
+		Username: auth.User,
+		Password: auth.Pass,
+	}
+	ctx.DockerBearerRegistryToken = ""
+	return nil
 }
 
 func Dumps(v interface{}) string {
@@ -219,14 +547,21 @@ func Dumps(v interface{}) string {
 	return string(bytes)
 }
 
+const SSM_PREFIX = "ssm:"
+
 const (
-	SECRET_ARN  = "SECRET_ARN"
-	SECRET_NAME = "SECRET_NAME"
-	SECRET_TEXT = "SECRET_TEXT"
+	SECRET_ARN    = "SECRET_ARN"
+	SECRET_NAME   = "SECRET_NAME"
+	SECRET_TEXT   = "SECRET_TEXT"
+	SSM_PARAMETER = "SSM_PARAMETER"
 )
 
+// GetCredsType classifies the SrcCreds or DestCreds property. SSM parameter references
+// (`ssm:<name>` or parameter ARN) are checked first, so literal creds can't use `ssm` as user.
 func GetCredsType(s string) string {
-	if strings.HasPrefix(s, "arn:aws") {
+	if IsSSMParameterRef(s) {
+		return SSM_PARAMETER
+	} else if strings.HasPrefix(s, "arn:aws") {
 		return SECRET_ARN
 	} else if strings.Contains(s, ":") {
 		return SECRET_TEXT
@@ -236,39 +571,213 @@ func GetCredsType(s string) string {
 }
 
 func ParseJsonSecret(s string) (secret string, err error) {
+	auth, err := parseJsonCreds(s, &SecretConfigs{TokenKey: aws.String("")})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", auth.User, auth.Pass), nil
+}
+
+// ParseSecretCreds parses the credentials of a secret: `user:pass` text, or a JSON object with
+// either a username and password or only a token, under the keys configured in sc.
+func ParseSecretCreds(s string, sc *SecretConfigs) (*ECRAuth, error) {
+	if !json.Valid([]byte(s)) {
+		user, pass, _ := strings.Cut(s, ":")
+		return &ECRAuth{User: user, Pass: pass}, nil
+	}
+	return parseJsonCreds(s, sc)
+}
+
+func parseJsonCreds(s string, sc *SecretConfigs) (*ECRAuth, error) {
 	var jsonData map[string]interface{}
 	jsonErr := json.Unmarshal([]byte(s), &jsonData)
 	if jsonErr != nil {
-		return "", fmt.Errorf("error parsing json secret: %v", jsonErr.Error())
+		return nil, fmt.Errorf("error parsing json secret: %v", jsonErr.Error())
+	}
+	if sc == nil {
+		sc = &SecretConfigs{}
+	}
+	usernameKey, passwordKey, tokenKey := sc.keys()
+
+	if _, ok := jsonData[usernameKey]; !ok && tokenKey != "" {
+		if token, ok := jsonData[tokenKey].(string); ok {
+			return &ECRAuth{BearerToken: token}, nil
+		}
 	}
-	username, ok := jsonData["username"].(string)
+	username, ok := jsonData[usernameKey].(string)
 	if !ok {
-		return "", fmt.Errorf("error parsing username from json secret")
+		return nil, fmt.Errorf("error parsing username from json secret")
 	}
-	password, ok := jsonData["password"].(string)
+	password, ok := jsonData[passwordKey].(string)
 	if !ok {
-		return "", fmt.Errorf("error parsing password from json secret")
+		return nil, fmt.Errorf("error parsing password from json secret")
+	}
+	return &ECRAuth{User: username, Pass: password}, nil
+}
+
+// keys returns the JSON keys of the username, password and token. An empty token key disables
+// token-only secrets.
+func (sc *SecretConfigs) keys() (string, string, string) {
+	usernameKey, passwordKey, tokenKey := "username", "password", "token"
+	if sc.UsernameKey != nil {
+		usernameKey = *sc.UsernameKey
+	}
+	if sc.PasswordKey != nil {
+		passwordKey = *sc.PasswordKey
+	}
+	if sc.TokenKey != nil {
+		tokenKey = *sc.TokenKey
+	}
+	return usernameKey, passwordKey, tokenKey
+}
+
+// Helper function to parse the specified secret configuration in the form of JSON data into a
+// SecretConfigs object
+func GetSecretConfigs(data string) (*SecretConfigs, error) {
+	config := SecretConfigs{}
+
+	if data != "" {
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("unable to parse secret configuration %v with error: %v", data, err)
+		}
 	}
-	return fmt.Sprintf("%s:%s", username, password), nil
+	if err := config.ValidateFields(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Helper function for SecretConfigs to validate the keys and the version selection.
+func (sc *SecretConfigs) ValidateFields() error {
+	if sc.VersionStage != nil && sc.VersionId != nil {
+		return fmt.Errorf("versionStage and versionId can't be both set")
+	}
+	if (sc.UsernameKey != nil && *sc.UsernameKey == "") || (sc.PasswordKey != nil && *sc.PasswordKey == "") {
+		return fmt.Errorf("usernameKey and passwordKey can't be empty")
+	}
+	return nil
 }
 
 func GetSecret(secretId string) (secret string, err error) {
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-	)
-	log.Printf("get secret id: %s of region: %s", secretId, cfg.Region)
+	return GetSecretVersion(secretId, nil)
+}
+
+// GetSecretVersion reads the version of a secret selected by sc, the current one if sc is nil.
+// Secrets referenced by ARN are read from the ARN's region, and binary secrets are returned
+// as text.
+func GetSecretVersion(secretId string, sc *SecretConfigs) (secret string, err error) {
+	opts := []func(*config.LoadOptions) error{}
+	if a, err := arn.Parse(secretId); err == nil {
+		opts = append(opts, config.WithRegion(a.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
 		return "", fmt.Errorf("api client configuration error: %v", err.Error())
 	}
+	logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_AUTH, "secretId": secretId, "region": cfg.Region}).Info("Getting secret")
 
-	client := secretsmanager.NewFromConfig(cfg)
-	resp, err := client.GetSecretValue(context.TODO(), &secretsmanager.GetSecretValueInput{
+	input := &secretsmanager.GetSecretValueInput{
 		SecretId: aws.String(secretId),
-	})
+	}
+	if sc != nil {
+		input.VersionStage = sc.VersionStage
+		input.VersionId = sc.VersionId
+	}
+	client := secretsmanager.NewFromConfig(cfg)
+	resp, err := client.GetSecretValue(context.TODO(), input)
 	if err != nil {
 		return "", fmt.Errorf("fetch secret value error: %v", err.Error())
 	}
-	return *resp.SecretString, nil
+	return secretValue(resp)
+}
+
+// secretValue returns the string or binary value of a secret.
+func secretValue(resp *secretsmanager.GetSecretValueOutput) (string, error) {
+	if resp.SecretString != nil {
+		return *resp.SecretString, nil
+	}
+	if resp.SecretBinary != nil {
+		return string(resp.SecretBinary), nil
+	}
+	return "", fmt.Errorf("fetch secret value error: secret has no value")
+}
+
+// IsSSMParameterRef checks whether s references an SSM parameter, either as `ssm:<name>` or as a parameter ARN.
+func IsSSMParameterRef(s string) bool {
+	if strings.HasPrefix(s, SSM_PREFIX) {
+		return true
+	}
+	a, err := arn.Parse(s)
+	return err == nil && a.Service == "ssm"
+}
+
+// GetSSMParameter fetches and decrypts the value of an SSM parameter referenced as
+// `ssm:<name>` or by ARN. Parameters referenced by ARN are read from the ARN's region.
+func GetSSMParameter(ref string) (string, error) {
+	name := strings.TrimPrefix(ref, SSM_PREFIX)
+	opts := []func(*config.LoadOptions) error{}
+	if a, err := arn.Parse(name); err == nil {
+		opts = append(opts, config.WithRegion(a.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return "", fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+	logger.WithFields(logrus.Fields{LOG_PHASE: PHASE_AUTH, "parameter": name, "region": cfg.Region}).Info("Getting SSM parameter")
+
+	resp, err := ssm.NewFromConfig(cfg).GetParameter(context.TODO(), &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("fetch ssm parameter error: %v", err.Error())
+	}
+	return aws.ToString(resp.Parameter.Value), nil
+}
+
+// GetS3Object reads a small object referenced as `s3://bucket/key`, failing if it is larger than limit bytes.
+func GetS3Object(uri string, limit int) ([]byte, error) {
+	s3uri, err := tarfile.ParseS3Uri(uri)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+
+	resp, err := s3.NewFromConfig(cfg).GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s3uri.Bucket),
+		Key:    aws.String(s3uri.Key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch s3 object error: %v", err.Error())
+	}
+	defer resp.Body.Close()
+	return iolimits.ReadAtMost(resp.Body, limit)
+}
+
+// GetS3ObjectSize returns the size of the object referenced as `s3://bucket/key`.
+func GetS3ObjectSize(ctx context.Context, uri string) (int64, error) {
+	s3uri, err := tarfile.ParseS3Uri(uri)
+	if err != nil {
+		return 0, err
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("api client configuration error: %v", err.Error())
+	}
+
+	resp, err := s3.NewFromConfig(cfg).HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3uri.Bucket),
+		Key:    aws.String(s3uri.Key),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("head s3 object error: %v", err.Error())
+	}
+	return aws.ToInt64(resp.ContentLength), nil
 }
 
 func GetImageTagsMap(archImageTags string) (tags map[string]string, err error) {
@@ -288,11 +797,83 @@ func GetImageDestination(dest string, imageTag string) string {
 	return fmt.Sprintf("docker://%s:%s", repo, imageTag)
 }
 
+// Supported values of the ManifestFormat property.
+const (
+	MANIFEST_FORMAT_OCI      = "oci"
+	MANIFEST_FORMAT_V2S2     = "v2s2"
+	MANIFEST_FORMAT_PRESERVE = "preserve"
+)
+
+// GetManifestMIMEType maps a ManifestFormat property value onto the manifest MIME type
+// to force at the destination. An empty result means the source format is preserved
+// whenever the destination accepts it.
+func GetManifestMIMEType(format string) (string, error) {
+	switch format {
+	case "", MANIFEST_FORMAT_PRESERVE:
+		return "", nil
+	case MANIFEST_FORMAT_OCI:
+		return imgspecv1.MediaTypeImageManifest, nil
+	case MANIFEST_FORMAT_V2S2:
+		return manifest.DockerV2Schema2MediaType, nil
+	}
+	return "", fmt.Errorf(`invalid manifest format %q. valid values are "%s", "%s" and "%s"`, format, MANIFEST_FORMAT_OCI, MANIFEST_FORMAT_V2S2, MANIFEST_FORMAT_PRESERVE)
+}
+
+// ValidateManifestLayers checks that the given layers can be described by a manifest of
+// manifestType. Docker v2s2 manifests have no media type for zstd-compressed layers.
+func ValidateManifestLayers(manifestType string, layers []types.BlobInfo) error {
+	if manifestType != manifest.DockerV2Schema2MediaType {
+		return nil
+	}
+	for _, layer := range layers {
+		if strings.HasSuffix(layer.MediaType, "+zstd") {
+			return fmt.Errorf("manifest format %q does not support zstd compressed layers (layer %s has media type %s)", MANIFEST_FORMAT_V2S2, layer.Digest, layer.MediaType)
+		}
+	}
+	return nil
+}
+
+// GetExpectedSourceDigest parses the ExpectedSourceDigest property. An empty value means the
+// source is not pinned.
+func GetExpectedSourceDigest(s string) (digest.Digest, error) {
+	if s == "" {
+		return "", nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid expected source digest %q: %v", s, err.Error())
+	}
+	return d, nil
+}
+
+// CheckPreserveDigests returns an error naming the reason the source digest can't be kept
+// when the requested manifest format or compression forces the manifest to change.
+func CheckPreserveDigests(srcManifestType string, manifestType string, compression *CompressionConfigs) error {
+	if aws.ToBool(compression.ForceRecompress) {
+		return fmt.Errorf("digests cannot be preserved: forceRecompress rewrites layers into %s", aws.ToString(compression.Format))
+	}
+	if manifestType == "" {
+		return nil
+	}
+	if manifest.MIMETypeIsMultiImage(srcManifestType) {
+		switch manifestType {
+		case manifest.DockerV2Schema2MediaType:
+			manifestType = manifest.DockerV2ListMediaType
+		case imgspecv1.MediaTypeImageManifest:
+			manifestType = imgspecv1.MediaTypeImageIndex
+		}
+	}
+	if manifest.NormalizedMIMEType(srcManifestType) != manifestType {
+		return fmt.Errorf("digests cannot be preserved: the source manifest is %s and would be converted to %s", srcManifestType, manifestType)
+	}
+	return nil
+}
+
 func intPtr(v int) *int             { return &v }
 func float64Ptr(v float64) *float64 { return &v }
 
 func (rc *RetryConfigs) ToString() string {
-	return fmt.Sprintf("RetryConfigs: numAttempts=%v baseDelay=%v maxDelay=%v", aws.ToInt(rc.NumAttempts), aws.ToFloat64(rc.BaseDelay), aws.ToFloat64(rc.MaxDelay))
+	return fmt.Sprintf("RetryConfigs: numAttempts=%v baseDelay=%v maxDelay=%v retryableErrors=%v", aws.ToInt(rc.NumAttempts), aws.ToFloat64(rc.BaseDelay), aws.ToFloat64(rc.MaxDelay), rc.RetryableErrors)
 }
 
 // Helper function to parse the specified retry configuration in the form of JSON data into a
@@ -318,6 +899,67 @@ func GetRetryConfigs(data string) (*RetryConfigs, error) {
 	return &config, nil
 }
 
+// Helper function to parse the specified compression configuration in the form of JSON data into a
+// CompressionConfigs object
+func GetCompressionConfigs(data string) (*CompressionConfigs, error) {
+	config := CompressionConfigs{}
+
+	if data != "" {
+		decoder := json.NewDecoder(strings.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("unable to parse compression configuration from data: %v with error: %v", data, err)
+		}
+	}
+	if err := config.ValidateFields(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Helper function for CompressionConfigs to validate that the format is supported and that the level is
+// within the range accepted by that format.
+func (cc *CompressionConfigs) ValidateFields() error {
+	if cc.Format == nil {
+		if cc.Level != nil {
+			return fmt.Errorf("level cannot be set without a compression format")
+		}
+		if aws.ToBool(cc.ForceRecompress) {
+			return fmt.Errorf("forceRecompress cannot be set without a compression format")
+		}
+		return nil
+	}
+
+	minLevel, maxLevel := 0, 0
+	switch *cc.Format {
+	case compressiontypes.GzipAlgorithmName:
+		minLevel, maxLevel = 1, 9
+	case compressiontypes.ZstdAlgorithmName, compressiontypes.ZstdChunkedAlgorithmName:
+		minLevel, maxLevel = 1, 20
+	default:
+		return fmt.Errorf(`invalid compression format %q. valid values are "%s", "%s" and "%s"`, *cc.Format,
+			compressiontypes.GzipAlgorithmName, compressiontypes.ZstdAlgorithmName, compressiontypes.ZstdChunkedAlgorithmName)
+	}
+	if cc.Level != nil && (*cc.Level < minLevel || *cc.Level > maxLevel) {
+		return fmt.Errorf("level for %s compression must be between %d and %d", *cc.Format, minLevel, maxLevel)
+	}
+	return nil
+}
+
+// IsZstd returns whether destination layers are compressed with zstd or zstd:chunked.
+func (cc *CompressionConfigs) IsZstd() bool {
+	format := aws.ToString(cc.Format)
+	return format == compressiontypes.ZstdAlgorithmName || format == compressiontypes.ZstdChunkedAlgorithmName
+}
+
+// ValidateManifestType checks that the compression can be described by a manifest of manifestType.
+func (cc *CompressionConfigs) ValidateManifestType(manifestType string) error {
+	if manifestType == manifest.DockerV2Schema2MediaType && cc.IsZstd() {
+		return fmt.Errorf("manifest format %q does not support %s compression", MANIFEST_FORMAT_V2S2, *cc.Format)
+	}
+	return nil
+}
+
 // Helper function for RetryConfigs to validate that the values of the retry configs are non-negative/non-zero as well as
 // have a valid range between baseDelay and maxDelay.
 func (rc *RetryConfigs) ValidateFields() error {
@@ -337,53 +979,75 @@ func (rc *RetryConfigs) ValidateFields() error {
 	if baseDelay > maxDelay {
 		return fmt.Errorf("baseDelay cannot be greater than maxDelay")
 	}
+	for category := range rc.RetryableErrors {
+		if !slices.Contains(ErrorCategories, ErrorCategory(category)) {
+			return fmt.Errorf("unknown error category %q in retryableErrors. valid values are %q", category, ErrorCategories)
+		}
+	}
 	return nil
 }
 
-// IsRetryableError checks if an error is transient and should be retried.
-// This covers ECR API rate limits, S3 throttling during blob transfers,
-// and transient network errors.
+// IsRetryableError checks if an error is transient and should be retried, whatever its
+// category. This covers ECR API rate limits, S3 throttling during blob transfers, server
+// errors and transient network errors.
 func IsRetryableError(err error) bool {
-	if err == nil {
+	return ClassifyError(err) != ""
+}
+
+// IsRetryable checks if an error is transient and its category is not disabled by the
+// retryableErrors of the configuration.
+func (rc *RetryConfigs) IsRetryable(err error) bool {
+	category := ClassifyError(err)
+	if category == "" {
 		return false
 	}
-	return IsECRRateLimitError(err) || IsS3ThrottlingError(err) || IsTransientNetworkError(err)
+	if retryable, ok := rc.RetryableErrors[string(category)]; ok {
+		return retryable
+	}
+	return true
 }
 
 // IsECRRateLimitError checks for ECR API rate-limit errors (push-side throttling).
 func IsECRRateLimitError(err error) bool {
-	// Attempt to cast it as a smithy APIError
-	var apiErr smithy.APIError
-	if errors.As(err, &apiErr) {
-		if strings.Contains(apiErr.ErrorMessage(), ECRRateExceedError) {
-			return true
-		}
-	}
-
-	s := strings.ToLower(err.Error())
-	return strings.Contains(s, "toomanyrequests") ||
-		strings.Contains(s, "ratelimitexceeded") ||
-		strings.Contains(s, "rate exceeded") ||
-		strings.Contains(s, "slow down") ||
-		strings.Contains(s, "503 service unavailable") ||
-		strings.Contains(s, "500 internal server error") ||
-		strings.Contains(s, "connection reset by peer") ||
-		(strings.Contains(s, "rate") && strings.Contains(s, "exceed"))
+	return ClassifyError(err) == ERROR_RATE_LIMIT
 }
 
 // IsS3ThrottlingError checks for S3 throttling errors during blob layer downloads.
 // ECR stores layers in S3 and serves them via presigned URLs; S3 uses HTTP 503 for throttling.
 func IsS3ThrottlingError(err error) bool {
-	s := strings.ToLower(err.Error())
-	return strings.Contains(s, "slow down") ||
-		strings.Contains(s, "503 service unavailable")
+	return ClassifyError(err) == ERROR_THROTTLING
 }
 
 // IsTransientNetworkError checks for transient server and network errors.
 func IsTransientNetworkError(err error) bool {
-	s := strings.ToLower(err.Error())
-	return strings.Contains(s, "500 internal server error") ||
-		strings.Contains(s, "connection reset by peer")
+	category := ClassifyError(err)
+	return category == ERROR_SERVER_ERROR || category == ERROR_NETWORK
+}
+
+// RETRY_DEADLINE_MARGIN is the time kept before the deadline of the invocation when waiting to
+// retry, for the next attempt and the response to CloudFormation.
+const RETRY_DEADLINE_MARGIN = 10 * time.Second
+
+// RetryDelay returns the wait before the retry attempt of a copy that failed with err: the
+// backoff with jitter, or the delay the server asked for if longer. The wait is capped by
+// maxDelay, so it is shorter than hint when maxDelay truncates it, and by the deadline of ctx.
+// ok is false if no time is left to retry before the deadline, or if the delay the server asked
+// for ends past it, as retrying sooner is bound to fail again. hint is the delay the server
+// asked for, 0 if none.
+func RetryDelay(ctx context.Context, err error, attempt int, baseDelay float64, maxDelay float64) (wait time.Duration, hint time.Duration, ok bool) {
+	wait = BackoffWithJitter(attempt, baseDelay, maxDelay)
+	if delay, hinted := RetryAfter(err); hinted {
+		hint = delay
+		wait = min(max(wait, hint), time.Duration(maxDelay*float64(time.Second)))
+	}
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		left := time.Until(deadline) - RETRY_DEADLINE_MARGIN
+		if left <= 0 || hint > left {
+			return 0, hint, false
+		}
+		wait = min(wait, left)
+	}
+	return wait, hint, true
 }
 
 // A simple backoff with jitter formula that's used for retries.
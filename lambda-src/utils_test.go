@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -11,8 +12,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.podman.io/image/v5/types"
 )
 
 func TestGetECRRegion(t *testing.T) {
@@ -30,12 +36,66 @@ func TestGetECRRegion(t *testing.T) {
 	)
 }
 
+func TestParseECRRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want *ECRRegistry
+	}{
+		{"standard", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/repo:tag", &ECRRegistry{"123456789012.dkr.ecr.us-west-2.amazonaws.com", "123456789012", "us-west-2", false, false}},
+		{"no transport", "123456789012.dkr.ecr.eu-west-1.amazonaws.com/org/repo@sha256:abc", &ECRRegistry{"123456789012.dkr.ecr.eu-west-1.amazonaws.com", "123456789012", "eu-west-1", false, false}},
+		{"proxy endpoint", "https://123456789012.dkr.ecr.us-east-1.amazonaws.com", &ECRRegistry{"123456789012.dkr.ecr.us-east-1.amazonaws.com", "123456789012", "us-east-1", false, false}},
+		{"FIPS", "docker://123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/repo:tag", &ECRRegistry{"123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com", "123456789012", "us-gov-west-1", true, false}},
+		{"dual-stack", "docker://123456789012.dkr-ecr.us-west-2.on.aws/repo:tag", &ECRRegistry{"123456789012.dkr-ecr.us-west-2.on.aws", "123456789012", "us-west-2", false, true}},
+		{"FIPS dual-stack", "docker://123456789012.dkr-ecr-fips.us-east-1.on.aws/repo:tag", &ECRRegistry{"123456789012.dkr-ecr-fips.us-east-1.on.aws", "123456789012", "us-east-1", true, true}},
+		{"China", "docker://123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/repo:tag", &ECRRegistry{"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn", "123456789012", "cn-north-1", false, false}},
+		{"public ECR", "docker://public.ecr.aws/nginx/nginx:latest", nil},
+		{"Docker Hub", "docker://docker.io/library/nginx:latest", nil},
+		{"ECR name in path", "docker://example.com/123456789012.dkr.ecr.us-west-2.amazonaws.com:tag", nil},
+		{"S3 archive", "s3://bucket/123456789012.dkr.ecr.us-west-2.amazonaws.com.tar", nil},
+		{"lookalike domain", "docker://123456789012.dkr.ecr.us-west-2.amazonaws.com.example.com/repo:tag", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, ok := ParseECRRegistry(tt.uri)
+			assert.Equal(t, tt.want != nil, ok)
+			assert.Equal(t, tt.want, registry)
+		})
+	}
+}
+
+func TestSelectECRAuth(t *testing.T) {
+	auths := []ECRAuth{
+		{User: "AWS", Pass: "own", ProxyEndpoint: "https://111111111111.dkr.ecr.us-west-2.amazonaws.com"},
+		{User: "AWS", Pass: "other", ProxyEndpoint: "https://222222222222.dkr.ecr.us-west-2.amazonaws.com"},
+	}
+
+	registry, _ := ParseECRRegistry("docker://222222222222.dkr.ecr.us-west-2.amazonaws.com/repo:tag")
+	auth, err := SelectECRAuth(auths, registry)
+	require.NoError(t, err)
+	assert.Equal(t, "other", auth.Pass)
+
+	registry, _ = ParseECRRegistry("docker://222222222222.dkr-ecr-fips.us-west-2.on.aws/repo:tag")
+	auth, err = SelectECRAuth(auths, registry)
+	require.NoError(t, err)
+	assert.Equal(t, "other", auth.Pass)
+
+	registry, _ = ParseECRRegistry("docker://333333333333.dkr.ecr.us-west-2.amazonaws.com/repo:tag")
+	_, err = SelectECRAuth(auths, registry)
+	assert.ErrorContains(t, err, "no ECR auth token for registry 333333333333.dkr.ecr.us-west-2.amazonaws.com")
+
+	_, err = SelectECRAuth(nil, registry)
+	assert.ErrorContains(t, err, "empty ECR login auth token list")
+}
+
 func TestGetCredsType(t *testing.T) {
 	assert.Equal(t, SECRET_ARN, GetCredsType("arn:aws:secretsmanager:us-west-2:00000:secret:fake-secret"))
 	assert.Equal(t, SECRET_ARN, GetCredsType("arn:aws-cn:secretsmanager:cn-north-1:00000:secret:fake-secret"))
 	assert.Equal(t, SECRET_NAME, GetCredsType("fake-secret"))
 	assert.Equal(t, SECRET_TEXT, GetCredsType("username:password"))
 	assert.Equal(t, SECRET_NAME, GetCredsType(""))
+	assert.Equal(t, SSM_PARAMETER, GetCredsType("ssm:/registry/creds"))
+	assert.Equal(t, SSM_PARAMETER, GetCredsType("arn:aws:ssm:us-west-2:00000:parameter/registry/creds"))
 }
 
 func TestParseJsonSecret(t *testing.T) {
@@ -67,6 +127,76 @@ func TestParseJsonSecret(t *testing.T) {
 	assert.Contains(t, "error parsing password from json secret", passwordError.Error())
 }
 
+func TestParseSecretCreds(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		configs *SecretConfigs
+		want    *ECRAuth
+		wantErr string
+	}{
+		{"text", "user_val:pass_val", nil, &ECRAuth{User: "user_val", Pass: "pass_val"}, ""},
+		{"default keys", `{"username": "user_val", "password": "pass_val"}`, nil, &ECRAuth{User: "user_val", Pass: "pass_val"}, ""},
+		{"custom keys", `{"login": "user_val", "secret": "pass_val"}`, &SecretConfigs{UsernameKey: aws.String("login"), PasswordKey: aws.String("secret")}, &ECRAuth{User: "user_val", Pass: "pass_val"}, ""},
+		{"token", `{"token": "bearer_val"}`, nil, &ECRAuth{BearerToken: "bearer_val"}, ""},
+		{"custom token key", `{"access_token": "bearer_val"}`, &SecretConfigs{TokenKey: aws.String("access_token")}, &ECRAuth{BearerToken: "bearer_val"}, ""},
+		{"username wins over token", `{"username": "user_val", "password": "pass_val", "token": "bearer_val"}`, nil, &ECRAuth{User: "user_val", Pass: "pass_val"}, ""},
+		{"tokens disabled", `{"token": "bearer_val"}`, &SecretConfigs{TokenKey: aws.String("")}, nil, "error parsing username from json secret"},
+		{"missing password", `{"username": "user_val"}`, nil, nil, "error parsing password from json secret"},
+		{"not an object", `["user_val"]`, nil, nil, "error parsing json secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := ParseSecretCreds(tt.secret, tt.configs)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, auth)
+		})
+	}
+}
+
+func TestGetSecretConfigs(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"keys", `{"usernameKey": "login", "passwordKey": "secret", "tokenKey": "access_token"}`, ""},
+		{"version stage", `{"versionStage": "AWSPREVIOUS"}`, ""},
+		{"version id", `{"versionId": "EXAMPLE1-90ab-cdef-fedc-ba987SECRET1"}`, ""},
+		{"stage and id", `{"versionStage": "AWSPREVIOUS", "versionId": "EXAMPLE1-90ab-cdef-fedc-ba987SECRET1"}`, "can't be both set"},
+		{"empty username key", `{"usernameKey": ""}`, "can't be empty"},
+		{"unknown field", `{"usernameField": "login"}`, "unable to parse secret configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GetSecretConfigs(tt.data)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSecretValue(t *testing.T) {
+	value, err := secretValue(&secretsmanager.GetSecretValueOutput{SecretString: aws.String("user:pass")})
+	require.NoError(t, err)
+	assert.Equal(t, "user:pass", value)
+
+	value, err = secretValue(&secretsmanager.GetSecretValueOutput{SecretBinary: []byte(`{"token": "bearer"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, `{"token": "bearer"}`, value)
+
+	_, err = secretValue(&secretsmanager.GetSecretValueOutput{})
+	assert.ErrorContains(t, err, "secret has no value")
+}
+
 func TestGetArchChoice(t *testing.T) {
 	assert.Equal(t, "amd64", GetArchChoice("amd64", false))
 	assert.Equal(t, "", GetArchChoice("amd64", true))
@@ -401,23 +531,65 @@ func TestBackoffWithJitter(t *testing.T) {
 	}
 }
 
+func TestRetryDelay(t *testing.T) {
+	hinted := func(delay time.Duration) error {
+		return &RetryAfterError{Err: errors.New("toomanyrequests"), Delay: delay}
+	}
+	testCases := []struct {
+		name      string
+		err       error
+		deadline  time.Duration // 0 for no deadline
+		maxDelay  float64
+		expectMin time.Duration
+		expectMax time.Duration
+		wantHint  time.Duration
+		wantOk    bool
+	}{
+		{"backoff without hint", errors.New("slow down"), 0, 4.0, 1 * time.Second, 4 * time.Second, 0, true},
+		{"hint longer than backoff", hinted(3500 * time.Millisecond), 0, 10.0, 3500 * time.Millisecond, 4 * time.Second, 3500 * time.Millisecond, true},
+		{"hint shorter than backoff", hinted(time.Millisecond), 0, 1.0, 1 * time.Second, 1 * time.Second, time.Millisecond, true},
+		{"hint capped by maxDelay", hinted(time.Hour), 0, 5.0, 5 * time.Second, 5 * time.Second, time.Hour, true},
+		{"capped by deadline", errors.New("slow down"), RETRY_DEADLINE_MARGIN + 2*time.Second, 60.0, time.Second, 2 * time.Second, 0, true},
+		{"hint before deadline", hinted(1500 * time.Millisecond), RETRY_DEADLINE_MARGIN + 5*time.Second, 60.0, 1500 * time.Millisecond, 4 * time.Second, 1500 * time.Millisecond, true},
+		{"hint past deadline", hinted(time.Minute), RETRY_DEADLINE_MARGIN + 5*time.Second, 60.0, 0, 0, time.Minute, false},
+		{"hint capped by maxDelay past deadline", hinted(time.Hour), RETRY_DEADLINE_MARGIN + 5*time.Second, 2.0, 0, 0, time.Hour, false},
+		{"no time left", errors.New("slow down"), RETRY_DEADLINE_MARGIN - time.Second, 60.0, 0, 0, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.deadline)
+				defer cancel()
+			}
+			wait, hint, ok := RetryDelay(ctx, tc.err, 2, 1.0, tc.maxDelay)
+			assert.Equal(t, tc.wantOk, ok)
+			assert.Equal(t, tc.wantHint, hint)
+			assert.GreaterOrEqual(t, wait, tc.expectMin)
+			assert.LessOrEqual(t, wait, tc.expectMax)
+		})
+	}
+}
+
 func TestNewImageOptsPrivateECR(t *testing.T) {
 	tests := []struct {
 		name       string
 		uri        string
-		wantLogin  bool
-		wantPublic bool
 		wantRegion string
 	}{
-		{"us-west-2", "docker://123456789.dkr.ecr.us-west-2.amazonaws.com/repo:tag", true, false, "us-west-2"},
-		{"us-east-1", "docker://123456789.dkr.ecr.us-east-1.amazonaws.com/repo:tag", true, false, "us-east-1"},
-		{"cn-north-1", "docker://123456789.dkr.ecr.cn-north-1.amazonaws.com.cn/repo:tag", true, false, "cn-north-1"},
+		{"us-west-2", "docker://123456789.dkr.ecr.us-west-2.amazonaws.com/repo:tag", "us-west-2"},
+		{"us-east-1", "docker://123456789.dkr.ecr.us-east-1.amazonaws.com/repo:tag", "us-east-1"},
+		{"cn-north-1", "docker://123456789.dkr.ecr.cn-north-1.amazonaws.com.cn/repo:tag", "cn-north-1"},
+		{"fips", "docker://123456789.dkr.ecr-fips.us-gov-west-1.amazonaws.com/repo:tag", "us-gov-west-1"},
+		{"dual-stack", "docker://123456789.dkr-ecr.eu-central-1.on.aws/repo:tag", "eu-central-1"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			opts := NewImageOpts(tt.uri, "amd64", false)
-			assert.True(t, opts.requireECRLogin)
-			assert.False(t, opts.requireECRPublicLogin)
+			_, authenticator := opts.authenticator()
+			assert.IsType(t, &ECRAuthenticator{}, authenticator)
 			assert.Equal(t, tt.wantRegion, opts.region)
 		})
 	}
@@ -435,8 +607,8 @@ func TestNewImageOptsPublicECR(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			opts := NewImageOpts(tt.uri, "amd64", false)
-			assert.False(t, opts.requireECRLogin)
-			assert.True(t, opts.requireECRPublicLogin)
+			_, authenticator := opts.authenticator()
+			assert.IsType(t, &ECRPublicAuthenticator{}, authenticator)
 			assert.Equal(t, "us-east-1", opts.region)
 		})
 	}
@@ -454,8 +626,8 @@ func TestNewImageOptsExternalRegistry(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			opts := NewImageOpts(tt.uri, "amd64", false)
-			assert.False(t, opts.requireECRLogin)
-			assert.False(t, opts.requireECRPublicLogin)
+			_, authenticator := opts.authenticator()
+			assert.Nil(t, authenticator)
 			assert.Equal(t, "", opts.region)
 		})
 	}
@@ -484,3 +656,266 @@ func TestNewECRAuth(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid auth token format")
 }
+
+func TestNewAssumeRoleConfigs(t *testing.T) {
+	tests := []struct {
+		name        string
+		roleArn     string
+		externalId  string
+		sessionName string
+		want        *AssumeRoleConfigs
+		wantErr     string
+	}{
+		{"no role", "", "", "", nil, ""},
+		{"default session name", "arn:aws:iam::123456789012:role/ecr-push", "", "", &AssumeRoleConfigs{"arn:aws:iam::123456789012:role/ecr-push", "", "cdk-ecr-deployment"}, ""},
+		{"external ID and session name", "arn:aws:iam::123456789012:role/path/ecr-push", "ext-123", "pipeline@prod", &AssumeRoleConfigs{"arn:aws:iam::123456789012:role/path/ecr-push", "ext-123", "pipeline@prod"}, ""},
+		{"china partition", "arn:aws-cn:iam::123456789012:role/ecr-push", "", "", &AssumeRoleConfigs{"arn:aws-cn:iam::123456789012:role/ecr-push", "", "cdk-ecr-deployment"}, ""},
+		{"external ID without role", "", "ext-123", "", nil, "require a role ARN"},
+		{"not an ARN", "ecr-push", "", "", nil, "invalid role ARN"},
+		{"not a role", "arn:aws:iam::123456789012:user/ecr-push", "", "", nil, "invalid role ARN"},
+		{"not IAM", "arn:aws:s3:::bucket", "", "", nil, "invalid role ARN"},
+		{"invalid session name", "arn:aws:iam::123456789012:role/ecr-push", "", "has spaces", nil, "invalid session name"},
+		{"session name too short", "arn:aws:iam::123456789012:role/ecr-push", "", "a", nil, "invalid session name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, err := NewAssumeRoleConfigs(tt.roleArn, tt.externalId, tt.sessionName)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, role)
+		})
+	}
+}
+
+type fakeSTS struct {
+	input *sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.input = params
+	return &sts.AssumeRoleOutput{
+		Credentials: &ststypes.Credentials{
+			AccessKeyId:     aws.String("ASIAEXAMPLE"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestNewAssumeRoleProvider(t *testing.T) {
+	client := &fakeSTS{}
+	role := &AssumeRoleConfigs{RoleArn: "arn:aws:iam::123456789012:role/ecr-push", ExternalId: "ext-123", SessionName: "pipeline"}
+	creds, err := newAssumeRoleProvider(client, role).Retrieve(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, "ASIAEXAMPLE", creds.AccessKeyID)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ecr-push", aws.ToString(client.input.RoleArn))
+	assert.Equal(t, "ext-123", aws.ToString(client.input.ExternalId))
+	assert.Equal(t, "pipeline", aws.ToString(client.input.RoleSessionName))
+
+	client = &fakeSTS{}
+	role = &AssumeRoleConfigs{RoleArn: "arn:aws:iam::123456789012:role/ecr-push", SessionName: DEFAULT_SESSION_NAME}
+	_, err = newAssumeRoleProvider(client, role).Retrieve(context.TODO())
+	require.NoError(t, err)
+	assert.Nil(t, client.input.ExternalId)
+}
+
+func TestImageOptsSetRole(t *testing.T) {
+	role := &AssumeRoleConfigs{RoleArn: "arn:aws:iam::123456789012:role/ecr-push", SessionName: DEFAULT_SESSION_NAME}
+	opts := NewImageOpts("docker://123456789012.dkr.ecr.us-west-2.amazonaws.com/repo:tag", "amd64", false)
+	assert.Nil(t, opts.role)
+	opts.SetRole(role)
+	assert.Equal(t, role, opts.role)
+}
+
+func TestGetManifestMIMEType(t *testing.T) {
+	testCases := []struct {
+		format    string
+		expected  string
+		expectErr bool
+	}{
+		{"", "", false},
+		{"preserve", "", false},
+		{"oci", "application/vnd.oci.image.manifest.v1+json", false},
+		{"v2s2", "application/vnd.docker.distribution.manifest.v2+json", false},
+		{"v2s1", "", true},
+		{"OCI", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			mimeType, err := GetManifestMIMEType(tc.format)
+			if tc.expectErr {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), "invalid manifest format")
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, mimeType)
+			}
+		})
+	}
+}
+
+func TestValidateManifestLayers(t *testing.T) {
+	gzipLayer := types.BlobInfo{Digest: "sha256:aaa", MediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}
+	zstdLayer := types.BlobInfo{Digest: "sha256:bbb", MediaType: "application/vnd.oci.image.layer.v1.tar+zstd"}
+
+	assert.NoError(t, ValidateManifestLayers("", []types.BlobInfo{gzipLayer, zstdLayer}))
+	assert.NoError(t, ValidateManifestLayers("application/vnd.oci.image.manifest.v1+json", []types.BlobInfo{gzipLayer, zstdLayer}))
+	assert.NoError(t, ValidateManifestLayers("application/vnd.docker.distribution.manifest.v2+json", []types.BlobInfo{gzipLayer}))
+
+	err := ValidateManifestLayers("application/vnd.docker.distribution.manifest.v2+json", []types.BlobInfo{gzipLayer, zstdLayer})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "sha256:bbb")
+}
+
+func TestGetCompressionConfigs(t *testing.T) {
+	testCases := []struct {
+		name                    string
+		jsonData                string
+		expectedFormat          string
+		expectedLevel           *int
+		expectedForceRecompress bool
+		expectErr               bool
+	}{
+		{
+			name:     "successfully parses empty string",
+			jsonData: "",
+		},
+		{
+			name:           "successfully parses gzip with level",
+			jsonData:       `{"format": "gzip", "level": 9}`,
+			expectedFormat: "gzip",
+			expectedLevel:  intPtr(9),
+		},
+		{
+			name:                    "successfully parses zstd with force recompress",
+			jsonData:                `{"format": "zstd", "forceRecompress": true}`,
+			expectedFormat:          "zstd",
+			expectedForceRecompress: true,
+		},
+		{
+			name:           "successfully parses zstd:chunked",
+			jsonData:       `{"format": "zstd:chunked", "level": 3}`,
+			expectedFormat: "zstd:chunked",
+			expectedLevel:  intPtr(3),
+		},
+		{
+			name:      "fails to parse unknown format",
+			jsonData:  `{"format": "bzip2"}`,
+			expectErr: true,
+		},
+		{
+			name:      "fails to parse unknown field",
+			jsonData:  `{"format": "gzip", "invalid": true}`,
+			expectErr: true,
+		},
+		{
+			name:      "fails to parse gzip level out of range",
+			jsonData:  `{"format": "gzip", "level": 10}`,
+			expectErr: true,
+		},
+		{
+			name:      "fails to parse zstd level out of range",
+			jsonData:  `{"format": "zstd", "level": 0}`,
+			expectErr: true,
+		},
+		{
+			name:      "fails to parse level without format",
+			jsonData:  `{"level": 3}`,
+			expectErr: true,
+		},
+		{
+			name:      "fails to parse forceRecompress without format",
+			jsonData:  `{"forceRecompress": true}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := GetCompressionConfigs(tc.jsonData)
+
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expectedFormat, aws.ToString(config.Format))
+				assert.Equal(t, tc.expectedLevel, config.Level)
+				assert.Equal(t, tc.expectedForceRecompress, aws.ToBool(config.ForceRecompress))
+			}
+		})
+	}
+}
+
+func TestCompressionConfigsValidateManifestType(t *testing.T) {
+	v2s2 := "application/vnd.docker.distribution.manifest.v2+json"
+	oci := "application/vnd.oci.image.manifest.v1+json"
+
+	assert.NoError(t, (&CompressionConfigs{}).ValidateManifestType(v2s2))
+	assert.NoError(t, (&CompressionConfigs{Format: aws.String("gzip")}).ValidateManifestType(v2s2))
+	assert.NoError(t, (&CompressionConfigs{Format: aws.String("zstd")}).ValidateManifestType(oci))
+	assert.NoError(t, (&CompressionConfigs{Format: aws.String("zstd")}).ValidateManifestType(""))
+	assert.Error(t, (&CompressionConfigs{Format: aws.String("zstd")}).ValidateManifestType(v2s2))
+	assert.Error(t, (&CompressionConfigs{Format: aws.String("zstd:chunked")}).ValidateManifestType(v2s2))
+}
+
+func TestNewSystemContextCompression(t *testing.T) {
+	opts := NewImageOpts("dir:/tmp/nginx.dir", "amd64", false)
+	ctx, err := opts.NewSystemContext()
+	require.NoError(t, err)
+	assert.Nil(t, ctx.CompressionFormat)
+	assert.Nil(t, ctx.CompressionLevel)
+
+	opts.SetCompression(&CompressionConfigs{Format: aws.String("zstd"), Level: intPtr(5)})
+	ctx, err = opts.NewSystemContext()
+	require.NoError(t, err)
+	require.NotNil(t, ctx.CompressionFormat)
+	assert.Equal(t, "zstd", ctx.CompressionFormat.Name())
+	assert.Equal(t, 5, *ctx.CompressionLevel)
+}
+
+func TestCheckPreserveDigests(t *testing.T) {
+	v2s2 := "application/vnd.docker.distribution.manifest.v2+json"
+	v2list := "application/vnd.docker.distribution.manifest.list.v2+json"
+	oci := "application/vnd.oci.image.manifest.v1+json"
+	ociIndex := "application/vnd.oci.image.index.v1+json"
+	noCompression := &CompressionConfigs{}
+
+	assert.NoError(t, CheckPreserveDigests(v2s2, "", noCompression))
+	assert.NoError(t, CheckPreserveDigests(v2s2, v2s2, noCompression))
+	assert.NoError(t, CheckPreserveDigests(v2list, v2s2, noCompression))
+	assert.NoError(t, CheckPreserveDigests(ociIndex, oci, noCompression))
+	assert.NoError(t, CheckPreserveDigests(oci, "", &CompressionConfigs{Format: aws.String("zstd")}))
+
+	err := CheckPreserveDigests(v2s2, oci, noCompression)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "would be converted to "+oci)
+
+	err = CheckPreserveDigests(ociIndex, v2s2, noCompression)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "would be converted to "+v2list)
+
+	err = CheckPreserveDigests(oci, "", &CompressionConfigs{Format: aws.String("zstd"), ForceRecompress: aws.Bool(true)})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "forceRecompress rewrites layers into zstd")
+}
+
+func TestGetExpectedSourceDigest(t *testing.T) {
+	d, err := GetExpectedSourceDigest("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", d.String())
+
+	d, err = GetExpectedSourceDigest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", d.String())
+
+	_, err = GetExpectedSourceDigest("sha256:abc")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid expected source digest")
+
+	_, err = GetExpectedSourceDigest("latest")
+	assert.Error(t, err)
+}
@@ -1,8 +1,9 @@
 // Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
+import * as crypto from 'crypto';
 import * as path from 'path';
-import { aws_ec2 as ec2, aws_iam as iam, aws_lambda as lambda, Arn, Aws, Duration, CustomResource, Stack, Token } from 'aws-cdk-lib';
+import { aws_ec2 as ec2, aws_events as events, aws_iam as iam, aws_kms as kms, aws_lambda as lambda, aws_s3 as s3, aws_secretsmanager as secretsmanager, aws_sns as sns, aws_ssm as ssm, Arn, Aws, Duration, CustomResource, Size, Stack, Token } from 'aws-cdk-lib';
 import { PolicyStatement, AddToPrincipalPolicyResult } from 'aws-cdk-lib/aws-iam';
 import { RuntimeFamily } from 'aws-cdk-lib/aws-lambda';
 import { Construct } from 'constructs';
@@ -59,9 +60,196 @@ export interface ECRDeploymentProps {
    * between each retry.
    *
    * For example, { 'numAttempts': 3, 'baseDelay': 1, 'maxDelay': 5 }
+   *
+   * @deprecated use `retry`
    */
   readonly retryConfigs?: { [fields: string]: number };
 
+  /**
+   * How copies failing with transient errors are retried.
+   *
+   * @default - a single attempt
+   */
+  readonly retry?: RetryOptions;
+
+  /**
+   * The manifest format of the destination image.
+   *
+   * The layers are converted along with the manifest when needed. Converting changes
+   * the digest of the image.
+   *
+   * @default ManifestFormat.PRESERVE
+   */
+  readonly manifestFormat?: ManifestFormat;
+
+  /**
+   * The compression of the layers written to the destination.
+   *
+   * @default - layers keep the compression of the source
+   */
+  readonly compression?: CompressionOptions;
+
+  /**
+   * Whether to fail the deployment instead of changing the manifest, and so the digest, of the image.
+   *
+   * Can't be combined with a manifestFormat or compression which would convert the image.
+   *
+   * @default false
+   */
+  readonly preserveDigests?: boolean;
+
+  /**
+   * The digest the source image must have, e.g. `sha256:...`.
+   *
+   * The source is checked before it is copied, and read by that digest so that
+   * a tag moved meanwhile can't change what is copied. The digest may be the one
+   * of the image index or of the image selected from it; with archImageTags, it
+   * must be the one of the image index.
+   *
+   * @default - the source is not checked
+   */
+  readonly expectedSourceDigest?: string;
+
+  /**
+   * The policy the source image must satisfy, e.g. requiring sigstore signatures.
+   *
+   * @default - any image is accepted, signed or not
+   */
+  readonly signaturePolicy?: SignaturePolicy;
+
+  /**
+   * Whether to copy the signatures, attestations and SBOMs attached to the source image.
+   *
+   * They are found with the OCI referrers API, or with the cosign tags of the image on
+   * registries without it. They refer to the source digest, so the image must keep it:
+   * the deployment fails if the copy changes the digest, see preserveDigests.
+   *
+   * @default false
+   */
+  readonly copyReferrers?: boolean;
+
+  /**
+   * The KMS key to sign the destination image with.
+   *
+   * A cosign signature of the image is attached to the destination repository
+   * under the `sha256-<digest>.sig` tag, replacing the earlier signature of the
+   * same key and tag. The key must be an asymmetric SIGN_VERIFY key of spec
+   * ECC_NIST_P256 or RSA_*, and the handler is granted kms:Sign and
+   * kms:GetPublicKey on it.
+   *
+   * @default - the image is not signed
+   */
+  readonly signingKey?: kms.IKey;
+
+  /**
+   * The role to assume to read the source, e.g. of an ECR registry in another account.
+   *
+   * The handler is granted sts:AssumeRole on it; the trust policy of the role must
+   * allow the handler role.
+   *
+   * @default - the source is read with the handler role
+   */
+  readonly srcRole?: AssumeRoleOptions;
+
+  /**
+   * The role to assume to write the destination, e.g. of an ECR registry in another account.
+   *
+   * The handler is granted sts:AssumeRole on it; the trust policy of the role must
+   * allow the handler role.
+   *
+   * @default - the destination is written with the handler role
+   */
+  readonly destRole?: AssumeRoleOptions;
+
+  /**
+   * A docker config.json document with the credentials of the source registry.
+   *
+   * The credentials of the most specific `auths` entry matching the source are
+   * used. Can't be combined with the creds of the source.
+   *
+   * @default - the creds of the source, or the ECR login
+   */
+  readonly srcAuthConfig?: AuthConfig;
+
+  /**
+   * A docker config.json document with the credentials of the destination registry.
+   *
+   * The credentials of the most specific `auths` entry matching the destination are
+   * used. Can't be combined with the creds of the destination.
+   *
+   * @default - the creds of the destination, or the ECR login
+   */
+  readonly destAuthConfig?: AuthConfig;
+
+  /**
+   * The KMS key the creds of the source are encrypted with, such as the customer
+   * managed key of a SecureString parameter. The handler is granted kms:Decrypt
+   * on it.
+   *
+   * @default - the creds are encrypted with an AWS managed key
+   */
+  readonly srcCredsKey?: kms.IKey;
+
+  /**
+   * The KMS key the creds of the destination are encrypted with, such as the
+   * customer managed key of a SecureString parameter. The handler is granted
+   * kms:Decrypt on it.
+   *
+   * @default - the creds are encrypted with an AWS managed key
+   */
+  readonly destCredsKey?: kms.IKey;
+
+  /**
+   * Native authentication to the source registry, for Google, Azure and GitHub registries.
+   *
+   * @default - the creds of the source, or the ECR login
+   */
+  readonly srcRegistryAuth?: RegistryAuthOptions;
+
+  /**
+   * Native authentication to the destination registry, for Google, Azure and GitHub registries.
+   *
+   * @default - the creds of the destination, or the ECR login
+   */
+  readonly destRegistryAuth?: RegistryAuthOptions;
+
+  /**
+   * How to read the creds of the source, which must be a secret or an SSM parameter.
+   *
+   * @default - the `username` and `password`, or `token`, keys of the current version
+   */
+  readonly srcSecretOptions?: SecretOptions;
+
+  /**
+   * How to read the creds of the destination, which must be a secret or an SSM parameter.
+   *
+   * @default - the `username` and `password`, or `token`, keys of the current version
+   */
+  readonly destSecretOptions?: SecretOptions;
+
+  /**
+   * How often the copy of each blob is reported, and where to besides the logs.
+   *
+   * @default - reports every 10 seconds, to the logs only
+   */
+  readonly progress?: ProgressOptions;
+
+  /**
+   * How Docker Hub sources are copied: whether the pull quota left is checked first, and
+   * the ECR pull-through cache of Docker Hub to copy from when it is too low.
+   *
+   * @default - the quota is checked, and the copy fails when it is too low
+   */
+  readonly dockerHub?: DockerHubOptions;
+
+  /**
+   * The ECR pull-through cache rules to copy the sources of upstream registries through,
+   * so that ECR serves and caches them.
+   *
+   * @default - sources are copied from their registry
+   */
+  readonly pullThroughCache?: PullThroughCacheOptions;
+
   /**
    * The amount of memory (in MiB) to allocate to the AWS Lambda function which
    * replicates the files from the CDK bucket to the destination bucket.
@@ -73,6 +261,36 @@ export interface ECRDeploymentProps {
    */
   readonly memoryLimit?: number;
 
+  /**
+   * The size of the /tmp directory of the deployment lambda handler.
+   *
+   * The layers of S3 and docker archive sources are buffered in /tmp to compute their
+   * digest before they are pushed, so that retries and later deployments skip the
+   * layers already pushed. Archives which don't fit are copied without.
+   *
+   * @default Size.mebibytes(512)
+   */
+  readonly ephemeralStorageSize?: Size;
+
+  /**
+   * The X-Ray tracing of the deployment lambda handler. When enabled with a
+   * `tracingCollectorLayer`, the handler also sends the spans of the deployment
+   * phases to X-Ray.
+   *
+   * @default Tracing.DISABLED
+   */
+  readonly tracing?: lambda.Tracing;
+
+  /**
+   * The AWS Distro for OpenTelemetry collector layer to export the spans of the
+   * deployment phases through, such as the `aws-otel-collector-amd64` layer of the
+   * region. The handler sends them over OTLP to the collector, which exports them
+   * to X-Ray. Only used when `tracing` is enabled.
+   *
+   * @default - only the invocations of the handler are traced
+   */
+  readonly tracingCollectorLayer?: lambda.ILayerVersion;
+
   /**
    * Execution role associated with this function
    *
@@ -107,6 +325,474 @@ export interface ECRDeploymentProps {
   readonly securityGroups?: ec2.SecurityGroup[];
 }
 
+/**
+ * Retries of copies failing with transient errors, with exponential backoff and jitter.
+ */
+export interface RetryOptions {
+  /**
+   * The maximum number of attempts.
+   *
+   * @default 1
+   */
+  readonly numAttempts?: number;
+
+  /**
+   * The base delay between two attempts.
+   *
+   * @default Duration.seconds(1)
+   */
+  readonly baseDelay?: Duration;
+
+  /**
+   * The maximum delay between two attempts.
+   *
+   * Attempts wait at least the delay asked by the `Retry-After` header of AWS API
+   * throttling errors and of the registry requests the handler sends itself, up to
+   * this maximum; longer delays are cut short, with a warning.
+   *
+   * @default Duration.seconds(1)
+   */
+  readonly maxDelay?: Duration;
+
+  /**
+   * Which categories of transient errors are retried.
+   *
+   * @default - all of them
+   */
+  readonly retryableErrors?: RetryableErrorsOptions;
+}
+
+/**
+ * Whether each category of transient errors is retried.
+ */
+export interface RetryableErrorsOptions {
+  /**
+   * Rate limits: HTTP 429, registry TOOMANYREQUESTS and AWS throttling errors.
+   *
+   * @default true
+   */
+  readonly rateLimit?: boolean;
+
+  /**
+   * HTTP 503, such as S3 Slow Down errors on blob reads.
+   *
+   * @default true
+   */
+  readonly throttling?: boolean;
+
+  /**
+   * HTTP 500, 502 and 504.
+   *
+   * @default true
+   */
+  readonly serverError?: boolean;
+
+  /**
+   * Timeouts, connection resets and truncated responses.
+   *
+   * @default true
+   */
+  readonly network?: boolean;
+}
+
+/**
+ * Manifest format of a destination image.
+ */
+export enum ManifestFormat {
+  /**
+   * OCI image manifest and index.
+   */
+  OCI = 'oci',
+
+  /**
+   * Docker v2 schema 2 manifest and manifest list. Zstd compressed layers are not supported.
+   */
+  V2S2 = 'v2s2',
+
+  /**
+   * The format of the source, unless the destination doesn't accept it.
+   */
+  PRESERVE = 'preserve',
+}
+
+/**
+ * Compression algorithm of destination layers.
+ */
+export enum CompressionFormat {
+  /**
+   * gzip, readable by every registry and runtime.
+   */
+  GZIP = 'gzip',
+
+  /**
+   * zstd, which needs an OCI manifest.
+   */
+  ZSTD = 'zstd',
+
+  /**
+   * zstd:chunked, which lets runtimes supporting it pull only the files they miss.
+   */
+  ZSTD_CHUNKED = 'zstd:chunked',
+}
+
+/**
+ * Compression of the layers written to the destination.
+ */
+export interface CompressionOptions {
+  /**
+   * The compression algorithm of the destination layers.
+   *
+   * @default - layers keep the compression of the source
+   */
+  readonly format?: CompressionFormat;
+
+  /**
+   * The compression level passed to the algorithm.
+   *
+   * @default - the default level of the algorithm
+   */
+  readonly level?: number;
+
+  /**
+   * Whether to recompress layers already compressed with another algorithm.
+   *
+   * Without it, such layers are copied as they are.
+   *
+   * @default false
+   */
+  readonly forceRecompress?: boolean;
+}
+
+/**
+ * A containers-policy.json document which source images must satisfy.
+ *
+ * @see https://github.com/containers/image/blob/main/docs/containers-policy.json.5.md
+ */
+export abstract class SignaturePolicy {
+  /**
+   * A policy given inline.
+   *
+   * @param document - the containers-policy.json document
+   */
+  public static fromDocument(document: { [key: string]: any }): SignaturePolicy {
+    return new (class extends SignaturePolicy {
+      public bind(_grantee: iam.IGrantable): string { return JSON.stringify(document); }
+    })();
+  }
+
+  /**
+   * A policy stored in an S3 object.
+   */
+  public static fromBucket(bucket: s3.IBucket, key: string): SignaturePolicy {
+    return new (class extends SignaturePolicy {
+      public bind(grantee: iam.IGrantable): string {
+        bucket.grantRead(grantee, key);
+        return `s3://${bucket.bucketName}/${key}`;
+      }
+    })();
+  }
+
+  /**
+   * A policy stored in an SSM parameter.
+   */
+  public static fromParameter(parameter: ssm.IParameter): SignaturePolicy {
+    return new (class extends SignaturePolicy {
+      public bind(grantee: iam.IGrantable): string {
+        parameter.grantRead(grantee);
+        return parameter.parameterArn;
+      }
+    })();
+  }
+
+  /**
+   * Grants grantee read access to the policy, and returns the SignaturePolicy property.
+   */
+  public abstract bind(grantee: iam.IGrantable): string;
+}
+
+/**
+ * A role the handler assumes to access a registry.
+ */
+export interface AssumeRoleOptions {
+  /**
+   * The role to assume.
+   */
+  readonly role: iam.IRole;
+
+  /**
+   * The external ID required by the trust policy of the role.
+   *
+   * @default - no external ID
+   */
+  readonly externalId?: string;
+
+  /**
+   * The session name, which shows in the CloudTrail events of the registry.
+   *
+   * @default 'cdk-ecr-deployment'
+   */
+  readonly sessionName?: string;
+}
+
+/**
+ * A docker config.json document holding registry credentials in its `auths` entries.
+ *
+ * Credential helpers can't run in the handler, so `credsStore` and `credHelpers` are rejected.
+ */
+export abstract class AuthConfig {
+  /**
+   * A document stored in a Secrets Manager secret.
+   */
+  public static fromSecret(secret: secretsmanager.ISecret): AuthConfig {
+    return new (class extends AuthConfig {
+      public bind(grantee: iam.IGrantable): string {
+        secret.grantRead(grantee);
+        return secret.secretArn;
+      }
+    })();
+  }
+
+  /**
+   * A document stored in an SSM parameter, e.g. a SecureString.
+   */
+  public static fromParameter(parameter: ssm.IParameter): AuthConfig {
+    return new (class extends AuthConfig {
+      public bind(grantee: iam.IGrantable): string {
+        parameter.grantRead(grantee);
+        return parameter.parameterArn;
+      }
+    })();
+  }
+
+  /**
+   * A document stored in an S3 object.
+   */
+  public static fromBucket(bucket: s3.IBucket, key: string): AuthConfig {
+    return new (class extends AuthConfig {
+      public bind(grantee: iam.IGrantable): string {
+        bucket.grantRead(grantee, key);
+        return `s3://${bucket.bucketName}/${key}`;
+      }
+    })();
+  }
+
+  /**
+   * Grants grantee read access to the document, and returns the auth config property.
+   */
+  public abstract bind(grantee: iam.IGrantable): string;
+}
+
+/**
+ * Native authentication to non-AWS cloud registries. Each registry of an image uses the
+ * authentication of its provider, so one side can hold several of them.
+ */
+export interface RegistryAuthOptions {
+  /**
+   * Authentication to Google Container Registry and Artifact Registry.
+   *
+   * @default - none
+   */
+  readonly gcp?: GcpRegistryAuthOptions;
+
+  /**
+   * Authentication to Azure Container Registry.
+   *
+   * @default - none
+   */
+  readonly azure?: AzureRegistryAuthOptions;
+
+  /**
+   * Authentication to the GitHub Container Registry.
+   *
+   * @default - none
+   */
+  readonly github?: GitHubRegistryAuthOptions;
+}
+
+/**
+ * Authentication to Google registries, with a service account key or workload identity federation.
+ */
+export interface GcpRegistryAuthOptions {
+  /**
+   * The secret holding the JSON key of a service account.
+   *
+   * @default - workloadIdentityAudience is used
+   */
+  readonly serviceAccountKey?: secretsmanager.ISecret;
+
+  /**
+   * The full resource name of the workload identity pool provider trusting the AWS
+   * account of the handler, e.g.
+   * `//iam.googleapis.com/projects/<number>/locations/global/workloadIdentityPools/<pool>/providers/<provider>`.
+   *
+   * @default - serviceAccountKey is used
+   */
+  readonly workloadIdentityAudience?: string;
+
+  /**
+   * The service account to impersonate with workload identity federation.
+   *
+   * @default - the federated identity is granted access to the registry directly
+   */
+  readonly workloadIdentityServiceAccountEmail?: string;
+}
+
+/**
+ * Authentication to Azure registries with a service principal.
+ */
+export interface AzureRegistryAuthOptions {
+  /**
+   * The Azure AD tenant of the service principal.
+   */
+  readonly tenantId: string;
+
+  /**
+   * The application (client) ID of the service principal.
+   */
+  readonly clientId: string;
+
+  /**
+   * The secret holding the client secret of the service principal.
+   */
+  readonly clientSecret: secretsmanager.ISecret;
+}
+
+/**
+ * Authentication to the GitHub Container Registry with a GitHub App.
+ */
+export interface GitHubRegistryAuthOptions {
+  /**
+   * The ID of the GitHub App.
+   */
+  readonly appId: string;
+
+  /**
+   * The ID of the App installation with access to the packages.
+   */
+  readonly installationId: string;
+
+  /**
+   * The secret holding the PEM private key of the GitHub App.
+   */
+  readonly privateKey: secretsmanager.ISecret;
+}
+
+/**
+ * How to read the credentials of a JSON secret. A secret holding only a token is sent
+ * as a bearer token.
+ */
+export interface SecretOptions {
+  /**
+   * The JSON key of the username.
+   *
+   * @default 'username'
+   */
+  readonly usernameKey?: string;
+
+  /**
+   * The JSON key of the password.
+   *
+   * @default 'password'
+   */
+  readonly passwordKey?: string;
+
+  /**
+   * The JSON key of a bearer token.
+   *
+   * @default 'token'
+   */
+  readonly tokenKey?: string;
+
+  /**
+   * The staging label of the version to read.
+   *
+   * @default 'AWSCURRENT'
+   */
+  readonly versionStage?: string;
+
+  /**
+   * The ID of the version to read, instead of a staging label.
+   *
+   * @default - the version of versionStage
+   */
+  readonly versionId?: string;
+}
+
+/**
+ * Copies of Docker Hub sources.
+ */
+export interface DockerHubOptions {
+  /**
+   * Whether to check the pull quota left before copying. A used up quota is waited for
+   * as set by `retry`, and a quota too low for the copy fails it.
+   *
+   * @default true
+   */
+  readonly checkRateLimit?: boolean;
+
+  /**
+   * The ECR pull-through cache of Docker Hub to copy from when the quota is too low, such
+   * as `123456789012.dkr.ecr.us-west-2.amazonaws.com/docker-hub`. The handler is granted
+   * `ecr:BatchImportUpstreamImage` and `ecr:CreateRepository` to pull through it.
+   *
+   * @default - None
+   */
+  readonly pullThroughCachePrefix?: string;
+}
+
+/**
+ * ECR pull-through cache rules. The handler is granted `ecr:BatchImportUpstreamImage` and
+ * `ecr:CreateRepository` to pull through them.
+ */
+export interface PullThroughCacheOptions {
+  /**
+   * The ECR registry of the rules, such as `123456789012.dkr.ecr.us-west-2.amazonaws.com`.
+   *
+   * @default - the registry of the destination
+   */
+  readonly registry?: string;
+
+  /**
+   * The repository prefix of the rule of each upstream registry, such as
+   * `{ 'docker.io': 'docker-hub' }`.
+   */
+  readonly rules: { [upstreamRegistry: string]: string };
+
+  /**
+   * Whether to copy from the upstream registry when the image can't be read from the cache.
+   *
+   * @default true
+   */
+  readonly fallbackOnMiss?: boolean;
+}
+
+/**
+ * Progress reporting of the copy of each blob.
+ */
+export interface ProgressOptions {
+  /**
+   * The interval between two reports of a blob.
+   *
+   * @default Duration.seconds(10)
+   */
+  readonly interval?: Duration;
+
+  /**
+   * An SNS topic to publish the reports to. The handler is granted `sns:Publish` on it.
+   *
+   * @default - None
+   */
+  readonly topic?: sns.ITopic;
+
+  /**
+   * An EventBridge bus to put the reports on, with the `cdk-ecr-deployment` source and
+   * the `Image Copy Progress` detail type. The handler is granted `events:PutEvents` on it.
+   *
+   * @default - None
+   */
+  readonly eventBus?: events.IEventBus;
+}
+
 export interface IImageName {
   /**
    *  The uri of the docker image.
@@ -116,10 +802,13 @@ export interface IImageName {
   readonly uri: string;
 
   /**
-   * The credentials of the docker image. Format `user:password` or `AWS Secrets Manager secret arn` or `AWS Secrets Manager secret name`.
+   * The credentials of the docker image. Format `user:password` or `AWS Secrets Manager secret arn` or `AWS Secrets Manager secret name`
+   * or `ssm:<SSM parameter name>` or `SSM parameter arn`.
    *
    * If specifying an AWS Secrets Manager secret, the format of the secret should be either plain text (`user:password`) or
-   * JSON (`{"username":"<username>","password":"<password>"}`).
+   * JSON (`{"username":"<username>","password":"<password>"}`). SSM parameters, e.g. SecureString ones, hold the same
+   * formats, and the handler is granted ssm:GetParameter on them. Set `srcCredsKey` or `destCredsKey` for creds
+   * encrypted with a customer managed key.
    *
    * For more details on JSON format, see https://docs.aws.amazon.com/AmazonECS/latest/developerguide/private-auth.html
    */
@@ -164,8 +853,10 @@ export class ECRDeployment extends Construct {
   constructor(scope: Construct, id: string, props: ECRDeploymentProps) {
     super(scope, id);
     const memoryLimit = props.memoryLimit ?? 512;
+    const tracing = props.tracing !== lambda.Tracing.DISABLED ? props.tracing : undefined;
+    const collectorLayer = tracing ? props.tracingCollectorLayer : undefined;
     this.handler = new lambda.SingletonFunction(this, 'CustomResourceHandler', {
-      uuid: this.renderSingletonUuid(memoryLimit),
+      uuid: this.renderSingletonUuid(memoryLimit, tracing, props.ephemeralStorageSize, collectorLayer),
       code: lambda.Code.fromAsset(path.join(__dirname, '../lambda-bin')),
       runtime: new lambda.Runtime('provided.al2023', RuntimeFamily.OTHER), // not using Runtime.PROVIDED_AL2023 to support older CDK versions (< 2.105.0)
       handler: 'bootstrap',
@@ -174,6 +865,13 @@ export class ECRDeployment extends Construct {
       timeout: Duration.minutes(15),
       role: props.role,
       memorySize: memoryLimit,
+      ephemeralStorageSize: props.ephemeralStorageSize,
+      tracing,
+      layers: collectorLayer ? [collectorLayer] : undefined,
+      environment: collectorLayer ? {
+        OTEL_TRACES_EXPORTER: 'otlp',
+        OTEL_EXPORTER_OTLP_ENDPOINT: 'http://localhost:4318',
+      } : undefined,
       vpc: props.vpc,
       vpcSubnets: props.vpcSubnets,
       securityGroups: props.securityGroups,
@@ -258,6 +956,9 @@ export class ECRDeployment extends Construct {
       }));
     }
 
+    if (props.retry && props.retryConfigs) {
+      throw new Error('retry and retryConfigs cannot both be set');
+    }
     if (props.imageArch && props.copyImageIndex) {
       throw new Error('imageArch and copyImageIndex cannot both be set');
     }
@@ -268,6 +969,29 @@ export class ECRDeployment extends Construct {
       throw new Error(`imageArch must contain exactly 1 element, got ${JSON.stringify(props.imageArch)}`);
     }
     const imageArch = props.imageArch ? props.imageArch[0] : '';
+    props.signingKey?.grant(handlerRole, 'kms:Sign', 'kms:GetPublicKey');
+    if (props.dockerHub?.pullThroughCachePrefix || props.pullThroughCache) {
+      this.grantPullThroughCache();
+    }
+    this.grantCredsParameter(props.src.creds);
+    this.grantCredsParameter(props.dest.creds);
+    props.srcCredsKey?.grantDecrypt(handlerRole);
+    props.destCredsKey?.grantDecrypt(handlerRole);
+    if (props.srcAuthConfig && props.src.creds) {
+      throw new Error('srcAuthConfig and the creds of src cannot both be set');
+    }
+    if (props.destAuthConfig && props.dest.creds) {
+      throw new Error('destAuthConfig and the creds of dest cannot both be set');
+    }
+    if (props.srcSecretOptions && !props.src.creds) {
+      throw new Error('srcSecretOptions require the creds of src to be a secret or an SSM parameter');
+    }
+    if (props.destSecretOptions && !props.dest.creds) {
+      throw new Error('destSecretOptions require the creds of dest to be a secret or an SSM parameter');
+    }
+    if (props.expectedSourceDigest && !Token.isUnresolved(props.expectedSourceDigest) && !/^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$/.test(props.expectedSourceDigest)) {
+      throw new Error(`expectedSourceDigest must be a digest such as sha256:<hex>, got ${props.expectedSourceDigest}`);
+    }
 
     new CustomResource(this, 'CustomResource', {
       serviceToken: this.handler.functionArn,
@@ -282,6 +1006,32 @@ export class ECRDeployment extends Construct {
         ...props.copyImageIndex ? { CopyImageIndex: props.copyImageIndex } : {},
         ...props.archImageTags ? { ArchImageTags: JSON.stringify(props.archImageTags) } : {},
         ...props.retryConfigs ? { RetryConfigs: JSON.stringify(props.retryConfigs) } : {},
+        ...props.retry ? {
+          RetryConfigs: JSON.stringify({
+            numAttempts: props.retry.numAttempts,
+            baseDelay: props.retry.baseDelay ? props.retry.baseDelay.toMilliseconds() / 1000 : undefined,
+            maxDelay: props.retry.maxDelay ? props.retry.maxDelay.toMilliseconds() / 1000 : undefined,
+            retryableErrors: props.retry.retryableErrors,
+          }),
+        } : {},
+        ...props.manifestFormat ? { ManifestFormat: props.manifestFormat } : {},
+        ...props.compression ? { CompressionConfigs: JSON.stringify(props.compression) } : {},
+        ...props.preserveDigests ? { PreserveDigests: props.preserveDigests } : {},
+        ...props.expectedSourceDigest ? { ExpectedSourceDigest: props.expectedSourceDigest } : {},
+        ...props.signaturePolicy ? { SignaturePolicy: props.signaturePolicy.bind(handlerRole) } : {},
+        ...props.copyReferrers ? { CopyReferrers: props.copyReferrers } : {},
+        ...props.signingKey ? { SigningKey: props.signingKey.keyArn } : {},
+        ...this.renderRole('Src', props.srcRole),
+        ...this.renderRole('Dest', props.destRole),
+        ...props.srcAuthConfig ? { SrcAuthConfig: props.srcAuthConfig.bind(handlerRole) } : {},
+        ...props.destAuthConfig ? { DestAuthConfig: props.destAuthConfig.bind(handlerRole) } : {},
+        ...props.srcRegistryAuth ? { SrcRegistryAuth: this.renderRegistryAuth(props.srcRegistryAuth, handlerRole) } : {},
+        ...props.destRegistryAuth ? { DestRegistryAuth: this.renderRegistryAuth(props.destRegistryAuth, handlerRole) } : {},
+        ...props.srcSecretOptions ? { SrcSecretConfigs: JSON.stringify(props.srcSecretOptions) } : {},
+        ...props.destSecretOptions ? { DestSecretConfigs: JSON.stringify(props.destSecretOptions) } : {},
+        ...props.progress ? { ProgressConfigs: this.renderProgress(props.progress, handlerRole) } : {},
+        ...props.dockerHub ? { DockerHubConfigs: Stack.of(this).toJsonString(props.dockerHub) } : {},
+        ...props.pullThroughCache ? { PullThroughCacheConfigs: Stack.of(this).toJsonString(props.pullThroughCache) } : {},
       },
     });
   }
@@ -293,7 +1043,93 @@ export class ECRDeployment extends Construct {
     return handlerRole.addToPrincipalPolicy(statement);
   }
 
-  private renderSingletonUuid(memoryLimit?: number) {
+  // Grants read access to the SSM parameter creds reference as `ssm:<name>` or by ARN.
+  private grantCredsParameter(creds?: string) {
+    if (!creds || Token.isUnresolved(creds)) { return; }
+    let parameterArn: string;
+    if (creds.startsWith('ssm:')) {
+      parameterArn = Arn.format({
+        service: 'ssm',
+        resource: 'parameter',
+        resourceName: creds.slice('ssm:'.length).replace(/^\//, ''),
+      }, Stack.of(this));
+    } else if (creds.startsWith('arn:') && creds.split(':')[2] === 'ssm') {
+      parameterArn = creds;
+    } else {
+      return;
+    }
+    this.addToPrincipalPolicy(new iam.PolicyStatement({
+      effect: iam.Effect.ALLOW,
+      actions: ['ssm:GetParameter'],
+      resources: [parameterArn],
+    }));
+  }
+
+  // Grants the pulls through ECR pull-through cache rules, which import the upstream images
+  // into repositories created on the first pull.
+  private grantPullThroughCache() {
+    this.addToPrincipalPolicy(new iam.PolicyStatement({
+      effect: iam.Effect.ALLOW,
+      actions: ['ecr:BatchImportUpstreamImage', 'ecr:CreateRepository'],
+      resources: ['*'],
+    }));
+  }
+
+  private renderRole(side: string, options?: AssumeRoleOptions): { [key: string]: string } {
+    if (!options) { return {}; }
+    this.addToPrincipalPolicy(new iam.PolicyStatement({
+      effect: iam.Effect.ALLOW,
+      actions: ['sts:AssumeRole'],
+      resources: [options.role.roleArn],
+    }));
+    return {
+      [`${side}RoleArn`]: options.role.roleArn,
+      ...options.externalId ? { [`${side}ExternalId`]: options.externalId } : {},
+      ...options.sessionName ? { [`${side}SessionName`]: options.sessionName } : {},
+    };
+  }
+
+  private renderRegistryAuth(options: RegistryAuthOptions, grantee: iam.IGrantable): string {
+    const secretArn = (secret: secretsmanager.ISecret) => {
+      secret.grantRead(grantee);
+      return secret.secretArn;
+    };
+    const { gcp, azure, github } = options;
+    if (gcp && !gcp.serviceAccountKey === !gcp.workloadIdentityAudience) {
+      throw new Error('gcp registry auth needs exactly one of serviceAccountKey and workloadIdentityAudience');
+    }
+    return Stack.of(this).toJsonString({
+      gcp: gcp ? {
+        serviceAccountKey: gcp.serviceAccountKey ? secretArn(gcp.serviceAccountKey) : undefined,
+        workloadIdentity: gcp.workloadIdentityAudience ? {
+          audience: gcp.workloadIdentityAudience,
+          serviceAccountEmail: gcp.workloadIdentityServiceAccountEmail,
+        } : undefined,
+      } : undefined,
+      azure: azure ? {
+        tenantId: azure.tenantId,
+        clientId: azure.clientId,
+        clientSecret: secretArn(azure.clientSecret),
+      } : undefined,
+      github: github ? {
+        appId: github.appId,
+        installationId: github.installationId,
+        privateKey: secretArn(github.privateKey),
+      } : undefined,
+    });
+  }
+
+  private renderProgress(options: ProgressOptions, grantee: iam.IGrantable): string {
+    options.topic?.grantPublish(grantee);
+    options.eventBus?.grantPutEventsTo(grantee);
+    return Stack.of(this).toJsonString({
+      interval: options.interval ? options.interval.toMilliseconds() / 1000 : undefined,
+      snsTopicArn: options.topic?.topicArn,
+      eventBusArn: options.eventBus?.eventBusArn,
+    });
+  }
+
+  private renderSingletonUuid(memoryLimit?: number, tracing?: lambda.Tracing, ephemeralStorageSize?: Size, collectorLayer?: lambda.ILayerVersion) {
     let uuid = 'bd07c930-edb9-4112-a20f-03f096f53666';
 
     // if user specify a custom memory limit, define another singleton handler
@@ -307,6 +1143,26 @@ export class ECRDeployment extends Construct {
       uuid += `-${memoryLimit.toString()}MiB`;
     }
 
+    // likewise for the tracing of the handler.
+    if (tracing) {
+      uuid += `-${tracing}`;
+    }
+
+    // and for its collector layer, whose ARN may hold tokens such as the region.
+    if (collectorLayer) {
+      const arn = JSON.stringify(Stack.of(this).resolve(collectorLayer.layerVersionArn));
+      uuid += `-${crypto.createHash('sha256').update(arn).digest('hex').slice(0, 8)}`;
+    }
+
+    // and for its ephemeral storage size.
+    if (ephemeralStorageSize) {
+      if (Token.isUnresolved(ephemeralStorageSize.toMebibytes())) {
+        throw new Error('Can\'t use tokens when specifying "ephemeralStorageSize" since we use it to identify the singleton custom resource handler');
+      }
+
+      uuid += `-${ephemeralStorageSize.toMebibytes().toString()}MiBStorage`;
+    }
+
     return uuid;
   }
 }
@@ -1,5 +1,5 @@
-import { Stack, App, aws_ecr as ecr, assertions } from 'aws-cdk-lib';
-import { DockerImageName, ECRDeployment } from '../src';
+import { Stack, App, Duration, Size, aws_ecr as ecr, aws_events as events, aws_iam as iam, aws_kms as kms, aws_lambda as lambda, aws_secretsmanager as secretsmanager, aws_sns as sns, aws_ssm as ssm, assertions } from 'aws-cdk-lib';
+import { AuthConfig, CompressionFormat, DockerImageName, ECRDeployment, ManifestFormat, SignaturePolicy } from '../src';
 
 // Yes, it's a lie. It's also the truth.
 const CUSTOM_RESOURCE_TYPE = 'Custom::CDKECRDeployment';
@@ -155,4 +155,493 @@ test('public ECR source with private ECR dest gets read-auth permissions only',
   const policyJson = JSON.stringify(template.toJSON());
   expect(policyJson).not.toContain('ecr-public:PutImage');
   expect(policyJson).not.toContain('ecr-public:InitiateLayerUpload');
-});
\ No newline at end of file
+});
+test('ManifestFormat is in custom resource properties if specified', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    manifestFormat: ManifestFormat.OCI,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    ManifestFormat: 'oci',
+  });
+});
+
+test('CompressionConfigs are rendered as JSON', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    compression: { format: CompressionFormat.ZSTD_CHUNKED, level: 3 },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    CompressionConfigs: '{"format":"zstd:chunked","level":3}',
+  });
+});
+
+test('PreserveDigests is in custom resource properties if specified', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    preserveDigests: true,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    PreserveDigests: true,
+  });
+});
+
+test('ExpectedSourceDigest is in custom resource properties if specified', () => {
+  const digest = 'sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef';
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    expectedSourceDigest: digest,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    ExpectedSourceDigest: digest,
+  });
+});
+
+test('expectedSourceDigest must be a digest', () => {
+  expect(() => new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    expectedSourceDigest: 'latest',
+  })).toThrow(/expectedSourceDigest must be a digest/);
+});
+
+test('SignaturePolicy documents are rendered as JSON', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    signaturePolicy: SignaturePolicy.fromDocument({ default: [{ type: 'reject' }] }),
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SignaturePolicy: '{"default":[{"type":"reject"}]}',
+  });
+});
+
+test('SignaturePolicy parameters are granted to the handler', () => {
+  const parameter = ssm.StringParameter.fromStringParameterName(stack, 'Policy', 'signature-policy');
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    signaturePolicy: SignaturePolicy.fromParameter(parameter),
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SignaturePolicy: stack.resolve(parameter.parameterArn),
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: assertions.Match.arrayWith(['ssm:GetParameter']),
+          Effect: 'Allow',
+        }),
+      ]),
+    },
+  });
+});
+
+test('CopyReferrers is in custom resource properties if specified', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    copyReferrers: true,
+    preserveDigests: true,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    CopyReferrers: true,
+    PreserveDigests: true,
+  });
+});
+
+test('SigningKey is granted kms:Sign and kms:GetPublicKey', () => {
+  const key = new kms.Key(stack, 'Key', {
+    keySpec: kms.KeySpec.ECC_NIST_P256,
+    keyUsage: kms.KeyUsage.SIGN_VERIFY,
+  });
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    signingKey: key,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SigningKey: stack.resolve(key.keyArn),
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: ['kms:Sign', 'kms:GetPublicKey'],
+          Effect: 'Allow',
+          Resource: stack.resolve(key.keyArn),
+        }),
+      ]),
+    },
+  });
+});
+
+test('SrcRole and DestRole are granted sts:AssumeRole', () => {
+  const srcRole = iam.Role.fromRoleArn(stack, 'SrcRole', 'arn:aws:iam::111111111111:role/ecr-reader');
+  const destRole = iam.Role.fromRoleArn(stack, 'DestRole', 'arn:aws:iam::222222222222:role/ecr-writer');
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    srcRole: { role: srcRole, externalId: 'external-id' },
+    destRole: { role: destRole, sessionName: 'deploy' },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SrcRoleArn: 'arn:aws:iam::111111111111:role/ecr-reader',
+    SrcExternalId: 'external-id',
+    SrcSessionName: assertions.Match.absent(),
+    DestRoleArn: 'arn:aws:iam::222222222222:role/ecr-writer',
+    DestSessionName: 'deploy',
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: 'sts:AssumeRole',
+          Effect: 'Allow',
+          Resource: 'arn:aws:iam::111111111111:role/ecr-reader',
+        }),
+        assertions.Match.objectLike({
+          Action: 'sts:AssumeRole',
+          Effect: 'Allow',
+          Resource: 'arn:aws:iam::222222222222:role/ecr-writer',
+        }),
+      ]),
+    },
+  });
+});
+
+test('SrcAuthConfig secrets are granted to the handler', () => {
+  const secret = new secretsmanager.Secret(stack, 'AuthConfig');
+  new ECRDeployment(stack, 'ECR', {
+    src: new DockerImageName('ghcr.io/owner/app:latest'),
+    dest,
+    srcAuthConfig: AuthConfig.fromSecret(secret),
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SrcAuthConfig: stack.resolve(secret.secretArn),
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: ['secretsmanager:GetSecretValue', 'secretsmanager:DescribeSecret'],
+          Effect: 'Allow',
+          Resource: stack.resolve(secret.secretArn),
+        }),
+      ]),
+    },
+  });
+});
+
+test('Cannot specify both srcAuthConfig and the creds of src', () => {
+  const secret = new secretsmanager.Secret(stack, 'AuthConfig');
+  expect(() => new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    srcAuthConfig: AuthConfig.fromSecret(secret),
+  })).toThrow(/srcAuthConfig and the creds of src cannot both be set/);
+});
+
+test('SrcRegistryAuth is rendered as JSON with its secrets granted', () => {
+  const privateKey = new secretsmanager.Secret(stack, 'PrivateKey');
+  new ECRDeployment(stack, 'ECR', {
+    src: new DockerImageName('ghcr.io/owner/app:latest'),
+    dest,
+    srcRegistryAuth: {
+      github: { appId: '1234', installationId: '5678', privateKey },
+    },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SrcRegistryAuth: {
+      'Fn::Join': ['', assertions.Match.arrayWith([
+        '{"github":{"appId":"1234","installationId":"5678","privateKey":"',
+        stack.resolve(privateKey.secretArn),
+      ])],
+    },
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: ['secretsmanager:GetSecretValue', 'secretsmanager:DescribeSecret'],
+          Resource: stack.resolve(privateKey.secretArn),
+        }),
+      ]),
+    },
+  });
+});
+
+test('gcp registry auth needs a key or a workload identity', () => {
+  expect(() => new ECRDeployment(stack, 'ECR', {
+    src: new DockerImageName('us-docker.pkg.dev/project/repo/app:latest'),
+    dest,
+    srcRegistryAuth: { gcp: {} },
+  })).toThrow(/exactly one of serviceAccountKey and workloadIdentityAudience/);
+});
+
+test('SrcSecretConfigs are rendered as JSON', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    srcSecretOptions: { usernameKey: 'user', passwordKey: 'pat', versionStage: 'AWSPREVIOUS' },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    SrcSecretConfigs: '{"usernameKey":"user","passwordKey":"pat","versionStage":"AWSPREVIOUS"}',
+  });
+});
+
+test('destSecretOptions require the creds of dest', () => {
+  expect(() => new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    destSecretOptions: { tokenKey: 'access_token' },
+  })).toThrow(/destSecretOptions require the creds of dest/);
+});
+
+test('SSM parameter creds are granted ssm:GetParameter', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src: new DockerImageName('javacs3/javacs3:latest', 'ssm:/dockerhub/creds'),
+    dest: new DockerImageName('111111111111.dkr.ecr.us-west-2.amazonaws.com/repo:copied', 'arn:aws:ssm:us-west-2:111111111111:parameter/registry/creds'),
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: 'ssm:GetParameter',
+          Resource: {
+            'Fn::Join': ['', assertions.Match.arrayWith([':parameter/dockerhub/creds'])],
+          },
+        }),
+        assertions.Match.objectLike({
+          Action: 'ssm:GetParameter',
+          Resource: 'arn:aws:ssm:us-west-2:111111111111:parameter/registry/creds',
+        }),
+      ]),
+    },
+  });
+});
+
+test('creds keys are granted kms:Decrypt', () => {
+  const key = kms.Key.fromKeyArn(stack, 'Key', 'arn:aws:kms:us-west-2:111111111111:key/1234abcd-12ab-34cd-56ef-1234567890ab');
+  new ECRDeployment(stack, 'ECR', {
+    src: new DockerImageName('javacs3/javacs3:latest', 'ssm:/dockerhub/creds'),
+    dest,
+    srcCredsKey: key,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: 'kms:Decrypt',
+          Resource: 'arn:aws:kms:us-west-2:111111111111:key/1234abcd-12ab-34cd-56ef-1234567890ab',
+        }),
+      ]),
+    },
+  });
+});
+
+test('ProgressConfigs are rendered and their sinks granted', () => {
+  const topic = sns.Topic.fromTopicArn(stack, 'Topic', 'arn:aws:sns:us-west-2:111111111111:progress');
+  const eventBus = events.EventBus.fromEventBusArn(stack, 'Bus', 'arn:aws:events:us-west-2:111111111111:event-bus/progress');
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    progress: { interval: Duration.seconds(30), topic, eventBus },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    ProgressConfigs: '{"interval":30,"snsTopicArn":"arn:aws:sns:us-west-2:111111111111:progress","eventBusArn":"arn:aws:events:us-west-2:111111111111:event-bus/progress"}',
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: 'sns:Publish',
+          Resource: 'arn:aws:sns:us-west-2:111111111111:progress',
+        }),
+        assertions.Match.objectLike({
+          Action: 'events:PutEvents',
+          Resource: 'arn:aws:events:us-west-2:111111111111:event-bus/progress',
+        }),
+      ]),
+    },
+  });
+});
+
+test('tracing enables X-Ray on a separate handler', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+  });
+  new ECRDeployment(stack, 'TracedECR', {
+    src,
+    dest,
+    tracing: lambda.Tracing.ACTIVE,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.resourceCountIs('AWS::Lambda::Function', 2);
+  template.hasResourceProperties('AWS::Lambda::Function', {
+    TracingConfig: { Mode: 'Active' },
+    Environment: assertions.Match.absent(),
+  });
+});
+
+test('tracing exports the spans through the collector layer', () => {
+  const layer = lambda.LayerVersion.fromLayerVersionArn(stack, 'Collector', 'arn:aws:lambda:us-west-2:901920570463:layer:aws-otel-collector-amd64-ver-0-102-1:1');
+  new ECRDeployment(stack, 'TracedECR', {
+    src,
+    dest,
+    tracing: lambda.Tracing.ACTIVE,
+  });
+  new ECRDeployment(stack, 'CollectedECR', {
+    src,
+    dest,
+    tracing: lambda.Tracing.ACTIVE,
+    tracingCollectorLayer: layer,
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.resourceCountIs('AWS::Lambda::Function', 2);
+  template.hasResourceProperties('AWS::Lambda::Function', {
+    TracingConfig: { Mode: 'Active' },
+    Layers: ['arn:aws:lambda:us-west-2:901920570463:layer:aws-otel-collector-amd64-ver-0-102-1:1'],
+    Environment: {
+      Variables: {
+        OTEL_TRACES_EXPORTER: 'otlp',
+        OTEL_EXPORTER_OTLP_ENDPOINT: 'http://localhost:4318',
+      },
+    },
+  });
+});
+
+test('RetryConfigs are rendered from retry', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    retry: {
+      numAttempts: 3,
+      baseDelay: Duration.millis(500),
+      maxDelay: Duration.seconds(30),
+      retryableErrors: { network: false },
+    },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    RetryConfigs: '{"numAttempts":3,"baseDelay":0.5,"maxDelay":30,"retryableErrors":{"network":false}}',
+  });
+});
+
+test('retry and retryConfigs cannot both be set', () => {
+  expect(() => new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    retry: { numAttempts: 3 },
+    retryConfigs: { numAttempts: 3 },
+  })).toThrow(/retry and retryConfigs cannot both be set/);
+});
+
+test('ephemeralStorageSize is set on a separate handler', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+  });
+  new ECRDeployment(stack, 'LargeECR', {
+    src,
+    dest,
+    ephemeralStorageSize: Size.gibibytes(10),
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.resourceCountIs('AWS::Lambda::Function', 2);
+  template.hasResourceProperties('AWS::Lambda::Function', {
+    EphemeralStorage: { Size: 10240 },
+  });
+});
+
+test('DockerHubConfigs are rendered and the pull-through cache granted', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    dockerHub: {
+      checkRateLimit: true,
+      pullThroughCachePrefix: '111111111111.dkr.ecr.us-west-2.amazonaws.com/docker-hub',
+    },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    DockerHubConfigs: '{"checkRateLimit":true,"pullThroughCachePrefix":"111111111111.dkr.ecr.us-west-2.amazonaws.com/docker-hub"}',
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: ['ecr:BatchImportUpstreamImage', 'ecr:CreateRepository'],
+          Resource: '*',
+        }),
+      ]),
+    },
+  });
+});
+
+test('PullThroughCacheConfigs are rendered and the pull-through cache granted', () => {
+  new ECRDeployment(stack, 'ECR', {
+    src,
+    dest,
+    pullThroughCache: {
+      rules: { 'docker.io': 'docker-hub' },
+      fallbackOnMiss: false,
+    },
+  });
+
+  const template = assertions.Template.fromStack(stack);
+  template.hasResourceProperties(CUSTOM_RESOURCE_TYPE, {
+    PullThroughCacheConfigs: '{"rules":{"docker.io":"docker-hub"},"fallbackOnMiss":false}',
+  });
+  template.hasResourceProperties('AWS::IAM::Policy', {
+    PolicyDocument: {
+      Statement: assertions.Match.arrayWith([
+        assertions.Match.objectLike({
+          Action: ['ecr:BatchImportUpstreamImage', 'ecr:CreateRepository'],
+          Resource: '*',
+        }),
+      ]),
+    },
+  });
+});